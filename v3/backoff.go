@@ -0,0 +1,14 @@
+package datahelperlite
+
+import "time"
+
+// ExponentialBackoff returns a backoff that doubles from base after each attempt, up to limit
+func ExponentialBackoff(base, limit time.Duration) func(attempts int) time.Duration {
+	return func(attempts int) time.Duration {
+		d := base
+		for i := 1; i < attempts && d < limit; i++ {
+			d *= 2
+		}
+		return min(d, limit)
+	}
+}
@@ -0,0 +1,256 @@
+package datahelperlite
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// Errors
+var (
+	ErrBulkheadUnknownLane error = errors.New(`bulkhead lane is not configured`)
+	ErrBulkheadOverweight  error = errors.New(`weight exceeds the lane capacity`)
+)
+
+// DefaultLane is the lane used when the context names none
+const DefaultLane = `default`
+
+type laneKey struct{}
+
+type laneRequest struct {
+	name   string
+	weight int64
+}
+
+// WithLane returns a context that makes Acquire take weight permits from the named bulkhead lane
+func WithLane(ctx context.Context, name string, weight int64) context.Context {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	if weight <= 0 {
+		weight = 1
+	}
+	return context.WithValue(ctx, laneKey{}, laneRequest{name: name, weight: weight})
+}
+
+// LaneStats are the statistics of a bulkhead lane
+type LaneStats struct {
+	Capacity  int64         // Permits of the lane
+	InUse     int64         // Permits held
+	Waiting   int           // Acquirers in the queue
+	Acquired  uint64        // Successful acquisitions
+	Canceled  uint64        // Acquisitions abandoned because the context ended
+	WaitTotal time.Duration // Total time spent waiting
+}
+
+// Bulkhead limits concurrent helpers per named lane with weighted permits.
+//
+// Heavy work, such as reports, can be put in its own lane so that it cannot
+// take every connection of a handle from latency-sensitive work.
+type Bulkhead struct {
+	mu    sync.Mutex
+	lanes map[string]*bulkheadLane
+}
+
+type bulkheadLane struct {
+	stats   LaneStats
+	waiters list.List // of *bulkheadWaiter
+}
+
+type bulkheadWaiter struct {
+	weight int64
+	ready  chan struct{}
+}
+
+// NewBulkhead creates a bulkhead with lane capacities by name.
+// Add a DefaultLane entry to limit acquisitions whose context names no lane.
+func NewBulkhead(lanes map[string]int64) *Bulkhead {
+	b := &Bulkhead{lanes: make(map[string]*bulkheadLane, len(lanes))}
+	for name, capacity := range lanes {
+		b.lanes[name] = &bulkheadLane{stats: LaneStats{Capacity: capacity}}
+	}
+	return b
+}
+
+// Acquire waits for weight permits of a lane until the context ends. The returned function gives the permits back.
+func (b *Bulkhead) Acquire(ctx context.Context, lane string, weight int64) (func(), error) {
+	if weight <= 0 {
+		weight = 1
+	}
+	b.mu.Lock()
+	l, ok := b.lanes[lane]
+	if !ok {
+		b.mu.Unlock()
+		return nil, ErrBulkheadUnknownLane
+	}
+	if weight > l.stats.Capacity {
+		b.mu.Unlock()
+		return nil, ErrBulkheadOverweight
+	}
+	if l.waiters.Len() == 0 && l.stats.InUse+weight <= l.stats.Capacity {
+		l.stats.InUse += weight
+		l.stats.Acquired++
+		b.mu.Unlock()
+		return b.releaser(l, weight), nil
+	}
+
+	start := time.Now()
+	w := &bulkheadWaiter{weight: weight, ready: make(chan struct{})}
+	elem := l.waiters.PushBack(w)
+	l.stats.Waiting = l.waiters.Len()
+	b.mu.Unlock()
+
+	select {
+	case <-w.ready:
+		b.mu.Lock()
+		l.stats.WaitTotal += time.Since(start)
+		b.mu.Unlock()
+		return b.releaser(l, weight), nil
+	case <-ctx.Done():
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		l.stats.WaitTotal += time.Since(start)
+		select {
+		case <-w.ready:
+			// Granted while canceling, give it back
+			l.stats.InUse -= weight
+			l.stats.Acquired--
+			b.notify(l)
+		default:
+			l.waiters.Remove(elem)
+			l.stats.Waiting = l.waiters.Len()
+			// Waiters behind a large one may fit now
+			b.notify(l)
+		}
+		l.stats.Canceled++
+		return nil, ctx.Err()
+	}
+}
+
+// Stats returns the statistics of all lanes by name
+func (b *Bulkhead) Stats() map[string]LaneStats {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	st := make(map[string]LaneStats, len(b.lanes))
+	for name, l := range b.lanes {
+		st[name] = l.stats
+	}
+	return st
+}
+
+// releaser returns a function that gives permits back once
+func (b *Bulkhead) releaser(l *bulkheadLane, weight int64) func() {
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			b.mu.Lock()
+			defer b.mu.Unlock()
+			l.stats.InUse -= weight
+			b.notify(l)
+		})
+	}
+}
+
+// notify grants permits to waiters in order while they fit. It must be called with the lock held.
+func (b *Bulkhead) notify(l *bulkheadLane) {
+	for {
+		front := l.waiters.Front()
+		if front == nil {
+			break
+		}
+		w := front.Value.(*bulkheadWaiter)
+		if l.stats.InUse+w.weight > l.stats.Capacity {
+			break
+		}
+		l.stats.InUse += w.weight
+		l.stats.Acquired++
+		l.waiters.Remove(front)
+		close(w.ready)
+	}
+	l.stats.Waiting = l.waiters.Len()
+}
+
+type bulkheadPermitKey struct{}
+
+// Interceptor returns an interceptor that makes Acquire wait for permits of the lane named in its context (see WithLane).
+//
+// The permits are held until the helper is released or acquired again, or the context given to Acquire ends.
+// Contexts that name no lane take one permit of the DefaultLane, if there is one.
+func (b *Bulkhead) Interceptor() Interceptor {
+	return func(op *Operation, next Invoker) error {
+		switch op.Method {
+		case "Acquire":
+		case "Release":
+			err := next(op)
+			releasePermits(op)
+			return err
+		default:
+			return next(op)
+		}
+		// A helper acquired again gives back what it held
+		releasePermits(op)
+
+		ctx := op.Context
+		if ctx == nil {
+			ctx = context.Background()
+		}
+		req, named := ctx.Value(laneKey{}).(laneRequest)
+		if !named {
+			req = laneRequest{name: DefaultLane, weight: 1}
+			b.mu.Lock()
+			_, ok := b.lanes[DefaultLane]
+			b.mu.Unlock()
+			if !ok {
+				return next(op)
+			}
+		}
+		release, err := b.Acquire(ctx, req.name, req.weight)
+		if err != nil {
+			return err
+		}
+		if err := next(op); err != nil {
+			release()
+			return err
+		}
+		stop := context.AfterFunc(ctx, release)
+		op.SetValue(bulkheadPermitKey{}, func() {
+			stop()
+			release()
+		})
+		return nil
+	}
+}
+
+// releasePermits gives back the permits held by the helper running the operation
+func releasePermits(op *Operation) {
+	if rel, ok := op.Value(bulkheadPermitKey{}).(func()); ok {
+		rel()
+		op.SetValue(bulkheadPermitKey{}, nil)
+	}
+}
+
+// HandleBulkheads returns an interceptor that applies the bulkhead registered for the name of the acquired handle.
+//
+// Handles without a bulkhead are not limited.
+func HandleBulkheads(byHandle map[string]*Bulkhead) Interceptor {
+	return func(op *Operation, next Invoker) error {
+		switch op.Method {
+		case "Acquire":
+		case "Release":
+			err := next(op)
+			releasePermits(op)
+			return err
+		default:
+			return next(op)
+		}
+		b, ok := byHandle[HandleName(op.Handle)]
+		if !ok {
+			// Release what an earlier acquisition with a limited handle held
+			releasePermits(op)
+			return next(op)
+		}
+		return b.Interceptor()(op, next)
+	}
+}
@@ -0,0 +1,288 @@
+package datahelperlite
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// BreakerState is the state of a circuit breaker
+type BreakerState uint8
+
+// Breaker states
+const (
+	BreakerClosed   BreakerState = 0 // Operations pass
+	BreakerOpen     BreakerState = 1 // Operations fail fast
+	BreakerHalfOpen BreakerState = 2 // A limited number of probe operations pass
+)
+
+// Errors
+var (
+	ErrCircuitOpen error = errors.New(`circuit breaker is open`)
+)
+
+// BreakerOptions configures a circuit breaker. Zero values take the defaults.
+type BreakerOptions struct {
+	ConsecutiveFailures int              // Open after this many failures in a row. The default is 5. Negative disables it.
+	ErrorRate           float64          // Open when the failure ratio within the window reaches this, from 0 to 1. Zero disables it.
+	MinRequests         int              // Operations needed in the window before ErrorRate applies. The default is 20.
+	Window              time.Duration    // Window of the error rate. The default is 10 seconds.
+	OpenTimeout         time.Duration    // Time spent open before going half-open. The default is 30 seconds.
+	HalfOpenProbes      int              // Probes that must succeed in half-open to close. The default is 1.
+	IsFailure           func(error) bool // Errors that count as failures. The default counts connection and timeout errors.
+	Now                 func() time.Time // Clock, for tests
+}
+
+// CircuitBreaker fails operations fast while the database is unhealthy
+type CircuitBreaker struct {
+	mu       sync.Mutex
+	opts     BreakerOptions
+	state    BreakerState
+	openedAt time.Time
+	streak   int // consecutive failures
+	probes   int // probes let through in half-open
+	passed   int // probes that succeeded in half-open
+	winStart time.Time
+	winTotal int
+	winFails int
+}
+
+// NewCircuitBreaker creates a circuit breaker
+func NewCircuitBreaker(opts BreakerOptions) *CircuitBreaker {
+	if opts.ConsecutiveFailures == 0 {
+		opts.ConsecutiveFailures = 5
+	}
+	if opts.MinRequests <= 0 {
+		opts.MinRequests = 20
+	}
+	if opts.Window <= 0 {
+		opts.Window = 10 * time.Second
+	}
+	if opts.OpenTimeout <= 0 {
+		opts.OpenTimeout = 30 * time.Second
+	}
+	if opts.HalfOpenProbes <= 0 {
+		opts.HalfOpenProbes = 1
+	}
+	if opts.IsFailure == nil {
+		opts.IsFailure = func(err error) bool {
+			switch ClassifyError(err) {
+			case ErrorClassConnection, ErrorClassTimeout:
+				return true
+			}
+			return false
+		}
+	}
+	if opts.Now == nil {
+		opts.Now = time.Now
+	}
+	return &CircuitBreaker{opts: opts}
+}
+
+// State returns the current state
+func (cb *CircuitBreaker) State() BreakerState {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	cb.advance()
+	return cb.state
+}
+
+// Allow reports if an operation may run. It returns ErrCircuitOpen when it may not.
+//
+// Every allowed operation must be followed by a call to Record.
+func (cb *CircuitBreaker) Allow() error {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	cb.advance()
+	switch cb.state {
+	case BreakerOpen:
+		return ErrCircuitOpen
+	case BreakerHalfOpen:
+		if cb.probes >= cb.opts.HalfOpenProbes {
+			return ErrCircuitOpen
+		}
+		cb.probes++
+	}
+	return nil
+}
+
+// Record records the outcome of an allowed operation
+func (cb *CircuitBreaker) Record(err error) {
+	failed := err != nil && cb.opts.IsFailure(err)
+
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	now := cb.opts.Now()
+	switch cb.state {
+	case BreakerHalfOpen:
+		if failed {
+			cb.trip(now)
+			return
+		}
+		cb.passed++
+		if cb.passed >= cb.opts.HalfOpenProbes {
+			cb.close()
+		}
+		return
+	case BreakerOpen:
+		return
+	}
+
+	if now.Sub(cb.winStart) >= cb.opts.Window {
+		cb.winStart, cb.winTotal, cb.winFails = now, 0, 0
+	}
+	cb.winTotal++
+	if !failed {
+		cb.streak = 0
+		return
+	}
+	cb.winFails++
+	cb.streak++
+	if cb.opts.ConsecutiveFailures > 0 && cb.streak >= cb.opts.ConsecutiveFailures {
+		cb.trip(now)
+		return
+	}
+	if cb.opts.ErrorRate > 0 && cb.winTotal >= cb.opts.MinRequests &&
+		float64(cb.winFails)/float64(cb.winTotal) >= cb.opts.ErrorRate {
+		cb.trip(now)
+	}
+}
+
+// Trip opens the breaker
+func (cb *CircuitBreaker) Trip() {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	cb.trip(cb.opts.Now())
+}
+
+// Reset closes the breaker
+func (cb *CircuitBreaker) Reset() {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	cb.close()
+}
+
+// ReconnectHook returns a hook for Reconnect (see OnReconnectEvent).
+//
+// A lost connection opens the breaker, and the connection opened again after it closes the breaker.
+// Healthy pings leave the breaker alone: a database that answers pings may still fail operations.
+func (cb *CircuitBreaker) ReconnectHook() func(ReconnectEvent) {
+	var lost atomic.Bool
+	return func(ev ReconnectEvent) {
+		switch ev.Kind {
+		case ReconnectLost:
+			lost.Store(true)
+			cb.Trip()
+		case ReconnectConnected:
+			if lost.Swap(false) {
+				cb.Reset()
+			}
+		}
+	}
+}
+
+// HalfOpen moves an open breaker to half-open at once, so that the next operations probe the database
+func (cb *CircuitBreaker) HalfOpen() {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	if cb.state == BreakerOpen {
+		cb.state = BreakerHalfOpen
+		cb.probes, cb.passed = 0, 0
+	}
+}
+
+// advance moves an open breaker to half-open once the open timeout has passed
+func (cb *CircuitBreaker) advance() {
+	if cb.state == BreakerOpen && cb.opts.Now().Sub(cb.openedAt) >= cb.opts.OpenTimeout {
+		cb.state = BreakerHalfOpen
+		cb.probes, cb.passed = 0, 0
+	}
+}
+
+func (cb *CircuitBreaker) trip(now time.Time) {
+	cb.state = BreakerOpen
+	cb.openedAt = now
+	cb.streak, cb.probes, cb.passed = 0, 0, 0
+}
+
+func (cb *CircuitBreaker) close() {
+	cb.state = BreakerClosed
+	cb.streak, cb.probes, cb.passed = 0, 0, 0
+	cb.winStart, cb.winTotal, cb.winFails = time.Time{}, 0, 0
+}
+
+// unguardedMethods always pass the breaker so that transactions can be finished and helpers released
+var unguardedMethods = map[string]bool{
+	"Commit":   true,
+	"Rollback": true,
+	"Release":  true,
+}
+
+// Interceptor returns an interceptor that fails helper operations with ErrCircuitOpen while the breaker is open
+func (cb *CircuitBreaker) Interceptor() Interceptor {
+	return func(op *Operation, next Invoker) error {
+		return cb.guard(op, next)
+	}
+}
+
+func (cb *CircuitBreaker) guard(op *Operation, next Invoker) error {
+	if unguardedMethods[op.Method] {
+		err := next(op)
+		if err != nil && cb.opts.IsFailure(err) {
+			cb.Record(err)
+		}
+		return err
+	}
+	if err := cb.Allow(); err != nil {
+		return err
+	}
+	err := next(op)
+	cb.Record(err)
+	return err
+}
+
+// BreakerHandle is a handle guarded by a circuit breaker.
+//
+// Its Ping feeds the breaker, so passing it to Reconnect lets probes through
+// once the database answers again. Helpers wrapped with CircuitBreaking
+// and acquired with this handle fail fast while the breaker is open.
+type BreakerHandle struct {
+	DataHelperHandle
+	cb *CircuitBreaker
+}
+
+// NewBreakerHandle guards a handle with a circuit breaker
+func NewBreakerHandle(h DataHelperHandle, opts BreakerOptions) *BreakerHandle {
+	return &BreakerHandle{DataHelperHandle: h, cb: NewCircuitBreaker(opts)}
+}
+
+// Breaker returns the circuit breaker of the handle
+func (bh *BreakerHandle) Breaker() *CircuitBreaker {
+	return bh.cb
+}
+
+// Ping pings the database. A failed ping opens the breaker. A successful one moves an open breaker to
+// half-open, leaving it to the probe operations to close it.
+func (bh *BreakerHandle) Ping() error {
+	err := bh.DataHelperHandle.Ping()
+	if err != nil {
+		bh.cb.Trip()
+		return err
+	}
+	bh.cb.HalfOpen()
+	return nil
+}
+
+// CircuitBreaking returns an interceptor that guards operations with the breaker of the acquired handle.
+//
+// Operations pass unguarded when the handle is not a BreakerHandle.
+func CircuitBreaking() Interceptor {
+	return func(op *Operation, next Invoker) error {
+		bh, ok := op.Handle.(*BreakerHandle)
+		if !ok {
+			return next(op)
+		}
+		return bh.cb.guard(op, next)
+	}
+}
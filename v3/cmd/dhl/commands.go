@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"text/tabwriter"
+
+	dhl "github.com/NarsilWorks-Inc/datahelperlite/v3"
+	"github.com/NarsilWorks-Inc/datahelperlite/v3/migrate"
+)
+
+// env is what commands work with
+type env struct {
+	dh     dhl.DataHelperLite
+	handle dhl.DataHelperHandle
+	out    io.Writer
+	errOut io.Writer
+}
+
+// command runs a command with its arguments
+type command func(ctx context.Context, e *env, args []string) error
+
+var commands = map[string]command{
+	"ping":              ping,
+	"version":           version,
+	"migrate":           migrateCmd,
+	"query":             query,
+	"exec":              execCmd,
+	"vendor-statements": vendorStatements,
+}
+
+// untimed are the commands that -timeout does not limit
+var untimed = map[string]bool{
+	"migrate": true,
+}
+
+func ping(_ context.Context, e *env, _ []string) error {
+	if err := e.handle.Ping(); err != nil {
+		return err
+	}
+	_, err := fmt.Fprintln(e.out, "ok")
+	return err
+}
+
+func version(_ context.Context, e *env, _ []string) error {
+	_, err := fmt.Fprintln(e.out, e.dh.DatabaseVersion())
+	return err
+}
+
+func query(_ context.Context, e *env, args []string) error {
+	fs := e.flags("query")
+	format := fs.String("format", "table", "output format: table, csv or json")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() == 0 {
+		return fmt.Errorf("%w: query needs a statement", ErrUsage)
+	}
+	w, ok := writers[*format]
+	if !ok {
+		return fmt.Errorf("%w: unknown format %q", ErrUsage, *format)
+	}
+	rows, err := e.dh.Query(fs.Arg(0), params(fs.Args()[1:])...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	return w(e.out, rows)
+}
+
+func execCmd(_ context.Context, e *env, args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("%w: exec needs a statement", ErrUsage)
+	}
+	n, err := e.dh.Exec(args[0], params(args[1:])...)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(e.out, "%d rows affected\n", n)
+	return err
+}
+
+func vendorStatements(_ context.Context, e *env, args []string) error {
+	fs := e.flags("vendor-statements")
+	withSQL := fs.Bool("sql", false, "print the statements too")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	keys := e.dh.VendorStatements()
+	sort.Strings(keys)
+	for _, k := range keys {
+		line := k
+		if *withSQL {
+			line += "\t" + e.dh.VendorStatement(k)
+		}
+		if _, err := fmt.Fprintln(e.out, line); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func migrateCmd(ctx context.Context, e *env, args []string) error {
+	fs := e.flags("migrate")
+	dir := fs.String("dir", "migrations", "directory of the migration files")
+	dryRun := fs.Bool("dry-run", false, "print the statements instead of running them")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() == 0 || fs.NArg() > 2 {
+		return fmt.Errorf("%w: migrate up [version], down [steps] or status", ErrUsage)
+	}
+	m, err := migrate.New(e.dh, e.handle, os.DirFS(*dir), migrate.Options{DryRun: *dryRun, Output: e.out})
+	if err != nil {
+		return err
+	}
+	n := int64(-1)
+	if fs.NArg() == 2 {
+		if n, err = strconv.ParseInt(fs.Arg(1), 10, 64); err != nil || n < 0 {
+			return fmt.Errorf("%w: %q is not a version or a number of steps", ErrUsage, fs.Arg(1))
+		}
+	}
+
+	var done []migrate.Migration
+	switch fs.Arg(0) {
+	case "up":
+		done, err = m.UpTo(ctx, n)
+	case "down":
+		if n == 0 {
+			return fmt.Errorf("%w: migrate down needs at least one step", ErrUsage)
+		}
+		done, err = m.Down(ctx, int(max(n, 1)))
+	case "status":
+		return printStatus(ctx, e.out, m)
+	default:
+		return fmt.Errorf("%w: migrate %s", ErrUnknownCommand, fs.Arg(0))
+	}
+	verb := map[string]string{"up": "applied", "down": "reverted"}[fs.Arg(0)]
+	if *dryRun {
+		verb = map[string]string{"up": "would apply", "down": "would revert"}[fs.Arg(0)]
+	}
+	for _, mig := range done {
+		fmt.Fprintf(e.out, "%s %s\n", verb, mig)
+	}
+	if len(done) == 0 && err == nil {
+		fmt.Fprintln(e.out, "nothing to do")
+	}
+	return err
+}
+
+func printStatus(ctx context.Context, out io.Writer, m *migrate.Migrator) error {
+	st, err := m.Status(ctx)
+	if err != nil {
+		return err
+	}
+	tw := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "VERSION\tNAME\tSTATE\tAPPLIED AT")
+	for _, s := range st {
+		state, at := "pending", ""
+		switch {
+		case s.Missing:
+			state = "applied, file missing"
+		case s.Changed:
+			state = "applied, file changed"
+		case s.Applied:
+			state = "applied"
+		}
+		if s.Applied {
+			at = s.AppliedAt.Format("2006-01-02 15:04:05")
+		}
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%s\n", s.Version, s.Name, state, at)
+	}
+	return tw.Flush()
+}
+
+// flags returns the flag set of a command
+func (e *env) flags(name string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.SetOutput(e.errOut)
+	return fs
+}
+
+// params turns command line arguments into statement parameters
+func params(args []string) []any {
+	out := make([]any, len(args))
+	for i, a := range args {
+		out[i] = a
+	}
+	return out
+}
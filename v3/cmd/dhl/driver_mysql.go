@@ -0,0 +1,14 @@
+//go:build mysql
+
+package main
+
+import (
+	dhl "github.com/NarsilWorks-Inc/datahelperlite/v3"
+	"github.com/NarsilWorks-Inc/datahelperlite/v3/cmd/dhl/internal/sqlhelper"
+	_ "github.com/go-sql-driver/mysql"
+)
+
+func init() {
+	dhl.SetHelper("mysql", &sqlhelper.Helper{})
+	dhl.SetHandler("mysql", &sqlhelper.Handle{})
+}
@@ -0,0 +1,14 @@
+//go:build postgres
+
+package main
+
+import (
+	dhl "github.com/NarsilWorks-Inc/datahelperlite/v3"
+	"github.com/NarsilWorks-Inc/datahelperlite/v3/cmd/dhl/internal/sqlhelper"
+	_ "github.com/jackc/pgx/v5/stdlib"
+)
+
+func init() {
+	dhl.SetHelper("postgres", &sqlhelper.Helper{})
+	dhl.SetHandler("postgres", &sqlhelper.Handle{})
+}
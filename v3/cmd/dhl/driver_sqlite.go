@@ -0,0 +1,14 @@
+//go:build sqlite
+
+package main
+
+import (
+	dhl "github.com/NarsilWorks-Inc/datahelperlite/v3"
+	"github.com/NarsilWorks-Inc/datahelperlite/v3/cmd/dhl/internal/sqlhelper"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+func init() {
+	dhl.SetHelper("sqlite", &sqlhelper.Helper{})
+	dhl.SetHandler("sqlite", &sqlhelper.Handle{})
+}
@@ -0,0 +1,14 @@
+//go:build sqlserver
+
+package main
+
+import (
+	dhl "github.com/NarsilWorks-Inc/datahelperlite/v3"
+	"github.com/NarsilWorks-Inc/datahelperlite/v3/cmd/dhl/internal/sqlhelper"
+	_ "github.com/microsoft/go-mssqldb"
+)
+
+func init() {
+	dhl.SetHelper("sqlserver", &sqlhelper.Helper{})
+	dhl.SetHandler("sqlserver", &sqlhelper.Handle{})
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"sort"
+	"strings"
+
+	dhl "github.com/NarsilWorks-Inc/datahelperlite/v3"
+)
+
+// Drivers are linked in with build tags. Each one has a file of its own, named driver_<tag>.go, that
+// links the database/sql driver in and registers the helper and handle of internal/sqlhelper under
+// the HelperID its connections use:
+//
+//	driver_postgres.go   postgres   github.com/jackc/pgx/v5/stdlib, DriverName pgx
+//	driver_sqlserver.go  sqlserver  github.com/microsoft/go-mssqldb, DriverName sqlserver
+//	driver_mysql.go      mysql      github.com/go-sql-driver/mysql, DriverName mysql
+//	driver_sqlite.go     sqlite     github.com/mattn/go-sqlite3 (cgo), DriverName sqlite3
+//
+// The binary then serves the drivers of the tags it is built with. The command is a module of its own,
+// so that the library does not require the drivers; it is built from its directory:
+//
+//	cd v3/cmd/dhl && go build -tags postgres,sqlserver
+//
+// Other helpers are added the same way, with a file registering them under a tag of their own.
+
+// registered describes the HelperIDs that have both a helper and a handle registered
+func registered() string {
+	var ids []string
+	for id := range dhl.Helper {
+		if _, err := dhl.NewHandle(id); err == nil {
+			ids = append(ids, id)
+		}
+	}
+	if len(ids) == 0 {
+		return "no driver; build it with the tag of a driver file"
+	}
+	sort.Strings(ids)
+	return "the drivers " + strings.Join(ids, ", ")
+}
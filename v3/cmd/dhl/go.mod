@@ -0,0 +1,28 @@
+module github.com/NarsilWorks-Inc/datahelperlite/v3/cmd/dhl
+
+go 1.23.2
+
+toolchain go1.24.2
+
+require (
+	github.com/NarsilWorks-Inc/datahelperlite v0.0.0
+	github.com/eaglebush/datainfo v0.1.0
+	github.com/go-sql-driver/mysql v1.9.3
+	github.com/jackc/pgx/v5 v5.7.4
+	github.com/mattn/go-sqlite3 v1.14.33
+	github.com/microsoft/go-mssqldb v1.7.2
+)
+
+require (
+	filippo.io/edwards25519 v1.1.0 // indirect
+	github.com/golang-sql/civil v0.0.0-20220223132316-b832511892a9 // indirect
+	github.com/golang-sql/sqlexp v0.1.0 // indirect
+	github.com/jackc/pgpassfile v1.0.0 // indirect
+	github.com/jackc/pgservicefile v0.0.0-20240606120523-5a60cdf6a761 // indirect
+	github.com/jackc/puddle/v2 v2.2.2 // indirect
+	golang.org/x/crypto v0.31.0 // indirect
+	golang.org/x/sync v0.10.0 // indirect
+	golang.org/x/text v0.21.0 // indirect
+)
+
+replace github.com/NarsilWorks-Inc/datahelperlite => ../../..
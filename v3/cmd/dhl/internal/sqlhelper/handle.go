@@ -0,0 +1,131 @@
+// Package sqlhelper implements DataHelperLite and DataHelperHandle on database/sql for the dhl command.
+//
+// It serves the dialects of datahelperlite with the driver named by the DriverName of a connection,
+// which a driver file of the command links in and registers the helper for:
+//
+//	import _ "github.com/jackc/pgx/v5/stdlib"
+//
+//	dhl.SetHelper("postgres", &sqlhelper.Helper{})
+//	dhl.SetHandler("postgres", &sqlhelper.Handle{})
+//
+// Statements are written with ? placeholders and {table} names. The helper applies the schema of the
+// connection to the tables and replaces the placeholders with those of the dialect, or with the
+// ParameterPlaceHolder of the connection when it is set to another one than ?.
+package sqlhelper
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"sync"
+
+	dhl "github.com/NarsilWorks-Inc/datahelperlite/v3"
+	dn "github.com/eaglebush/datainfo"
+)
+
+// Errors
+var (
+	ErrNoDriverName error = errors.New(`driver name not set`)
+)
+
+// Handle is a DataHelperHandle on a database/sql connection pool
+type Handle struct {
+	mu  sync.RWMutex
+	db  *sql.DB
+	di  *dn.DataInfo
+	err error
+}
+
+// Open opens the connection pool of a database info and pings it. The pool settings of the info are applied (see datahelperlite.ConfigurePool).
+func (h *Handle) Open(di *dn.DataInfo) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if di != nil {
+		// Kept on failure, so that Reconnect can try again
+		h.di = di
+	}
+	switch {
+	case di == nil:
+		h.err = dhl.ErrHandleNoConn
+	case di.ConnectionString == nil || *di.ConnectionString == "":
+		h.err = dhl.ErrHandleNoConnStr
+	case di.DriverName == nil || *di.DriverName == "":
+		h.err = ErrNoDriverName
+	default:
+		h.err = h.open(*di.DriverName, *di.ConnectionString, di)
+	}
+	return h.err
+}
+
+func (h *Handle) open(driver, dsn string, di *dn.DataInfo) error {
+	db, err := sql.Open(driver, dsn)
+	if err != nil {
+		return err
+	}
+	dhl.ConfigurePool(db, di)
+	if err := db.PingContext(context.Background()); err != nil {
+		_ = db.Close()
+		return err
+	}
+	if h.db != nil {
+		_ = h.db.Close()
+	}
+	h.db = db
+	return nil
+}
+
+// Ping pings the database
+func (h *Handle) Ping() error {
+	db := h.DB()
+	if db == nil {
+		return dhl.ErrHandleNoHandle
+	}
+	err := db.Ping()
+	h.mu.Lock()
+	h.err = err
+	h.mu.Unlock()
+	return err
+}
+
+// DB returns the connection pool. It is nil before Open and after Close.
+func (h *Handle) DB() *sql.DB {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.db
+}
+
+// DI returns the database info of the last Open
+func (h *Handle) DI() *dn.DataInfo {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.di
+}
+
+// Close closes the connection pool and drops its prepared statement cache. The database info is kept for the next Open.
+func (h *Handle) Close() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.db == nil {
+		return nil
+	}
+	dhl.DropStmtCache(h.db)
+	err := h.db.Close()
+	h.db = nil
+	return err
+}
+
+// Err returns the error of the last Open or Ping
+func (h *Handle) Err() error {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.err
+}
+
+// Stats returns the statistics of the connection pool
+func (h *Handle) Stats() sql.DBStats {
+	db := h.DB()
+	if db == nil {
+		return sql.DBStats{}
+	}
+	return db.Stats()
+}
@@ -0,0 +1,698 @@
+package sqlhelper
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	dhl "github.com/NarsilWorks-Inc/datahelperlite/v3"
+	dn "github.com/eaglebush/datainfo"
+)
+
+// Errors
+var (
+	ErrInvalidIdentifier error = errors.New(`invalid column or serial name`)
+	ErrInvalidOperator   error = errors.New(`invalid column filter operator`)
+	ErrUpsertColumns     error = errors.New(`upsert needs insert columns matching the values, unique columns among them, and return columns`)
+	ErrNextUnsupported   error = errors.New(`serials are not supported by the dialect; set a SequenceGenerator`)
+)
+
+// Helper is a DataHelperLite on the connection pool of a handle. Its zero value is ready to be acquired.
+//
+// Statements run on the pool or in its transactions are prepared once, through the prepared statement
+// cache of the pool (see datahelperlite.StmtCacheFor). Those of a helper pinned to a connection are not.
+//
+// A helper is not safe for concurrent use; create one per goroutine with NewHelper.
+type Helper struct {
+	ctx       context.Context
+	db        *sql.DB
+	cache     *dhl.StmtCache
+	di        *dn.DataInfo
+	dialect   dhl.Dialect
+	conn      *sql.Conn // pinned connection, see PinConn
+	tx        *sql.Tx
+	manual    bool // the transaction was begun with BeginManually
+	committed bool // the last transaction begun with Begin committed, a deferred Rollback is expected
+}
+
+// querier runs statements on a pool, a connection or a transaction
+type querier interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+// NewHelper returns a new helper, to be acquired
+func (h *Helper) NewHelper() dhl.DataHelperLite {
+	return &Helper{}
+}
+
+// Acquire makes the helper run its statements on the pool of a handle, with a context
+func (h *Helper) Acquire(ctx context.Context, hnd dhl.DataHelperHandle) error {
+	if h.tx != nil {
+		return dhl.ErrHandleTxNotNil
+	}
+	if hnd == nil {
+		return dhl.ErrHandleNotSet
+	}
+	db := hnd.DB()
+	if db == nil {
+		return dhl.ErrHandleDBNotSet
+	}
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	h.ctx, h.db, h.di, h.dialect = ctx, db, hnd.DI(), dhl.DialectOf(hnd.DI())
+	h.cache = dhl.StmtCacheFor(db)
+	h.committed = false
+	return nil
+}
+
+// Release rolls back an open transaction and detaches the helper from its handle
+func (h *Helper) Release() error {
+	var err error
+	if h.tx != nil {
+		err = h.Rollback()
+	}
+	h.ctx, h.db, h.cache, h.committed = nil, nil, nil, false
+	return err
+}
+
+// PinConn makes the helper run its statements and transactions on a connection (see datahelperlite.ConnPinner)
+func (h *Helper) PinConn(conn *sql.Conn) {
+	h.conn = conn
+}
+
+func (h *Helper) Begin() error {
+	return h.begin(false)
+}
+
+func (h *Helper) BeginManually() error {
+	return h.begin(true)
+}
+
+func (h *Helper) begin(manual bool) error {
+	if h.tx != nil {
+		return dhl.ErrHandleTxNotNil
+	}
+	if h.db == nil {
+		return dhl.ErrHandleNotSet
+	}
+	var (
+		tx  *sql.Tx
+		err error
+	)
+	if h.conn != nil {
+		tx, err = h.conn.BeginTx(h.ctx, nil)
+	} else {
+		tx, err = h.db.BeginTx(h.ctx, nil)
+	}
+	if err != nil {
+		return err
+	}
+	h.tx, h.manual, h.committed = tx, manual, false
+	return nil
+}
+
+func (h *Helper) Commit() error {
+	if h.tx == nil {
+		return dhl.ErrNoTx
+	}
+	err := h.tx.Commit()
+	h.tx, h.committed = nil, !h.manual
+	return err
+}
+
+// Rollback rolls back the transaction. After the Commit of a transaction begun with Begin, it does nothing.
+func (h *Helper) Rollback() error {
+	if h.tx == nil {
+		if h.committed {
+			h.committed = false
+			return nil
+		}
+		return dhl.ErrNoTx
+	}
+	err := h.tx.Rollback()
+	h.tx = nil
+	if errors.Is(err, sql.ErrTxDone) {
+		// The context ended and database/sql rolled back already
+		return nil
+	}
+	return err
+}
+
+func (h *Helper) Mark(name string) error {
+	if h.dialect == dhl.DialectSQLServer {
+		return h.savepoint(`SAVE TRANSACTION %s`, name)
+	}
+	return h.savepoint(`SAVEPOINT %s`, name)
+}
+
+func (h *Helper) Save(name string) error {
+	if h.dialect == dhl.DialectSQLServer {
+		// SQL Server savepoints end with the transaction
+		if h.tx == nil {
+			return dhl.ErrNoTx
+		}
+		return nil
+	}
+	return h.savepoint(`RELEASE SAVEPOINT %s`, name)
+}
+
+func (h *Helper) Discard(name string) error {
+	if h.dialect == dhl.DialectSQLServer {
+		return h.savepoint(`ROLLBACK TRANSACTION %s`, name)
+	}
+	return h.savepoint(`ROLLBACK TO SAVEPOINT %s; RELEASE SAVEPOINT %s`, name)
+}
+
+func (h *Helper) savepoint(format, name string) error {
+	if h.tx == nil {
+		return dhl.ErrNoTx
+	}
+	if !isIdentifier(name) {
+		return fmt.Errorf("%w: %q", ErrInvalidIdentifier, name)
+	}
+	for _, s := range strings.Split(format, "; ") {
+		if _, err := h.tx.ExecContext(h.ctx, fmt.Sprintf(s, h.dialect.QuoteIdent(name))); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// DatabaseVersion returns the version reported by the database, or an empty string when it cannot tell
+func (h *Helper) DatabaseVersion() string {
+	var v string
+	q := h.VendorStatement(`version`)
+	if q == "" || h.QueryRow(q).Scan(&v) != nil {
+		return ""
+	}
+	return v
+}
+
+// Escape doubles the single quotes of a value
+func (h *Helper) Escape(fv string) string {
+	return strings.ReplaceAll(fv, `'`, `''`)
+}
+
+func (h *Helper) Exec(sql string, args ...any) (int64, error) {
+	q, err := h.querier()
+	if err != nil {
+		return 0, err
+	}
+	res, err := q.ExecContext(h.ctx, h.statement(sql), args...)
+	if err != nil {
+		return 0, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		// The driver does not count rows
+		return 0, nil
+	}
+	return n, nil
+}
+
+func (h *Helper) Exists(sql string, args ...any) (bool, error) {
+	q, err := h.querier()
+	if err != nil {
+		return false, err
+	}
+	rows, err := q.QueryContext(h.ctx, h.statement(sql), args...)
+	if err != nil {
+		return false, err
+	}
+	defer rows.Close()
+	found := rows.Next()
+	return found, rows.Err()
+}
+
+// filterOperators are the operators allowed in column filters
+var filterOperators = map[string]bool{
+	"=": true, "<>": true, "!=": true, "<": true, "<=": true, ">": true, ">=": true, "LIKE": true, "NOT LIKE": true,
+}
+
+// ExistsExt checks if a row of a table matches all the filters. A nil value matches NULL with = and <>.
+func (h *Helper) ExistsExt(tableName string, values []dhl.ColumnFilter) (bool, error) {
+	var (
+		where []string
+		args  []any
+	)
+	for _, f := range values {
+		if !isIdentifier(f.Name) {
+			return false, fmt.Errorf("%w: %q", ErrInvalidIdentifier, f.Name)
+		}
+		op := strings.ToUpper(strings.Join(strings.Fields(f.Operator), " "))
+		if op == "" {
+			op = "="
+		}
+		if !filterOperators[op] {
+			return false, fmt.Errorf("%w: %q", ErrInvalidOperator, f.Operator)
+		}
+		if f.Value == nil {
+			switch op {
+			case "=":
+				where = append(where, f.Name+` IS NULL`)
+				continue
+			case "<>", "!=":
+				where = append(where, f.Name+` IS NOT NULL`)
+				continue
+			}
+			return false, fmt.Errorf("%w: %s with NULL", ErrInvalidOperator, op)
+		}
+		where = append(where, f.Name+` `+op+` ?`)
+		args = append(args, f.Value)
+	}
+	sql := `SELECT 1 FROM ` + table(tableName)
+	if len(where) > 0 {
+		sql += ` WHERE ` + strings.Join(where, ` AND `)
+	}
+	return h.Exists(dhl.CommentStatement(h.ctx, sql), args...)
+}
+
+// Next sets next to the next value of a serial: a sequence of PostgreSQL or SQL Server, or a serial of the
+// SequenceGenerator of the connection, whose statements have the serial name in place of its NamePlaceHolder.
+func (h *Helper) Next(serial string, next *int64) error {
+	if next == nil {
+		return dhl.ErrVarMustBeInit
+	}
+	if sg := h.sequenceGenerator(); sg != nil {
+		named := func(q string) string {
+			if sg.NamePlaceHolder == "" {
+				return q
+			}
+			return strings.ReplaceAll(q, sg.NamePlaceHolder, h.Escape(serial))
+		}
+		if sg.UpsertQuery != "" {
+			if _, err := h.Exec(named(sg.UpsertQuery)); err != nil {
+				return err
+			}
+		}
+		return h.QueryRow(named(sg.ResultQuery)).Scan(next)
+	}
+	switch h.dialect {
+	case dhl.DialectPostgres:
+		return h.QueryRow(`SELECT nextval(?)`, serial).Scan(next)
+	case dhl.DialectSQLServer:
+		parts := strings.Split(serial, ".")
+		for i, p := range parts {
+			if !isIdentifier(p) {
+				return fmt.Errorf("%w: %q", ErrInvalidIdentifier, serial)
+			}
+			parts[i] = h.dialect.QuoteIdent(p)
+		}
+		return h.QueryRow(`SELECT NEXT VALUE FOR ` + strings.Join(parts, ".")).Scan(next)
+	}
+	return ErrNextUnsupported
+}
+
+func (h *Helper) sequenceGenerator() *dn.SequenceGeneratorInfo {
+	if h.di == nil || h.di.SequenceGenerator == nil || h.di.SequenceGenerator.ResultQuery == "" {
+		return nil
+	}
+	return h.di.SequenceGenerator
+}
+
+// Now returns the time of the database, or of this process when the database cannot tell
+func (h *Helper) Now() *time.Time {
+	t, err := h.databaseTime()
+	if err != nil {
+		t = time.Now()
+	}
+	return &t
+}
+
+// NowUTC returns the time of Now in UTC
+func (h *Helper) NowUTC() *time.Time {
+	t := h.Now().UTC()
+	return &t
+}
+
+// databaseTime reads the time of the database, parsing it when the driver returns it as text
+func (h *Helper) databaseTime() (time.Time, error) {
+	q := h.VendorStatement(`now`)
+	if q == "" {
+		return time.Time{}, ErrNextUnsupported
+	}
+	var v any
+	if err := h.QueryRow(q).Scan(&v); err != nil {
+		return time.Time{}, err
+	}
+	var s string
+	switch v := v.(type) {
+	case time.Time:
+		return v, nil
+	case []byte:
+		s = string(v)
+	case string:
+		s = v
+	default:
+		return time.Time{}, fmt.Errorf("unexpected time %T", v)
+	}
+	for _, layout := range []string{time.RFC3339Nano, `2006-01-02 15:04:05.999999999Z07:00`, `2006-01-02 15:04:05.999999999`} {
+		if t, err := time.ParseInLocation(layout, s, time.Local); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("unexpected time %q", s)
+}
+
+func (h *Helper) Ping() error {
+	switch {
+	case h.conn != nil:
+		return h.conn.PingContext(h.ctx)
+	case h.db != nil:
+		return h.db.PingContext(h.ctx)
+	}
+	return dhl.ErrHandleNotSet
+}
+
+func (h *Helper) Query(sql string, args ...any) (dhl.Rows, error) {
+	q, err := h.querier()
+	if err != nil {
+		return nil, err
+	}
+	rows, err := q.QueryContext(h.ctx, h.statement(sql), args...)
+	if err != nil {
+		return nil, err
+	}
+	return &Rows{rows: rows}, nil
+}
+
+// QueryArray stores the first column of the rows in the slice that out points to
+func (h *Helper) QueryArray(sql string, out any, args ...any) error {
+	ov := reflect.ValueOf(out)
+	if ov.Kind() != reflect.Pointer || ov.IsNil() || ov.Elem().Kind() != reflect.Slice {
+		return dhl.ErrArrayTypeNotSupported
+	}
+	rows, err := h.Query(sql, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	st := ov.Elem().Type()
+	list := reflect.MakeSlice(st, 0, 0)
+	for rows.Next() {
+		v := reflect.New(st.Elem())
+		if err := rows.Scan(v.Interface()); err != nil {
+			return err
+		}
+		list = reflect.Append(list, v.Elem())
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	ov.Elem().Set(list)
+	return nil
+}
+
+func (h *Helper) QueryRow(sql string, args ...any) dhl.Row {
+	q, err := h.querier()
+	if err != nil {
+		return errRow{err: err}
+	}
+	if cq, ok := q.(*cachedQuerier); ok {
+		return cq.queryRow(h.ctx, h.statement(sql), args...)
+	}
+	return q.QueryRowContext(h.ctx, h.statement(sql), args...)
+}
+
+// UpsertReturning inserts a row, or updates the row having the same unique column values, and returns it.
+//
+// PostgreSQL and SQLite use INSERT ... ON CONFLICT ... RETURNING, SQL Server uses MERGE ... OUTPUT,
+// and MySQL reads the row back by its unique columns after INSERT ... ON DUPLICATE KEY UPDATE.
+// The unique columns must be among the insert columns.
+//
+// Without update columns, the existing row is left unwritten: PostgreSQL and SQLite insert with
+// ON CONFLICT DO NOTHING and SQL Server merges without a WHEN MATCHED clause, while MySQL inserts and
+// takes a failure with the row present as a conflict. The row is then read back by its unique columns.
+func (h *Helper) UpsertReturning(tableName string, insertColumns, uniqueColumns, updateColumns, returnColumns []string, args ...any) (dhl.Row, error) {
+	if len(insertColumns) == 0 || len(insertColumns) != len(args) || len(uniqueColumns) == 0 || len(returnColumns) == 0 {
+		return nil, ErrUpsertColumns
+	}
+	for _, cols := range [][]string{insertColumns, uniqueColumns, updateColumns, returnColumns} {
+		for _, c := range cols {
+			if !isIdentifier(c) {
+				return nil, fmt.Errorf("%w: %q", ErrInvalidIdentifier, c)
+			}
+		}
+	}
+	uniqueArgs := make([]any, len(uniqueColumns))
+	for i, u := range uniqueColumns {
+		j := indexOf(insertColumns, u)
+		if j < 0 {
+			return nil, fmt.Errorf("%w: %s is not inserted", ErrUpsertColumns, u)
+		}
+		uniqueArgs[i] = args[j]
+	}
+	t := table(tableName)
+	cols := strings.Join(insertColumns, `, `)
+	values := `?` + strings.Repeat(`, ?`, len(insertColumns)-1)
+	on := make([]string, len(uniqueColumns))
+	for i, u := range uniqueColumns {
+		on[i] = `target.` + u + ` = source.` + u
+	}
+	readBack := func() dhl.Row {
+		return h.QueryRow(dhl.CommentStatement(h.ctx, fmt.Sprintf(`SELECT %s FROM %s WHERE %s`,
+			strings.Join(returnColumns, `, `), t, assignments(uniqueColumns, `%s = ?`))), uniqueArgs...)
+	}
+
+	if len(updateColumns) == 0 {
+		var err error
+		switch h.dialect {
+		case dhl.DialectSQLServer:
+			_, err = h.Exec(dhl.CommentStatement(h.ctx, fmt.Sprintf(
+				`MERGE INTO %s WITH (HOLDLOCK) AS target USING (VALUES (%s)) AS source (%s) ON %s `+
+					`WHEN NOT MATCHED THEN INSERT (%s) VALUES (%s);`,
+				t, values, cols, strings.Join(on, ` AND `), cols, prefixed(insertColumns, `source.`),
+			)), args...)
+		case dhl.DialectMySQL:
+			// A failed insert does not abort a MySQL transaction; the row being there tells a conflict
+			_, err = h.Exec(dhl.CommentStatement(h.ctx, fmt.Sprintf(`INSERT INTO %s (%s) VALUES (%s)`, t, cols, values)), args...)
+			if err != nil {
+				found, xerr := h.Exists(dhl.CommentStatement(h.ctx, fmt.Sprintf(`SELECT 1 FROM %s WHERE %s`,
+					t, assignments(uniqueColumns, `%s = ?`))), uniqueArgs...)
+				if xerr == nil && found {
+					err = nil
+				}
+			}
+		default:
+			_, err = h.Exec(dhl.CommentStatement(h.ctx, fmt.Sprintf(`INSERT INTO %s (%s) VALUES (%s) ON CONFLICT (%s) DO NOTHING`,
+				t, cols, values, strings.Join(uniqueColumns, `, `))), args...)
+		}
+		if err != nil {
+			return nil, err
+		}
+		return readBack(), nil
+	}
+
+	switch h.dialect {
+	case dhl.DialectSQLServer:
+		return h.QueryRow(dhl.CommentStatement(h.ctx, fmt.Sprintf(
+			`MERGE INTO %s WITH (HOLDLOCK) AS target USING (VALUES (%s)) AS source (%s) ON %s `+
+				`WHEN MATCHED THEN UPDATE SET %s WHEN NOT MATCHED THEN INSERT (%s) VALUES (%s) OUTPUT %s;`,
+			t, values, cols, strings.Join(on, ` AND `),
+			assignments(updateColumns, `target.%s = source.%s`), cols, prefixed(insertColumns, `source.`), prefixed(returnColumns, `inserted.`),
+		)), args...), nil
+	case dhl.DialectMySQL:
+		if _, err := h.Exec(dhl.CommentStatement(h.ctx, fmt.Sprintf(`INSERT INTO %s (%s) VALUES (%s) ON DUPLICATE KEY UPDATE %s`,
+			t, cols, values, assignments(updateColumns, `%s = VALUES(%s)`))), args...); err != nil {
+			return nil, err
+		}
+		return readBack(), nil
+	}
+	return h.QueryRow(dhl.CommentStatement(h.ctx, fmt.Sprintf(`INSERT INTO %s (%s) VALUES (%s) ON CONFLICT (%s) DO UPDATE SET %s RETURNING %s`,
+		t, cols, values, strings.Join(uniqueColumns, `, `), assignments(updateColumns, `%s = EXCLUDED.%s`), strings.Join(returnColumns, `, `),
+	)), args...), nil
+}
+
+// vendorStatements are the statements of each dialect that other methods use
+var vendorStatements = map[dhl.Dialect]map[string]string{
+	dhl.DialectPostgres: {
+		`now`:     `SELECT CURRENT_TIMESTAMP`,
+		`version`: `SELECT version()`,
+	},
+	dhl.DialectSQLServer: {
+		`now`:     `SELECT SYSDATETIMEOFFSET()`,
+		`version`: `SELECT @@VERSION`,
+	},
+	dhl.DialectMySQL: {
+		`now`:     `SELECT CURRENT_TIMESTAMP(6)`,
+		`version`: `SELECT VERSION()`,
+	},
+	dhl.DialectSQLite: {
+		`now`:     `SELECT strftime('%Y-%m-%dT%H:%M:%fZ', 'now')`,
+		`version`: `SELECT sqlite_version()`,
+	},
+}
+
+func (h *Helper) VendorStatement(key string) string {
+	return vendorStatements[h.dialect][key]
+}
+
+func (h *Helper) VendorStatements() []string {
+	keys := make([]string, 0, len(vendorStatements[h.dialect]))
+	for k := range vendorStatements[h.dialect] {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// querier returns where statements run: the pinned connection or its transaction, or the pool or its
+// transaction through the statement cache
+func (h *Helper) querier() (querier, error) {
+	switch {
+	case h.conn != nil && h.tx != nil:
+		return h.tx, nil
+	case h.conn != nil:
+		return h.conn, nil
+	case h.db == nil:
+		return nil, dhl.ErrHandleNotSet
+	case h.cache != nil:
+		return &cachedQuerier{cache: h.cache, db: h.db, tx: h.tx}, nil
+	case h.tx != nil:
+		return h.tx, nil
+	}
+	return h.db, nil
+}
+
+// cachedQuerier runs statements prepared through a statement cache, on a pool or in one of its transactions.
+// The statements that the cache rejects (see datahelperlite.StmtCache.Cacheable) are run as they are.
+type cachedQuerier struct {
+	cache *dhl.StmtCache
+	db    *sql.DB
+	tx    *sql.Tx
+}
+
+// direct returns where the statements that are not prepared run
+func (q *cachedQuerier) direct() querier {
+	if q.tx != nil {
+		return q.tx
+	}
+	return q.db
+}
+
+func (q *cachedQuerier) ExecContext(ctx context.Context, query string, args ...any) (res sql.Result, err error) {
+	if !q.cache.Cacheable(query) {
+		return q.direct().ExecContext(ctx, query, args...)
+	}
+	err = q.cache.Do(ctx, q.db, q.tx, query, func(st *sql.Stmt) error {
+		res, err = st.ExecContext(ctx, args...)
+		return err
+	})
+	return res, err
+}
+
+// QueryContext returns rows that outlive the cache call: database/sql closes a statement only after its rows
+func (q *cachedQuerier) QueryContext(ctx context.Context, query string, args ...any) (rows *sql.Rows, err error) {
+	if !q.cache.Cacheable(query) {
+		return q.direct().QueryContext(ctx, query, args...)
+	}
+	err = q.cache.Do(ctx, q.db, q.tx, query, func(st *sql.Stmt) error {
+		rows, err = st.QueryContext(ctx, args...)
+		return err
+	})
+	return rows, err
+}
+
+// QueryRowContext runs a statement unprepared. Helper.QueryRow goes through queryRow instead.
+func (q *cachedQuerier) QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row {
+	return q.direct().QueryRowContext(ctx, query, args...)
+}
+
+// queryRow returns a row that reports the error of a failed prepare, rather than running the statement again
+func (q *cachedQuerier) queryRow(ctx context.Context, query string, args ...any) dhl.Row {
+	if !q.cache.Cacheable(query) {
+		return q.direct().QueryRowContext(ctx, query, args...)
+	}
+	var row *sql.Row
+	if err := q.cache.Do(ctx, q.db, q.tx, query, func(st *sql.Stmt) error {
+		row = st.QueryRowContext(ctx, args...)
+		return nil
+	}); err != nil {
+		return errRow{err: err}
+	}
+	return row
+}
+
+// statement returns a statement as it is sent to the database, with its tables and placeholders resolved
+func (h *Helper) statement(sql string) string {
+	schema := ""
+	if h.di != nil && h.di.Schema != nil {
+		schema = *h.di.Schema
+	}
+	if h.di == nil || h.di.InterpolateTables == nil || *h.di.InterpolateTables {
+		sql = dhl.InterpolateTable(sql, schema)
+	}
+	ph, inSeq := h.placeholder()
+	return dhl.ReplaceQueryParamMarker(sql, inSeq, ph)
+}
+
+// placeholder returns the placeholder of the connection, or of the dialect when the connection keeps ?
+func (h *Helper) placeholder() (string, bool) {
+	if h.di != nil && h.di.ParameterPlaceHolder != nil && *h.di.ParameterPlaceHolder != "" && *h.di.ParameterPlaceHolder != `?` {
+		return *h.di.ParameterPlaceHolder, h.di.ParameterInSequence == nil || *h.di.ParameterInSequence
+	}
+	switch h.dialect {
+	case dhl.DialectPostgres:
+		return `$`, true
+	case dhl.DialectSQLServer:
+		return `@p`, true
+	}
+	return `?`, false
+}
+
+// table returns a table name as a {table} placeholder, unless it is one
+func table(name string) string {
+	if strings.HasPrefix(name, `{`) {
+		return name
+	}
+	return `{` + name + `}`
+}
+
+// isIdentifier reports if a name can be written in a statement as it is
+func isIdentifier(name string) bool {
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		switch {
+		case c == '_', c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z':
+		case c >= '0' && c <= '9' && i > 0:
+		default:
+			return false
+		}
+	}
+	return name != ""
+}
+
+func indexOf(list []string, s string) int {
+	for i, v := range list {
+		if strings.EqualFold(v, s) {
+			return i
+		}
+	}
+	return -1
+}
+
+// assignments formats each column with a format that uses it twice, joined by commas
+func assignments(cols []string, format string) string {
+	out := make([]string, len(cols))
+	for i, c := range cols {
+		out[i] = strings.ReplaceAll(format, `%s`, c)
+	}
+	return strings.Join(out, `, `)
+}
+
+func prefixed(cols []string, prefix string) string {
+	return prefix + strings.Join(cols, `, `+prefix)
+}
+
+// errRow is a row whose Scan fails
+type errRow struct{ err error }
+
+func (r errRow) Scan(dest ...any) error { return r.err }
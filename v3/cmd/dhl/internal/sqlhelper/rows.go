@@ -0,0 +1,80 @@
+package sqlhelper
+
+import (
+	"database/sql"
+
+	dhl "github.com/NarsilWorks-Inc/datahelperlite/v3"
+)
+
+// Rows is the result of a query
+type Rows struct {
+	rows *sql.Rows
+}
+
+func (r *Rows) Close() error {
+	return r.rows.Close()
+}
+
+func (r *Rows) Columns() ([]dhl.Column, error) {
+	cts, err := r.rows.ColumnTypes()
+	if err != nil {
+		return nil, err
+	}
+	cols := make([]dhl.Column, len(cts))
+	for i, ct := range cts {
+		cols[i] = ct
+	}
+	return cols, nil
+}
+
+func (r *Rows) Err() error {
+	return r.rows.Err()
+}
+
+func (r *Rows) Next() bool {
+	return r.rows.Next()
+}
+
+// RawValues returns copies of the column values of the current row as the driver returned them. It returns nil when they cannot be read.
+func (r *Rows) RawValues() [][]byte {
+	cols, err := r.rows.Columns()
+	if err != nil {
+		return nil
+	}
+	raw := make([]sql.RawBytes, len(cols))
+	dest := make([]any, len(cols))
+	for i := range raw {
+		dest[i] = &raw[i]
+	}
+	if err := r.rows.Scan(dest...); err != nil {
+		return nil
+	}
+	out := make([][]byte, len(raw))
+	for i, b := range raw {
+		if b != nil {
+			out[i] = append([]byte{}, b...)
+		}
+	}
+	return out
+}
+
+func (r *Rows) Scan(dest ...any) error {
+	return r.rows.Scan(dest...)
+}
+
+// Values returns the column values of the current row
+func (r *Rows) Values() ([]any, error) {
+	cols, err := r.rows.Columns()
+	if err != nil {
+		return nil, err
+	}
+	vals := make([]any, len(cols))
+	dest := make([]any, len(cols))
+	for i := range vals {
+		dest[i] = &vals[i]
+	}
+	if err := r.rows.Scan(dest...); err != nil {
+		return nil, err
+	}
+	return vals, nil
+}
@@ -0,0 +1,297 @@
+//go:build cgo
+
+package sqlhelper
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	dhl "github.com/NarsilWorks-Inc/datahelperlite/v3"
+	dn "github.com/eaglebush/datainfo"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// open opens a SQLite database of the test and acquires a helper on it
+func open(t *testing.T) (*Helper, *Handle) {
+	t.Helper()
+	di := dn.New(
+		dn.ConnectionString("file:"+filepath.Join(t.TempDir(), "test.db")+"?_busy_timeout=1000"),
+		dn.DriverName("sqlite3"),
+	)
+	h := &Handle{}
+	if err := h.Open(di); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = h.Close() })
+	dh := &Helper{}
+	if err := dh.Acquire(context.Background(), h); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := dh.Exec(`CREATE TABLE {items} (id INTEGER PRIMARY KEY, name TEXT NOT NULL UNIQUE, qty INTEGER)`); err != nil {
+		t.Fatal(err)
+	}
+	return dh, h
+}
+
+func TestHandle(t *testing.T) {
+	h := &Handle{}
+	if err := h.Open(dn.New(dn.ConnectionString("file::memory:"))); !errors.Is(err, ErrNoDriverName) {
+		t.Errorf("got %v, want ErrNoDriverName", err)
+	}
+	if err := h.Open(dn.New(dn.DriverName("sqlite3"))); !errors.Is(err, dhl.ErrHandleNoConnStr) {
+		t.Errorf("got %v, want ErrHandleNoConnStr", err)
+	}
+
+	dh, h := open(t)
+	for range 2 {
+		if _, err := dh.Exec(`INSERT INTO {items} (name) VALUES (?)`, "a"); err != nil {
+			t.Fatal(err)
+		}
+		_, _ = dh.Exec(`DELETE FROM {items}; DELETE FROM {items}`)
+	}
+	if st := dhl.StmtCacheFor(h.DB()).Stats(); st.Misses != 2 || st.Hits != 1 || st.Size != 2 {
+		t.Errorf("statement cache %+v, want the create and insert statements prepared once", st)
+	}
+	// A handle over the same pool shares the cache
+	bh := &Helper{}
+	if err := bh.Acquire(context.Background(), dhl.NewBreakerHandle(h, dhl.BreakerOptions{})); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := bh.Exec(`INSERT INTO {items} (name) VALUES (?)`, "b"); err != nil {
+		t.Fatal(err)
+	}
+	if st := dhl.StmtCacheFor(h.DB()).Stats(); st.Hits != 2 {
+		t.Errorf("statement cache %+v, want the insert of the breaker handle served from it", st)
+	}
+	// A statement that fails to prepare reports the error without running again
+	var qty int64
+	if err := dh.QueryRow(`SELECT qty FROM {missing}`).Scan(&qty); err == nil || !strings.Contains(err.Error(), "no such table") {
+		t.Errorf("QueryRow of a missing table: %v", err)
+	}
+	if err := h.Close(); err != nil || h.DB() != nil || h.DI() == nil {
+		t.Fatalf("Close: %v, db %v, di %v", err, h.DB(), h.DI())
+	}
+	if err := h.Ping(); !errors.Is(err, dhl.ErrHandleNoHandle) {
+		t.Errorf("Ping after Close: got %v", err)
+	}
+	if err := h.Open(h.DI()); err != nil || h.Ping() != nil {
+		t.Errorf("reopen: %v", err)
+	}
+	if st := dhl.StmtCacheFor(h.DB()).Stats(); st.Size != 0 || st.Misses != 0 {
+		t.Errorf("statement cache kept after Close: %+v", st)
+	}
+}
+
+func TestStatements(t *testing.T) {
+	dh, _ := open(t)
+	if n, err := dh.Exec(`INSERT INTO {items} (name, qty) VALUES (?, ?), (?, ?)`, "a", 1, "b", nil); err != nil || n != 2 {
+		t.Fatalf("Exec: %d, %v", n, err)
+	}
+	if ok, err := dh.Exists(`SELECT 1 FROM {items} WHERE name = ?`, "a"); err != nil || !ok {
+		t.Errorf("Exists: %v, %v", ok, err)
+	}
+	for _, c := range []struct {
+		filters []dhl.ColumnFilter
+		want    bool
+	}{
+		{[]dhl.ColumnFilter{{Name: "name", Value: "b"}, {Name: "qty", Value: nil}}, true},
+		{[]dhl.ColumnFilter{{Name: "name", Value: "a"}, {Name: "qty", Operator: "<>", Value: nil}}, true},
+		{[]dhl.ColumnFilter{{Name: "qty", Operator: ">", Value: 1}}, false},
+		{[]dhl.ColumnFilter{{Name: "name", Operator: "not  like", Value: "%"}}, false},
+	} {
+		if ok, err := dh.ExistsExt("items", c.filters); err != nil || ok != c.want {
+			t.Errorf("ExistsExt %v: %v, %v", c.filters, ok, err)
+		}
+	}
+	if _, err := dh.ExistsExt("items", []dhl.ColumnFilter{{Name: "name; DROP", Value: 1}}); !errors.Is(err, ErrInvalidIdentifier) {
+		t.Errorf("got %v, want ErrInvalidIdentifier", err)
+	}
+	if _, err := dh.ExistsExt("items", []dhl.ColumnFilter{{Name: "qty", Operator: "OR", Value: 1}}); !errors.Is(err, ErrInvalidOperator) {
+		t.Errorf("got %v, want ErrInvalidOperator", err)
+	}
+
+	rows, err := dh.Query(`SELECT id, name, qty FROM {items} ORDER BY id`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cols, _ := rows.Columns()
+	if len(cols) != 3 || cols[1].Name() != "name" {
+		t.Errorf("Columns: %v", cols)
+	}
+	rows.Next()
+	if raw := rows.RawValues(); string(raw[1]) != "a" || string(raw[2]) != "1" {
+		t.Errorf("RawValues: %q", raw)
+	}
+	rows.Next()
+	if vals, err := rows.Values(); err != nil || vals[2] != nil {
+		t.Errorf("Values: %v, %v", vals, err)
+	}
+	if rows.Next() || rows.Close() != nil {
+		t.Error("more than two rows")
+	}
+
+	var names []string
+	if err := dh.QueryArray(`SELECT name FROM {items} ORDER BY name DESC`, &names); err != nil || len(names) != 2 || names[0] != "b" {
+		t.Errorf("QueryArray: %v, %v", names, err)
+	}
+	if err := dh.QueryArray(`SELECT name FROM {items}`, names); !errors.Is(err, dhl.ErrArrayTypeNotSupported) {
+		t.Errorf("QueryArray of a slice: %v", err)
+	}
+
+	var id, qty int64
+	row, err := dh.UpsertReturning("items", []string{"name", "qty"}, []string{"name"}, []string{"qty"}, []string{"id", "qty"}, "a", 5)
+	if err != nil || row.Scan(&id, &qty) != nil || id != 1 || qty != 5 {
+		t.Errorf("UpsertReturning update: %d %d %v", id, qty, err)
+	}
+	var kept sql.NullInt64
+	row, err = dh.UpsertReturning("items", []string{"name", "qty"}, []string{"name"}, nil, []string{"id", "qty"}, "b", 7)
+	if err != nil || row.Scan(&id, &kept) != nil || id != 2 || kept.Valid {
+		t.Errorf("UpsertReturning without update columns: %d %v %v", id, kept, err)
+	}
+	// Without update columns the existing row is not written, whichever way the dialect inserts
+	if _, err := dh.Exec(`CREATE TABLE {writes} (n INTEGER); CREATE TRIGGER items_written AFTER UPDATE ON items BEGIN INSERT INTO writes VALUES (1); END`); err != nil {
+		t.Fatal(err)
+	}
+	for _, d := range []dhl.Dialect{dhl.DialectSQLite, dhl.DialectMySQL} {
+		dh.dialect = d
+		row, err = dh.UpsertReturning("items", []string{"name", "qty"}, []string{"name"}, nil, []string{"id"}, "b", 7)
+		if err != nil || row.Scan(&id) != nil || id != 2 {
+			t.Errorf("%s: UpsertReturning of an existing row: %d %v", d, id, err)
+		}
+	}
+	dh.dialect = dhl.DialectSQLite
+	if ok, err := dh.Exists(`SELECT 1 FROM {writes}`); err != nil || ok {
+		t.Errorf("existing row written: %v, %v", ok, err)
+	}
+	if _, err := dh.UpsertReturning("items", []string{"name"}, []string{"qty"}, nil, []string{"id"}, "c"); !errors.Is(err, ErrUpsertColumns) {
+		t.Errorf("got %v, want ErrUpsertColumns", err)
+	}
+
+	if v := dh.DatabaseVersion(); v == "" {
+		t.Error("no database version")
+	}
+	if now := dh.Now(); now.IsZero() {
+		t.Error("no time")
+	}
+	var next int64
+	if err := dh.Next("items", &next); !errors.Is(err, ErrNextUnsupported) {
+		t.Errorf("got %v, want ErrNextUnsupported", err)
+	}
+}
+
+func TestTransactions(t *testing.T) {
+	dh, _ := open(t)
+	count := func() (n int) {
+		t.Helper()
+		if err := dh.QueryRow(`SELECT COUNT(*) FROM {items}`).Scan(&n); err != nil {
+			t.Fatal(err)
+		}
+		return n
+	}
+
+	if err := dh.Begin(); err != nil {
+		t.Fatal(err)
+	}
+	_, _ = dh.Exec(`INSERT INTO {items} (name) VALUES (?)`, "kept")
+	if err := dh.Mark("sp1"); err != nil {
+		t.Fatal(err)
+	}
+	_, _ = dh.Exec(`INSERT INTO {items} (name) VALUES (?)`, "discarded")
+	if err := dh.Discard("sp1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := dh.Mark("sp2"); err != nil {
+		t.Fatal(err)
+	}
+	_, _ = dh.Exec(`INSERT INTO {items} (name) VALUES (?)`, "saved")
+	if err := dh.Save("sp2"); err != nil {
+		t.Fatal(err)
+	}
+	if err := dh.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if err := dh.Rollback(); err != nil {
+		t.Errorf("deferred Rollback after Commit: %v", err)
+	}
+	if n := count(); n != 2 {
+		t.Errorf("got %d rows, want 2", n)
+	}
+
+	if err := dh.BeginManually(); err != nil {
+		t.Fatal(err)
+	}
+	_, _ = dh.Exec(`INSERT INTO {items} (name) VALUES (?)`, "rolled back")
+	if err := dh.Rollback(); err != nil {
+		t.Fatal(err)
+	}
+	if err := dh.Rollback(); !errors.Is(err, dhl.ErrNoTx) {
+		t.Errorf("second Rollback: got %v, want ErrNoTx", err)
+	}
+	if err := dh.Mark("sp"); !errors.Is(err, dhl.ErrNoTx) {
+		t.Errorf("Mark without a transaction: got %v, want ErrNoTx", err)
+	}
+
+	if err := dh.Begin(); err != nil {
+		t.Fatal(err)
+	}
+	_, _ = dh.Exec(`INSERT INTO {items} (name) VALUES (?)`, "released")
+	if err := dh.Release(); err != nil {
+		t.Fatal(err)
+	}
+	if err := dh.Acquire(context.Background(), nil); !errors.Is(err, dhl.ErrHandleNotSet) {
+		t.Errorf("got %v, want ErrHandleNotSet", err)
+	}
+}
+
+func TestPlaceholders(t *testing.T) {
+	for _, c := range []struct {
+		di   *dn.DataInfo
+		want string
+	}{
+		{dn.New(dn.DriverName("pgx"), dn.Schema("app")), `SELECT a FROM app.t WHERE a = $1 AND b = $2`},
+		{dn.New(dn.DriverName("sqlserver")), `SELECT a FROM t WHERE a = @p1 AND b = @p2`},
+		{dn.New(dn.DriverName("mysql")), `SELECT a FROM t WHERE a = ? AND b = ?`},
+		{dn.New(dn.DriverName("pgx"), dn.ParameterPlaceHolder(":"), dn.ParameterInSequence(true)), `SELECT a FROM t WHERE a = :1 AND b = :2`},
+	} {
+		dh := &Helper{di: c.di, dialect: dhl.DialectOf(c.di)}
+		if got := dh.statement(`SELECT a FROM {t} WHERE a = ? AND b = ?`); got != c.want {
+			t.Errorf("%s: got %q, want %q", *c.di.DriverName, got, c.want)
+		}
+	}
+}
+
+func TestQueryTags(t *testing.T) {
+	_, h := open(t)
+	trace := 0
+	dh := dhl.Wrap(&Helper{}, dhl.SQLCommenter(dhl.CommentOptions{
+		App:     "test",
+		TraceID: func(context.Context) string { trace++; return strconv.Itoa(trace) },
+	}))
+	cache := dhl.StmtCacheFor(h.DB())
+	before := cache.Stats()
+	for range 2 {
+		if err := dh.Acquire(context.Background(), h); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := dh.Exec(`INSERT INTO {items} (name, qty) VALUES (?, ?) ON CONFLICT (name) DO NOTHING`, "a", 1); err != nil {
+			t.Fatal(err)
+		}
+		if ok, err := dh.ExistsExt("items", []dhl.ColumnFilter{{Name: "name", Value: "a"}}); err != nil || !ok {
+			t.Errorf("ExistsExt: %v, %v", ok, err)
+		}
+		var qty int64
+		row, err := dh.UpsertReturning("items", []string{"name", "qty"}, []string{"name"}, []string{"qty"}, []string{"qty"}, "a", 2)
+		if err != nil || row.Scan(&qty) != nil || qty != 2 {
+			t.Errorf("UpsertReturning: %d, %v", qty, err)
+		}
+		_ = dh.Release()
+	}
+	if st := cache.Stats(); st.Size != before.Size || st.Misses != before.Misses || st.Hits != before.Hits {
+		t.Errorf("tagged statements went through the statement cache: %+v, before %+v", st, before)
+	}
+}
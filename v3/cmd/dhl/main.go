@@ -0,0 +1,166 @@
+// Command dhl works with the databases of connection definitions through their helpers. It pings
+// them, shows their version, runs migrations, queries and statements, and lists vendor statements.
+//
+// Usage:
+//
+//	dhl [-config file] [-conn name] [-timeout duration] <command> [arguments]
+//
+// The commands are:
+//
+//	ping                                        ping the database through its handle
+//	version                                     show the database version
+//	migrate [-dir dir] [-dry-run] up [version]  apply pending migrations, up to a version
+//	migrate [-dir dir] [-dry-run] down [steps]  revert the latest applied migrations, one by default
+//	migrate [-dir dir] status                   show the state of the migrations
+//	query [-format table|csv|json] sql [args]   run a query and print its rows
+//	exec sql [args]                             run a statement and print the rows it affected
+//	vendor-statements [-sql]                    list the vendor statements of the helper
+//
+// The configuration file holds a JSON object of DataInfo connection definitions by name, in the
+// format handles are opened with. The HelperID of a connection names the helper and handle that
+// serve it, which must be registered by a driver file built into the binary (see drivers.go).
+// Without -conn, the connection is the only one of the file, or the one named default.
+//
+// The helper is acquired with the -timeout of the command, which then bounds all of its statements.
+// Migrations may run for long, so migrate has no time limit.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	dhl "github.com/NarsilWorks-Inc/datahelperlite/v3"
+	dn "github.com/eaglebush/datainfo"
+)
+
+// Errors
+var (
+	ErrUsage          error = errors.New(`invalid usage`)
+	ErrUnknownConn    error = errors.New(`connection is not defined`)
+	ErrNoHelperID     error = errors.New(`connection has no HelperID`)
+	ErrUnknownCommand error = errors.New(`unknown command`)
+)
+
+func main() {
+	if err := run(context.Background(), os.Args[1:], os.Stdout, os.Stderr); err != nil {
+		fmt.Fprintln(os.Stderr, "dhl:", err)
+		if errors.Is(err, ErrUsage) || errors.Is(err, flag.ErrHelp) {
+			os.Exit(2)
+		}
+		os.Exit(1)
+	}
+}
+
+// run runs the command line args, writing results to stdout and usage to stderr
+func run(ctx context.Context, args []string, stdout, stderr io.Writer) error {
+	fs := flag.NewFlagSet("dhl", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	config := fs.String("config", envOr("DHL_CONFIG", "dhl.json"), "file of the connection definitions")
+	conn := fs.String("conn", os.Getenv("DHL_CONN"), "name of the connection")
+	timeout := fs.Duration("timeout", 30*time.Second, "time limit of the commands but migrate, which has none; 0 for no limit")
+	fs.Usage = func() {
+		fmt.Fprintln(stderr, "usage: dhl [flags] ping|version|migrate|query|exec|vendor-statements [arguments]")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return ErrUsage
+	}
+	cmd, cmdArgs := fs.Arg(0), fs.Args()[1:]
+	c, ok := commands[cmd]
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrUnknownCommand, cmd)
+	}
+
+	di, err := loadConnection(*config, *conn)
+	if err != nil {
+		return err
+	}
+	if *timeout > 0 && !untimed[cmd] {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, *timeout)
+		defer cancel()
+	}
+	dh, h, err := open(ctx, di)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = dh.Release()
+		_ = h.Close()
+	}()
+	return c(ctx, &env{dh: dh, handle: h, out: stdout, errOut: stderr}, cmdArgs)
+}
+
+func envOr(key, def string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return def
+}
+
+// loadConnection reads a connection definition from the configuration file
+func loadConnection(file, name string) (*dn.DataInfo, error) {
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var conns map[string]*dn.DataInfo
+	if err := json.Unmarshal(b, &conns); err != nil {
+		return nil, fmt.Errorf("%s: %w", file, err)
+	}
+	if name == "" {
+		name = "default"
+		if len(conns) == 1 {
+			for n := range conns {
+				name = n
+			}
+		}
+	}
+	di, ok := conns[name]
+	if !ok || di == nil {
+		names := make([]string, 0, len(conns))
+		for n := range conns {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+		return nil, fmt.Errorf("%w: %q (defined: %s)", ErrUnknownConn, name, strings.Join(names, ", "))
+	}
+	return di, nil
+}
+
+// open opens the handle of a connection and acquires a helper with it
+func open(ctx context.Context, di *dn.DataInfo) (dhl.DataHelperLite, dhl.DataHelperHandle, error) {
+	if di.HelperID == nil || *di.HelperID == "" {
+		return nil, nil, ErrNoHelperID
+	}
+	id := *di.HelperID
+	h, err := dhl.NewHandle(id)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w; this binary has %s", err, registered())
+	}
+	if err := h.Open(di); err != nil {
+		return nil, nil, err
+	}
+	dh, err := dhl.New(nil, id)
+	if err != nil {
+		_ = h.Close()
+		return nil, nil, fmt.Errorf("%w; this binary has %s", err, registered())
+	}
+	if err := dh.Acquire(ctx, h); err != nil {
+		_ = h.Close()
+		return nil, nil, err
+	}
+	return dh, h, nil
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	dhl "github.com/NarsilWorks-Inc/datahelperlite/v3"
+	"github.com/NarsilWorks-Inc/datahelperlite/v3/internal/dhltest"
+)
+
+// setup registers a scripted helper and handle as a driver file would register a helper package
+func setup(t *testing.T) (config string, helper *dhltest.Helper, handle *dhltest.Handle) {
+	t.Helper()
+	helper = &dhltest.Helper{
+		Version: "FakeDB 1.0",
+		Vendor:  map[string]string{"now": "SELECT now", "last_id": "SELECT last_id"},
+		OnExec:  func(string, ...any) (int64, error) { return 3, nil },
+		OnExists: func(string, ...any) (bool, error) {
+			return false, errors.New("no such table")
+		},
+		OnQuery: func(sql string, args ...any) (dhl.Rows, error) {
+			return dhltest.NewRows([]string{"id", "name", "at"},
+				[]any{int64(1), []byte("a, \"b\""), time.Date(2025, 1, 2, 3, 4, 5, 0, time.UTC)},
+				[]any{int64(2), nil, args[0]},
+			), nil
+		},
+	}
+	handle = &dhltest.Handle{}
+	dhl.SetHelper("fake", helper)
+	dhl.SetHandler("fake", handle)
+	t.Cleanup(func() {
+		delete(dhl.Helper, "fake")
+		delete(dhl.Handler, "fake")
+	})
+	config = filepath.Join(t.TempDir(), "dhl.json")
+	if err := os.WriteFile(config, []byte(`{
+		"default": {"HelperID": "fake", "Schema": "app", "ConnectionString": "fake://"},
+		"other": {"HelperID": "missing"}
+	}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return config, helper, handle
+}
+
+// execs returns the statements the helper executed
+func execs(h *dhltest.Helper) []string {
+	var out []string
+	for _, c := range h.Calls() {
+		if c.Method == "Exec" {
+			out = append(out, c.SQL)
+		}
+	}
+	return out
+}
+
+func runCLI(t *testing.T, args ...string) (string, error) {
+	t.Helper()
+	var out, errOut bytes.Buffer
+	err := run(context.Background(), args, &out, &errOut)
+	return out.String(), err
+}
+
+func TestCommands(t *testing.T) {
+	config, helper, handle := setup(t)
+	for _, c := range []struct {
+		args []string
+		want string
+	}{
+		{[]string{"ping"}, "ok\n"},
+		{[]string{"version"}, "FakeDB 1.0\n"},
+		{[]string{"vendor-statements", "-sql"}, "last_id\tSELECT last_id\nnow\tSELECT now\n"},
+		{[]string{"exec", "DELETE FROM t"}, "3 rows affected\n"},
+		{[]string{"query", "-format", "csv", "SELECT", "x"}, "id,name,at\n1,\"a, \"\"b\"\"\",2025-01-02T03:04:05Z\n2,,x\n"},
+		{[]string{"query", "-format", "json", "SELECT", "x"},
+			"[\n  {\"id\": 1, \"name\": \"a, \\\"b\\\"\", \"at\": \"2025-01-02T03:04:05Z\"},\n  {\"id\": 2, \"name\": null, \"at\": \"x\"}\n]\n"},
+		{[]string{"query", "SELECT", "x"}, "id  name    at\n1   a, \"b\"  2025-01-02T03:04:05Z\n2   NULL    x\n(2 rows)\n"},
+	} {
+		got, err := runCLI(t, append([]string{"-config", config}, c.args...)...)
+		if err != nil {
+			t.Errorf("%v: %v", c.args, err)
+			continue
+		}
+		if got != c.want {
+			t.Errorf("%v: got\n%s\nwant\n%s", c.args, got, c.want)
+		}
+	}
+	if *handle.Info.Schema != "app" || !handle.Closed {
+		t.Errorf("handle not opened with the definition or not closed: %+v", handle)
+	}
+	if got := execs(helper); len(got) != 1 {
+		t.Errorf("execs %q", got)
+	}
+}
+
+func TestMigrate(t *testing.T) {
+	config, helper, _ := setup(t)
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "0001_users.up.sql"), []byte("CREATE TABLE {users} (id INT);"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := runCLI(t, "-config", config, "migrate", "-dir", dir, "status")
+	if err != nil || !strings.Contains(got, "1        users  pending") {
+		t.Errorf("status: %v\n%s", err, got)
+	}
+	got, err = runCLI(t, "-config", config, "migrate", "-dir", dir, "-dry-run", "up")
+	if err != nil || got != "-- up 1_users\nCREATE TABLE app.users (id INT);\nwould apply 1_users\n" {
+		t.Errorf("dry run: %v\n%s", err, got)
+	}
+	if got := execs(helper); len(got) != 0 {
+		t.Errorf("dry run executed %q", got)
+	}
+	if _, err := runCLI(t, "-config", config, "migrate", "-dir", dir, "down", "0"); !errors.Is(err, ErrUsage) {
+		t.Errorf("down 0: got %v, want ErrUsage", err)
+	}
+
+	// Only the commands but migrate are limited by -timeout
+	for _, c := range helper.Calls() {
+		if c.Method == "Acquire" {
+			if _, ok := c.Args[0].(context.Context).Deadline(); ok {
+				t.Error("migrate acquired the helper with a deadline")
+			}
+		}
+	}
+	if _, err := runCLI(t, "-config", config, "version"); err != nil {
+		t.Fatal(err)
+	}
+	calls := helper.Calls()
+	if _, ok := calls[len(calls)-2].Args[0].(context.Context).Deadline(); !ok {
+		t.Errorf("version acquired the helper without a deadline: %v", calls[len(calls)-2])
+	}
+}
+
+func TestErrors(t *testing.T) {
+	config, _, _ := setup(t)
+	if _, err := runCLI(t, "-config", config); !errors.Is(err, ErrUsage) {
+		t.Errorf("got %v, want ErrUsage", err)
+	}
+	if _, err := runCLI(t, "-config", config, "drop"); !errors.Is(err, ErrUnknownCommand) {
+		t.Errorf("got %v, want ErrUnknownCommand", err)
+	}
+	if _, err := runCLI(t, "-config", config, "-conn", "nope", "ping"); !errors.Is(err, ErrUnknownConn) {
+		t.Errorf("got %v, want ErrUnknownConn", err)
+	}
+	_, err := runCLI(t, "-config", config, "-conn", "other", "ping")
+	if err == nil || !strings.Contains(err.Error(), "this binary has the drivers fake") {
+		t.Errorf("got %v for an unregistered helper", err)
+	}
+	if _, err := runCLI(t, "-config", config, "query", "-format", "xml", "SELECT 1"); !errors.Is(err, ErrUsage) {
+		t.Errorf("got %v, want ErrUsage", err)
+	}
+}
+
+func TestDriverFiles(t *testing.T) {
+	if testing.Short() {
+		t.Skip("builds the command")
+	}
+	gobin, err := exec.LookPath("go")
+	if err != nil {
+		t.Skip("no go command")
+	}
+	// The sqlite driver needs cgo; the others build without it
+	cmd := exec.Command(gobin, "build", "-tags", "postgres,sqlserver,mysql,sqlite", "-o", filepath.Join(t.TempDir(), "dhl"), ".")
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("%v\n%s", err, out)
+	}
+}
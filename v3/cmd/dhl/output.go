@@ -0,0 +1,150 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	dhl "github.com/NarsilWorks-Inc/datahelperlite/v3"
+)
+
+// rowWriter writes the rows of a query in an output format
+type rowWriter func(w io.Writer, rows dhl.Rows) error
+
+var writers = map[string]rowWriter{
+	"table": writeTable,
+	"csv":   writeCSV,
+	"json":  writeJSON,
+}
+
+// forEach calls fn with the column names, then with the values of each row
+func forEach(rows dhl.Rows, header func(cols []string) error, row func(vals []any) error) error {
+	cols, err := rows.Columns()
+	if err != nil {
+		return err
+	}
+	names := make([]string, len(cols))
+	for i, c := range cols {
+		names[i] = c.Name()
+	}
+	if err := header(names); err != nil {
+		return err
+	}
+	for rows.Next() {
+		vals, err := rows.Values()
+		if err != nil {
+			return err
+		}
+		for i, v := range vals {
+			if b, ok := v.([]byte); ok {
+				vals[i] = string(b)
+			}
+		}
+		if err := row(vals); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// text formats a value for table and CSV output
+func text(v any) string {
+	switch v := v.(type) {
+	case nil:
+		return "NULL"
+	case time.Time:
+		return v.Format(time.RFC3339Nano)
+	}
+	return fmt.Sprint(v)
+}
+
+func writeTable(w io.Writer, rows dhl.Rows) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	n := 0
+	line := func(cells []string) error {
+		// Keep each value on its line of the table
+		for i, c := range cells {
+			cells[i] = strings.NewReplacer("\t", " ", "\n", " ", "\r", "").Replace(c)
+		}
+		_, err := fmt.Fprintln(tw, strings.Join(cells, "\t"))
+		return err
+	}
+	err := forEach(rows, line, func(vals []any) error {
+		n++
+		cells := make([]string, len(vals))
+		for i, v := range vals {
+			cells[i] = text(v)
+		}
+		return line(cells)
+	})
+	if err != nil {
+		return err
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "(%d rows)\n", n)
+	return err
+}
+
+func writeCSV(w io.Writer, rows dhl.Rows) error {
+	cw := csv.NewWriter(w)
+	err := forEach(rows, cw.Write, func(vals []any) error {
+		cells := make([]string, len(vals))
+		for i, v := range vals {
+			cells[i] = text(v)
+			if v == nil {
+				cells[i] = ""
+			}
+		}
+		return cw.Write(cells)
+	})
+	if err != nil {
+		return err
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// writeJSON writes an array of objects whose keys are in column order
+func writeJSON(w io.Writer, rows dhl.Rows) error {
+	var names []string
+	sep := "["
+	err := forEach(rows, func(cols []string) error {
+		names = cols
+		return nil
+	}, func(vals []any) error {
+		var sb strings.Builder
+		sb.WriteString(sep + "\n  {")
+		sep = ","
+		for i, v := range vals {
+			k, _ := json.Marshal(names[i])
+			b, err := json.Marshal(v)
+			if err != nil {
+				return err
+			}
+			if i > 0 {
+				sb.WriteString(", ")
+			}
+			sb.Write(k)
+			sb.WriteString(": ")
+			sb.Write(b)
+		}
+		sb.WriteString("}")
+		_, err := io.WriteString(w, sb.String())
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if sep == "[" {
+		_, err = io.WriteString(w, "[]\n")
+		return err
+	}
+	_, err = io.WriteString(w, "\n]\n")
+	return err
+}
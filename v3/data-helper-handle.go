@@ -4,6 +4,7 @@ import (
 	"database/sql"
 	"errors"
 	"fmt"
+	"maps"
 	"sync"
 	"time"
 
@@ -11,7 +12,10 @@ import (
 )
 
 var (
-	Handler map[string]DataHelperHandle
+	// Handler holds the handles registered by SetHandler. It is guarded by a lock that the functions
+	// of the package take, so register handles with SetHandler rather than writing to it.
+	Handler   map[string]DataHelperHandle
+	handlerMu sync.RWMutex
 )
 
 // DataHelperHandle manages the handle to the database connection
@@ -30,6 +34,8 @@ type DataHelperHandle interface {
 	Close() error
 	// Err retrieves the last handle error
 	Err() error
+	// Stats returns the connection pool statistics
+	Stats() sql.DBStats
 }
 
 // Errors
@@ -41,7 +47,9 @@ var (
 
 // New creates new datahelper lite if the dhl parameter is null.
 func NewHandle(helperId string) (DataHelperHandle, error) {
+	handlerMu.RLock()
 	hnd, present := Handler[helperId]
+	handlerMu.RUnlock()
 	if !present {
 		return nil, fmt.Errorf("'%s' helper name is invalid", helperId)
 	}
@@ -50,12 +58,87 @@ func NewHandle(helperId string) (DataHelperHandle, error) {
 
 // SetHandler sets the internal handler object
 func SetHandler(name string, hndl DataHelperHandle) {
+	handlerMu.Lock()
+	defer handlerMu.Unlock()
 	if Handler == nil {
 		Handler = make(map[string]DataHelperHandle)
 	}
 	Handler[name] = hndl
 }
 
+// HandleName returns the name a handle was registered with by SetHandler. It returns an empty string if it was not registered.
+func HandleName(hndl DataHelperHandle) string {
+	if isReallyNil(hndl) {
+		return ""
+	}
+	handlerMu.RLock()
+	defer handlerMu.RUnlock()
+	for name, h := range Handler {
+		if h == hndl {
+			return name
+		}
+	}
+	return ""
+}
+
+// HandleStats returns a snapshot of the pool statistics of all registered handles keyed by name.
+//
+// Handles without an open database are left out.
+func HandleStats() map[string]sql.DBStats {
+	hs := handlers()
+	snap := make(map[string]sql.DBStats, len(hs))
+	for name, hndl := range hs {
+		if isReallyNil(hndl) || hndl.DB() == nil {
+			continue
+		}
+		snap[name] = hndl.Stats()
+	}
+	return snap
+}
+
+// handlers returns a copy of the registered handles, to be read without the lock
+func handlers() map[string]DataHelperHandle {
+	handlerMu.RLock()
+	defer handlerMu.RUnlock()
+	return maps.Clone(Handler)
+}
+
+// ReconnectEventKind is the kind of event reported by Reconnect
+type ReconnectEventKind uint8
+
+// Reconnect event kinds
+const (
+	ReconnectAttempt   ReconnectEventKind = 0 // An Open is about to be attempted
+	ReconnectFailed    ReconnectEventKind = 1 // The Open attempt failed
+	ReconnectConnected ReconnectEventKind = 2 // The handle was opened and the first ping succeeded
+	ReconnectLost      ReconnectEventKind = 3 // The ping failed and the handle was closed
+	ReconnectHealthy   ReconnectEventKind = 4 // The ping succeeded
+)
+
+// ReconnectEvent is an event reported by Reconnect on every state change or check
+type ReconnectEvent struct {
+	Kind ReconnectEventKind // Kind of event
+	Err  error              // Error for ReconnectFailed and ReconnectLost
+}
+
+// ReconnectOption configures Reconnect
+type ReconnectOption func(rc *reconnectConfig)
+
+type reconnectConfig struct {
+	hooks []func(ReconnectEvent)
+}
+
+// OnReconnectEvent registers a function that receives every event of the reconnection loop.
+//
+// Hooks run on the reconnection goroutine and must not block.
+func OnReconnectEvent(fn func(ReconnectEvent)) ReconnectOption {
+	return func(rc *reconnectConfig) {
+		if fn != nil {
+			rc.hooks = append(rc.hooks, fn)
+		}
+	}
+}
+
 // Reconnect allows reconnection to stabilize the handler.
 //
 // It returns a function to close the timer.
@@ -65,9 +148,24 @@ func Reconnect(
 	interval time.Duration,
 	mu sync.Locker,
 	logf func(string, ...string),
+	opts ...ReconnectOption,
 ) func() {
 	stopCh := make(chan struct{})
 
+	rc := reconnectConfig{}
+	for _, o := range opts {
+		if o == nil {
+			continue
+		}
+		o(&rc)
+	}
+
+	notify := func(kind ReconnectEventKind, err error) {
+		for _, fn := range rc.hooks {
+			fn(ReconnectEvent{Kind: kind, Err: err})
+		}
+	}
+
 	logger := func(logType string, msg ...string) {
 		if logf != nil {
 			logf(logType, msg...)
@@ -104,8 +202,10 @@ func Reconnect(
 						continue
 					}
 
+					notify(ReconnectAttempt, nil)
 					if err := hndl.Open(di); err != nil {
 						logger("ERR", fmt.Sprintf("Database error: %s", err.Error()))
+						notify(ReconnectFailed, err)
 						continue
 					}
 
@@ -120,14 +220,19 @@ func Reconnect(
 				if err := hndl.Ping(); err != nil {
 					logger("ERR", fmt.Sprintf("Database error: %s", err.Error()))
 
+					db := hndl.DB()
 					lock()
 					_ = hndl.Close()
 					unlock()
+					// The statements prepared on the closed pool are of no use
+					DropStmtCache(db)
 
+					notify(ReconnectLost, err)
 					continue
 				}
 
 				if justConnected {
+					notify(ReconnectConnected, nil)
 					lock()
 					if connCount == 1 {
 						logger("INF", "Database connection successful!")
@@ -138,6 +243,7 @@ func Reconnect(
 
 					justConnected = false
 				}
+				notify(ReconnectHealthy, nil)
 
 			case <-stopCh:
 				logger("INF", "Re-connection ticker stopped!")
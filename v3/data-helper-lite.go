@@ -9,7 +9,6 @@ import (
 	"errors"
 	"fmt"
 	"reflect"
-	"regexp"
 	"strconv"
 	"strings"
 	"time"
@@ -36,6 +35,7 @@ type DataHelperLite interface {
 	Query(sql string, args ...any) (Rows, error)                     // Query to a database to return one or more records
 	QueryArray(sql string, out any, args ...any) error               // Query to a database to return one or more records and store to an array
 	QueryRow(sql string, args ...any) Row                            // QueryRow to a database and return one record
+	Release() error                                                  // Release rolls back an open transaction and gives back what Acquire took, such as a pinned connection
 	Rollback() error                                                 // Rollback a transaction
 	Save(name string) error                                          // Save a transaction
 	// UpsertReturning inserts a row into the table.
@@ -125,6 +125,9 @@ func New(dhl DataHelperLite, helperId string) (DataHelperLite, error) {
 	if !present {
 		return nil, fmt.Errorf("'%s' helper name is invalid", helperId)
 	}
+	if strictMode.Load() {
+		return Strict(ndh.NewHelper()), nil
+	}
 	return ndh.NewHelper(), nil
 }
 
@@ -142,35 +145,41 @@ func SetErrNoRows(err error) {
 }
 
 // InterpolateTable interpolates table name that has been enclosed with curly braces
+//
+// Unqualified names are prefixed with the schema, while {schema.table} names are used as they are.
+// Names are not quoted; use a TableResolver for table mapping and quoting.
 func InterpolateTable(sql string, schema string) string {
-	if schema != "" {
-		schema = schema + `.`
-	}
-	re := regexp.MustCompile(`\{([a-zA-Z0-9\[\]\"\_\-]*)\}`)
-	return re.ReplaceAllString(sql, schema+`$1`)
+	tr := TableResolver{Schema: schema, Quote: QuoteNever}
+	out, _ := tr.Resolve(sql)
+	return out
 }
 
 // ReplaceQueryParamMarker replaces SQL string with parameters set as ?
+//
+// Question marks inside string literals, quoted identifiers and comments are left alone.
 func ReplaceQueryParamMarker(preparedQuery string, paramInSeq bool, paramPlaceHolder string) string {
-	retstr := preparedQuery
 	defph := `?`
-	pattern := `\` + defph //search for ?
 
 	// if the paramPlaceHolder was set
 	// by the configuration the same as default place holder, we exit
-	if paramPlaceHolder == defph {
-		return retstr
+	if paramPlaceHolder == defph || !strings.Contains(preparedQuery, defph) {
+		return preparedQuery
 	}
-	re := regexp.MustCompile(pattern)
-	matches := re.FindAllString(preparedQuery, -1)
-	for i, match := range matches {
+	var sb strings.Builder
+	sb.Grow(len(preparedQuery) + 8)
+	i := 0
+	for _, t := range lexSQL(preparedQuery) {
+		if t.kind != tokPlaceholder || t.text != defph {
+			sb.WriteString(t.text)
+			continue
+		}
+		i++
+		sb.WriteString(paramPlaceHolder)
 		if paramInSeq {
-			retstr = strings.Replace(retstr, match, paramPlaceHolder+strconv.Itoa((i+1)), 1)
-		} else {
-			retstr = strings.Replace(retstr, match, paramPlaceHolder, 1) // replace one at a time
+			sb.WriteString(strconv.Itoa(i))
 		}
 	}
-	return retstr
+	return sb.String()
 }
 
 // ToDBType converts string or string types to desired DBType
@@ -0,0 +1,1456 @@
+package datahelperlite
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	dn "github.com/eaglebush/datainfo"
+)
+
+// fakeConnector never connects. It only gives sql.OpenDB something to hold.
+type fakeConnector struct{}
+
+func (fakeConnector) Connect(context.Context) (driver.Conn, error) {
+	return nil, errors.New("fake connector")
+}
+
+func (fakeConnector) Driver() driver.Driver { return nil }
+
+type fakeHandle struct {
+	name string
+	db   *sql.DB
+	di   *dn.DataInfo
+	err  error
+}
+
+func newFakeHandle(name string) *fakeHandle {
+	return &fakeHandle{name: name, db: sql.OpenDB(fakeConnector{})}
+}
+
+func (h *fakeHandle) Open(di *dn.DataInfo) error { return nil }
+func (h *fakeHandle) Ping() error                { return h.err }
+func (h *fakeHandle) DB() *sql.DB                { return h.db }
+func (h *fakeHandle) DI() *dn.DataInfo           { return h.di }
+func (h *fakeHandle) Close() error               { return nil }
+func (h *fakeHandle) Err() error                 { return h.err }
+func (h *fakeHandle) Stats() sql.DBStats         { return h.db.Stats() }
+
+type fakeRow struct{ err error }
+
+func (r fakeRow) Scan(dest ...any) error { return r.err }
+
+// fakeHelper records the operations it receives together with the handle it was acquired with
+type fakeHelper struct {
+	handle DataHelperHandle
+	calls  *[]string
+	tx     bool
+}
+
+func newFakeHelper() *fakeHelper {
+	return &fakeHelper{calls: new([]string)}
+}
+
+func (f *fakeHelper) record(op string) {
+	name := ""
+	if h, ok := f.handle.(*fakeHandle); ok {
+		name = h.name
+	}
+	*f.calls = append(*f.calls, op+"@"+name)
+}
+
+func (f *fakeHelper) NewHelper() DataHelperLite { return &fakeHelper{calls: f.calls} }
+func (f *fakeHelper) Acquire(ctx context.Context, h DataHelperHandle) error {
+	f.handle = h
+	return nil
+}
+func (f *fakeHelper) Begin() error {
+	if f.tx {
+		return ErrHandleTxNotNil
+	}
+	f.tx = true
+	f.record("Begin")
+	return nil
+}
+func (f *fakeHelper) BeginManually() error { return f.Begin() }
+func (f *fakeHelper) Commit() error {
+	if !f.tx {
+		return ErrNoTx
+	}
+	f.tx = false
+	f.record("Commit")
+	return nil
+}
+func (f *fakeHelper) DatabaseVersion() string   { return "fake" }
+func (f *fakeHelper) Discard(name string) error { f.record("Discard"); return nil }
+func (f *fakeHelper) Escape(fv string) string   { return fv }
+func (f *fakeHelper) Exec(sql string, args ...any) (int64, error) {
+	f.record("Exec")
+	return 1, nil
+}
+func (f *fakeHelper) Exists(sqlWithParams string, args ...any) (bool, error) {
+	f.record("Exists")
+	return true, nil
+}
+func (f *fakeHelper) ExistsExt(tableName string, values []ColumnFilter) (bool, error) {
+	f.record("ExistsExt")
+	return true, nil
+}
+func (f *fakeHelper) Mark(name string) error { f.record("Mark"); return nil }
+func (f *fakeHelper) Next(serial string, next *int64) error {
+	f.record("Next")
+	*next++
+	return nil
+}
+func (f *fakeHelper) Now() *time.Time    { t := time.Now(); return &t }
+func (f *fakeHelper) NowUTC() *time.Time { t := time.Now().UTC(); return &t }
+func (f *fakeHelper) Ping() error        { return nil }
+func (f *fakeHelper) Query(sql string, args ...any) (Rows, error) {
+	f.record("Query")
+	return nil, nil
+}
+func (f *fakeHelper) QueryArray(sql string, out any, args ...any) error {
+	f.record("QueryArray")
+	return nil
+}
+func (f *fakeHelper) QueryRow(sql string, args ...any) Row {
+	f.record("QueryRow")
+	return fakeRow{}
+}
+func (f *fakeHelper) Rollback() error {
+	if !f.tx {
+		return ErrNoTx
+	}
+	f.tx = false
+	f.record("Rollback")
+	return nil
+}
+func (f *fakeHelper) Release() error {
+	if f.tx {
+		f.Rollback()
+	}
+	f.record("Release")
+	return nil
+}
+func (f *fakeHelper) Save(name string) error { f.record("Save"); return nil }
+func (f *fakeHelper) UpsertReturning(
+	tableName string,
+	insertColumns []string,
+	uniqueColumns []string,
+	updateColumns []string,
+	returnColumns []string,
+	args ...any,
+) (Row, error) {
+	f.record("UpsertReturning")
+	return fakeRow{}, nil
+}
+func (f *fakeHelper) VendorStatement(key string) string { return "" }
+func (f *fakeHelper) VendorStatements() []string        { return nil }
+
+func TestRouting(t *testing.T) {
+	primary := newFakeHandle("primary")
+	r1, r2 := newFakeHandle("r1"), newFakeHandle("r2")
+	rh := NewRoutingHandle(primary, []DataHelperHandle{r1, r2})
+
+	fh := newFakeHelper()
+	dh := Route(fh)
+	if err := dh.Acquire(context.Background(), rh); err != nil {
+		t.Fatal(err)
+	}
+	dh.QueryRow(`SELECT 1`)
+	if _, err := dh.Exec(`UPDATE t SET a = 1`); err != nil {
+		t.Fatal(err)
+	}
+	if err := dh.Begin(); err != nil {
+		t.Fatal(err)
+	}
+	dh.QueryRow(`SELECT 1`)
+	if err := dh.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{"QueryRow@r1", "Exec@primary", "Begin@primary", "QueryRow@primary", "Commit@primary"}
+	if len(*fh.calls) != len(want) {
+		t.Fatalf("got %v, want %v", *fh.calls, want)
+	}
+	for i := range want {
+		if (*fh.calls)[i] != want[i] {
+			t.Fatalf("got %v, want %v", *fh.calls, want)
+		}
+	}
+
+	// unhealthy replicas are skipped
+	r1.err = errors.New("down")
+	for range 3 {
+		if rep := rh.Replica(); rep != r2 {
+			t.Fatalf("expected r2, got %v", rep)
+		}
+	}
+}
+
+func TestRoutingReacquire(t *testing.T) {
+	primary, replica := newFakeHandle("primary"), newFakeHandle("r1")
+	var buf strings.Builder
+	rh := NewRoutingHandle(primary, []DataHelperHandle{replica}, WithRoutingLogger(slog.New(slog.NewTextHandler(&buf, nil))))
+	replicaDown := false
+	failing := func(op *Operation, next Invoker) error {
+		if op.Method == "Acquire" && op.Handle == replica && replicaDown {
+			return errors.New("too many connections")
+		}
+		return next(op)
+	}
+	fh := newFakeHelper()
+	dh := Route(Wrap(fh, failing))
+	if err := dh.Acquire(context.Background(), rh); err != nil {
+		t.Fatal(err)
+	}
+	replicaDown = true
+	if err := dh.Acquire(context.Background(), rh); err != nil {
+		t.Fatalf("a replica failure failed Acquire: %v", err)
+	}
+	dh.QueryRow(`SELECT 1`)
+	if got := strings.Join(*fh.calls, ","); !strings.HasPrefix(got, "Release@r1,") || !strings.HasSuffix(got, "QueryRow@primary") {
+		t.Errorf("calls %s, want the first replica released and the read on the primary", got)
+	}
+	if !strings.Contains(buf.String(), "replica not acquired") {
+		t.Errorf("replica failure not logged: %s", buf.String())
+	}
+}
+
+func TestReadYourWrites(t *testing.T) {
+	primary, replica := newFakeHandle("primary"), newFakeHandle("r1")
+	rh := NewRoutingHandle(primary, []DataHelperHandle{replica}, WithReadYourWrites(time.Minute))
+	var failExec error
+	fh := newFakeHelper()
+	failing := func(op *Operation, next Invoker) error {
+		if op.Method == "Exec" && failExec != nil {
+			return failExec
+		}
+		return next(op)
+	}
+	writer, other := Route(Wrap(fh, failing)), Route(Wrap(fh, failing))
+	for _, dh := range []DataHelperLite{writer, other} {
+		if err := dh.Acquire(context.Background(), rh); err != nil {
+			t.Fatal(err)
+		}
+	}
+	read := func(dh DataHelperLite) string {
+		dh.QueryRow(`SELECT 1`)
+		calls := *fh.calls
+		return calls[len(calls)-1]
+	}
+
+	failExec = errors.New("constraint violation")
+	if _, err := writer.Exec(`UPDATE t SET a = 1`); err == nil {
+		t.Fatal("expected the write to fail")
+	}
+	if got := read(writer); got != "QueryRow@r1" {
+		t.Errorf("read after a failed write went to %s", got)
+	}
+	failExec = nil
+	if _, err := writer.Exec(`UPDATE t SET a = 1`); err != nil {
+		t.Fatal(err)
+	}
+	if got := read(writer); got != "QueryRow@primary" {
+		t.Errorf("read after a write went to %s, want the primary", got)
+	}
+	if got := read(other); got != "QueryRow@r1" {
+		t.Errorf("read of another helper went to %s, want the replica", got)
+	}
+}
+
+func TestMetricsExport(t *testing.T) {
+	m := NewMetrics()
+	m.pools = func() map[string]sql.DBStats {
+		return map[string]sql.DBStats{"main": {MaxOpenConnections: 10, InUse: 2}}
+	}
+	dh := Instrument(newFakeHelper(), m)
+	if _, err := dh.Exec(`DELETE FROM t`); err != nil {
+		t.Fatal(err)
+	}
+	if err := dh.Begin(); err != nil {
+		t.Fatal(err)
+	}
+	if err := dh.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	m.ObserveQuery("Query", time.Millisecond, context.DeadlineExceeded)
+	m.ObserveQuery("QueryRow", time.Millisecond, sql.ErrNoRows)
+	m.ReconnectHook("main")(ReconnectEvent{Kind: ReconnectAttempt})
+
+	var sb strings.Builder
+	if err := m.Export(&sb); err != nil {
+		t.Fatal(err)
+	}
+	out := sb.String()
+	for _, want := range []string{
+		`datahelperlite_query_duration_seconds_count{operation="Exec"} 1`,
+		`datahelperlite_query_errors_total{operation="Query",type="timeout"} 1`,
+		`datahelperlite_transactions_total{outcome="commit"} 1`,
+		`datahelperlite_reconnect_attempts_total{handle="main"} 1`,
+		`datahelperlite_pool_in_use_connections{handle="main"} 2`,
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("missing %q in:\n%s", want, out)
+		}
+	}
+	if strings.Contains(out, `type="no_rows"`) {
+		t.Errorf("no rows counted as an error:\n%s", out)
+	}
+
+	// The registered handles are read while others register
+	h := &fakeHandle{name: "metrics", db: sql.OpenDB(&recConnector{})}
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := range 100 {
+			SetHandler(fmt.Sprintf("metrics-%d", i%4), h)
+		}
+	}()
+	for range 100 {
+		HandleStats()
+		StmtCacheStatsByHandle()
+	}
+	wg.Wait()
+	if _, ok := HandleStats()["metrics-3"]; !ok || HandleName(h) == "" {
+		t.Error("registered handle missing from the statistics")
+	}
+}
+
+func TestWrap(t *testing.T) {
+	var trail []string
+	tag := func(name string) Interceptor {
+		return func(op *Operation, next Invoker) error {
+			trail = append(trail, name+":"+op.Method)
+			if op.Method == "Exec" {
+				op.SQL += " /* " + name + " */"
+			}
+			return next(op)
+		}
+	}
+	var seenSQL, seenTx string
+	last := func(op *Operation, next Invoker) error {
+		seenSQL, seenTx = op.SQL, op.TxID
+		return next(op)
+	}
+
+	dh := Wrap(newFakeHelper(), tag("a"), tag("b"), last).NewHelper()
+	if err := dh.Acquire(context.Background(), newFakeHandle("main")); err != nil {
+		t.Fatal(err)
+	}
+	if err := dh.Begin(); err != nil {
+		t.Fatal(err)
+	}
+	n, err := dh.Exec(`UPDATE t SET a = 1`)
+	if err != nil || n != 1 {
+		t.Fatalf("unexpected result %d, %v", n, err)
+	}
+	if seenSQL != `UPDATE t SET a = 1 /* a */ /* b */` {
+		t.Errorf("unexpected SQL %q", seenSQL)
+	}
+	if seenTx == "" {
+		t.Error("expected a transaction id inside a transaction")
+	}
+	if want := "a:Acquire b:Acquire a:Begin b:Begin a:Exec b:Exec"; strings.Join(trail, " ") != want {
+		t.Errorf("got %q, want %q", strings.Join(trail, " "), want)
+	}
+
+	deny := errors.New("denied")
+	dh = Wrap(newFakeHelper(), func(op *Operation, next Invoker) error { return deny })
+	if err := dh.QueryRow(`SELECT 1`).Scan(); !errors.Is(err, deny) {
+		t.Errorf("expected the interceptor error from Scan, got %v", err)
+	}
+}
+
+func TestQueryLogger(t *testing.T) {
+	var buf strings.Builder
+	logger := slog.New(slog.NewTextHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	dh := Wrap(newFakeHelper(), QueryLogger(logger, QueryLogOptions{
+		Redact:        &RedactPolicy{Columns: []string{"password"}},
+		SlowThreshold: time.Nanosecond,
+	}))
+	if _, err := dh.Exec("UPDATE  users\n SET password = ?, token = ? WHERE name = ?", "hunter2", Secret{V: "abc"}, "bob"); err != nil {
+		t.Fatal(err)
+	}
+	out := buf.String()
+	for _, bad := range []string{"hunter2", "abc"} {
+		if strings.Contains(out, bad) {
+			t.Errorf("secret %q leaked: %s", bad, out)
+		}
+	}
+	for _, want := range []string{"level=WARN", `sql="UPDATE users SET password = ?, token = ? WHERE name = ?"`, "bob", "rows_affected=1"} {
+		if !strings.Contains(out, want) {
+			t.Errorf("missing %q in %s", want, out)
+		}
+	}
+
+	buf.Reset()
+	dh.Exec(`INSERT INTO users (created_at, name, password) VALUES (now(), ?, ?)`, "carol", "hunter3")
+	dh.Exec(`INSERT INTO users (name, password) VALUES (?, ?), (?, ?)`, "dave", "hunter4", "erin", "hunter5")
+	dh.Exec(`INSERT INTO users (name) SELECT ? FROM dual`, "hunter6")
+	out = buf.String()
+	for _, bad := range []string{"hunter3", "hunter4", "hunter5", "hunter6"} {
+		if strings.Contains(out, bad) {
+			t.Errorf("secret %q leaked: %s", bad, out)
+		}
+	}
+	for _, want := range []string{"carol", "dave", "erin"} {
+		if !strings.Contains(out, want) {
+			t.Errorf("missing %q in %s", want, out)
+		}
+	}
+}
+
+func TestPlaceholderColumns(t *testing.T) {
+	for _, c := range []struct {
+		sql  string
+		want []string
+	}{
+		{`INSERT INTO users (created_at, name, password) VALUES (now(), ?, ?)`, []string{"name", "password"}},
+		{`INSERT INTO t (a, b) VALUES (?, ?), (?, lower(?))`, []string{"a", "b", "a", "b"}},
+		{`INSERT INTO t (a, b) VALUES (coalesce(?, 'x'), ?) ON CONFLICT (a) DO UPDATE SET b = ?`, []string{"a", "b", "b"}},
+		{`INSERT INTO t (a) VALUES (?, ?)`, []string{"a", ""}},
+		{`SELECT * FROM t WHERE a = ? AND b IN (?, ?) LIMIT ?`, []string{"a", "b", "", ""}},
+	} {
+		if got := placeholderColumns(c.sql); strings.Join(got, "|") != strings.Join(c.want, "|") {
+			t.Errorf("%s: got %q, want %q", c.sql, got, c.want)
+		}
+	}
+}
+
+type recordedSpan struct {
+	name   string
+	parent *recordedSpan
+	attrs  map[string]any
+	err    error
+	ended  bool
+}
+
+func (s *recordedSpan) SetAttributes(attrs ...TraceAttr) {
+	for _, a := range attrs {
+		s.attrs[a.Key] = a.Value
+	}
+}
+func (s *recordedSpan) RecordError(err error) { s.err = err }
+func (s *recordedSpan) End()                  { s.ended = true }
+
+type spanKey struct{}
+
+// traceRecorder is an in-memory Tracer
+type traceRecorder struct {
+	spans []*recordedSpan
+}
+
+func (r *traceRecorder) Start(ctx context.Context, name string, attrs ...TraceAttr) (context.Context, Span) {
+	parent, _ := ctx.Value(spanKey{}).(*recordedSpan)
+	s := &recordedSpan{name: name, parent: parent, attrs: make(map[string]any)}
+	s.SetAttributes(attrs...)
+	r.spans = append(r.spans, s)
+	return context.WithValue(ctx, spanKey{}, s), s
+}
+
+func TestTracing(t *testing.T) {
+	rec := &traceRecorder{}
+	dh := Wrap(newFakeHelper(), Tracing(rec, TraceOptions{System: "postgresql", HandleName: "main"}))
+	if err := dh.Acquire(context.Background(), newFakeHandle("main")); err != nil {
+		t.Fatal(err)
+	}
+	if err := dh.Begin(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := dh.Exec(`INSERT INTO t (a) VALUES (?)`, 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := dh.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	dh.QueryRow(`SELECT a FROM t`)
+
+	names := make([]string, len(rec.spans))
+	for i, s := range rec.spans {
+		names[i] = s.name
+		if !s.ended {
+			t.Errorf("span %s not ended", s.name)
+		}
+	}
+	if want := "Acquire transaction Begin Exec Commit QueryRow"; strings.Join(names, " ") != want {
+		t.Fatalf("got %q, want %q", strings.Join(names, " "), want)
+	}
+	tx := rec.spans[1]
+	for _, s := range rec.spans[2:5] {
+		if s.parent != tx {
+			t.Errorf("span %s is not a child of the transaction span", s.name)
+		}
+	}
+	if rec.spans[5].parent != nil {
+		t.Error("span after commit should not be a child of the transaction span")
+	}
+	exec := rec.spans[3]
+	if exec.attrs[AttrDBSystem] != "postgresql" || exec.attrs[AttrHandle] != "main" ||
+		exec.attrs[AttrRowsAffected] != int64(1) || exec.attrs[AttrDBStatement] == nil {
+		t.Errorf("unexpected attributes %v", exec.attrs)
+	}
+	if tx.attrs[AttrTxOutcome] != "commit" {
+		t.Errorf("unexpected transaction attributes %v", tx.attrs)
+	}
+
+	// A failed commit ends the transaction span with its error
+	commitErr := errors.New("serialization failure")
+	rec = &traceRecorder{}
+	dh = Wrap(newFakeHelper(), Tracing(rec, TraceOptions{}), func(op *Operation, next Invoker) error {
+		if err := next(op); err != nil || op.Method != "Commit" {
+			return err
+		}
+		return commitErr
+	})
+	if err := dh.Acquire(context.Background(), newFakeHandle("main")); err != nil {
+		t.Fatal(err)
+	}
+	dh.Begin()
+	dh.Commit()
+	dh.Begin()
+	tx, next := rec.spans[1], rec.spans[4]
+	if !tx.ended || tx.err != commitErr || tx.attrs[AttrTxOutcome] != nil {
+		t.Errorf("transaction span after a failed commit: ended %v, error %v, attributes %v", tx.ended, tx.err, tx.attrs)
+	}
+	if next.name != "transaction" || next.parent != nil {
+		t.Errorf("next transaction span %s is a child of %v", next.name, next.parent)
+	}
+}
+
+func TestSQLCommenter(t *testing.T) {
+	var (
+		seen  string
+		inner context.Context
+	)
+	capture := func(op *Operation, next Invoker) error {
+		seen = op.SQL
+		if op.Method == "Acquire" {
+			inner = op.Context
+		}
+		return next(op)
+	}
+	dh := Wrap(newFakeHelper(), SQLCommenter(CommentOptions{App: "billing"}), capture)
+	ctx := WithQueryTag(context.Background(), "route", "/invoices */ DROP TABLE x; --'")
+	if err := dh.Acquire(ctx, newFakeHandle("main")); err != nil {
+		t.Fatal(err)
+	}
+	dh.QueryRow(`SELECT 1;`)
+	tag := `/*app='billing',route='%2Finvoices%20%2A%2F%20DROP%20TABLE%20x%3B%20--%27'*/`
+	if want := `SELECT 1 ` + tag + `;`; seen != want {
+		t.Errorf("got %s, want %s", seen, want)
+	}
+	if !HasQueryTags(seen) {
+		t.Errorf("no query tags found in %s", seen)
+	}
+
+	// Statements built by the wrapped helper are tagged through the context of its Acquire
+	if got, want := CommentStatement(inner, `SELECT 1 FROM t`), `SELECT 1 FROM t `+tag; got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+	if got := CommentStatement(ctx, `SELECT 1`); got != `SELECT 1` {
+		t.Errorf("tagged without a SQLCommenter: %s", got)
+	}
+	// A trailing line comment would swallow a tag on its line
+	if got, want := CommentStatement(inner, "SELECT 1 -- totals;\n"), "SELECT 1 -- totals;\n"+tag; got != want || !HasQueryTags(got) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	for _, sql := range []string{`SELECT '/*a=''b''*/'`, `SELECT /*+ INDEX(t) */ 1`, `SELECT 1 -- a='b'`} {
+		if HasQueryTags(sql) {
+			t.Errorf("query tags found in %s", sql)
+		}
+	}
+}
+
+func TestFingerprint(t *testing.T) {
+	tests := []struct{ in, want string }{
+		{"SELECT a, b FROM t WHERE id = 42 AND name = 'O''Brien'", "select a, b from t where id = ? and name = ?"},
+		{"select A,b\n\tfrom T where ID=$1 -- trailing\n", "select a, b from t where id = ?"},
+		{"SELECT * FROM t WHERE id IN (1, 2, 3) /* c */", "select * from t where id in (?+)"},
+		{"SELECT * FROM t WHERE id in (?,?)", "select * from t where id in (?+)"},
+		{"UPDATE [Order] SET x = -1.5e3 WHERE y = N'z';", "update [Order] set x = ? where y = ?"},
+	}
+	for _, tt := range tests {
+		if got := Fingerprint(tt.in); got != tt.want {
+			t.Errorf("Fingerprint(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestSplitStatements(t *testing.T) {
+	for _, c := range []struct {
+		script string
+		want   []string
+	}{
+		{
+			"-- header\nCREATE TABLE t (a TEXT DEFAULT ';');\n" +
+				"CREATE FUNCTION f() RETURNS int AS $$ BEGIN RETURN 1; END $$ LANGUAGE plpgsql;\n" +
+				"/* ; */ INSERT INTO \"x;y\" VALUES (1);\nSELECT going FROM t\n;;\n-- only a comment\n",
+			[]string{
+				"-- header\nCREATE TABLE t (a TEXT DEFAULT ';')",
+				"CREATE FUNCTION f() RETURNS int AS $$ BEGIN RETURN 1; END $$ LANGUAGE plpgsql",
+				"/* ; */ INSERT INTO \"x;y\" VALUES (1)",
+				"SELECT going FROM t",
+			},
+		},
+		{
+			// T-SQL batches keep their semicolons
+			"CREATE TABLE t (a INT);\nGO\nCREATE PROCEDURE p AS\nBEGIN\n  SET NOCOUNT ON;\n  SELECT going FROM t;\nEND\ngo -- batch\n" +
+				"INSERT INTO [x;y] VALUES (1); INSERT INTO t VALUES (2);\nGO\n-- only a comment\nGO\n",
+			[]string{
+				"CREATE TABLE t (a INT);",
+				"CREATE PROCEDURE p AS\nBEGIN\n  SET NOCOUNT ON;\n  SELECT going FROM t;\nEND",
+				"INSERT INTO [x;y] VALUES (1); INSERT INTO t VALUES (2);",
+			},
+		},
+	} {
+		got := SplitStatements(c.script)
+		if strings.Join(got, "|") != strings.Join(c.want, "|") {
+			t.Errorf("got %q\nwant %q", got, c.want)
+		}
+	}
+}
+
+func TestReplaceQueryParamMarker(t *testing.T) {
+	got := ReplaceQueryParamMarker(`SELECT '?' AS q /* ? */ FROM t WHERE a = ? AND b = ?`, true, `$`)
+	if want := `SELECT '?' AS q /* ? */ FROM t WHERE a = $1 AND b = $2`; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	got = ReplaceQueryParamMarker(`a = ? AND b = ?`, false, `@p`)
+	if want := `a = @p AND b = @p`; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	now := time.Unix(0, 0)
+	bh := NewBreakerHandle(newFakeHandle("main"), BreakerOptions{
+		ConsecutiveFailures: 2,
+		OpenTimeout:         time.Minute,
+		Now:                 func() time.Time { return now },
+	})
+	cb := bh.Breaker()
+	var fail error
+	failing := func(op *Operation, next Invoker) error {
+		if fail != nil {
+			return fail
+		}
+		return next(op)
+	}
+	dh := Wrap(newFakeHelper(), CircuitBreaking(), failing)
+	if err := dh.Acquire(context.Background(), bh); err != nil {
+		t.Fatal(err)
+	}
+
+	fail = driver.ErrBadConn
+	for range 2 {
+		if _, err := dh.Exec(`DELETE FROM t`); !errors.Is(err, driver.ErrBadConn) {
+			t.Fatalf("expected the driver error, got %v", err)
+		}
+	}
+	if _, err := dh.Exec(`DELETE FROM t`); !errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("expected ErrCircuitOpen, got %v", err)
+	}
+
+	// half-open lets one probe through, which closes the breaker
+	now = now.Add(time.Minute)
+	fail = nil
+	if cb.State() != BreakerHalfOpen {
+		t.Fatalf("expected half-open, got %v", cb.State())
+	}
+	if _, err := dh.Exec(`DELETE FROM t`); err != nil {
+		t.Fatal(err)
+	}
+	if cb.State() != BreakerClosed {
+		t.Fatalf("expected closed, got %v", cb.State())
+	}
+
+	// a successful ping lets a probe through, whose failure opens the breaker again
+	cb.Trip()
+	if err := bh.Ping(); err != nil || cb.State() != BreakerHalfOpen {
+		t.Fatalf("expected the ping to half-open the breaker, got %v, %v", err, cb.State())
+	}
+	fail = driver.ErrBadConn
+	if _, err := dh.Exec(`DELETE FROM t`); !errors.Is(err, driver.ErrBadConn) {
+		t.Fatalf("expected the probe to run, got %v", err)
+	}
+	if err := bh.Ping(); err != nil || cb.State() != BreakerHalfOpen {
+		t.Fatalf("expected half-open, got %v, %v", err, cb.State())
+	}
+	fail = nil
+	if _, err := dh.Exec(`DELETE FROM t`); err != nil || cb.State() != BreakerClosed {
+		t.Fatalf("expected the probe to close the breaker, got %v, %v", err, cb.State())
+	}
+
+	// healthy pings leave an open breaker alone, a reconnection after a loss closes it
+	hook := cb.ReconnectHook()
+	cb.Trip()
+	hook(ReconnectEvent{Kind: ReconnectHealthy})
+	hook(ReconnectEvent{Kind: ReconnectConnected})
+	if cb.State() != BreakerOpen {
+		t.Fatalf("expected open, got %v", cb.State())
+	}
+	hook(ReconnectEvent{Kind: ReconnectLost})
+	hook(ReconnectEvent{Kind: ReconnectConnected})
+	if cb.State() != BreakerClosed {
+		t.Fatalf("expected the reconnection to close the breaker, got %v", cb.State())
+	}
+}
+
+func TestBulkhead(t *testing.T) {
+	b := NewBulkhead(map[string]int64{"reports": 2})
+	newHelper := func() DataHelperLite { return Wrap(newFakeHelper(), b.Interceptor()) }
+
+	reqCtx, endRequest := context.WithCancel(context.Background())
+	heavy := WithLane(reqCtx, "reports", 2)
+	if err := newHelper().Acquire(heavy, newFakeHandle("main")); err != nil {
+		t.Fatal(err)
+	}
+
+	// the lane is full, so the next acquisition waits until its context times out
+	ctx, cancel := context.WithTimeout(WithLane(context.Background(), "reports", 1), 10*time.Millisecond)
+	defer cancel()
+	if err := newHelper().Acquire(ctx, newFakeHandle("main")); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected a timeout, got %v", err)
+	}
+
+	// ending the first request gives the permits back
+	endRequest()
+	deadline := time.Now().Add(time.Second)
+	for b.Stats()["reports"].InUse != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("permits were not given back")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	st := b.Stats()["reports"]
+	if st.Acquired != 1 || st.Canceled != 1 || st.Waiting != 0 {
+		t.Errorf("unexpected stats %+v", st)
+	}
+
+	// contexts without a lane are not limited when there is no default lane
+	if err := newHelper().Acquire(context.Background(), newFakeHandle("main")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// stmtConnector hands out connections that only prepare and execute statements
+type stmtConnector struct {
+	prepared *int
+	closed   *int
+}
+
+func (c stmtConnector) Connect(context.Context) (driver.Conn, error) { return stmtConn(c), nil }
+func (c stmtConnector) Driver() driver.Driver                        { return nil }
+
+type stmtConn stmtConnector
+
+func (c stmtConn) Prepare(query string) (driver.Stmt, error) {
+	*c.prepared++
+	return stmtStmt{closed: c.closed}, nil
+}
+func (c stmtConn) Close() error              { return nil }
+func (c stmtConn) Begin() (driver.Tx, error) { return stmtTx{}, nil }
+
+type stmtStmt struct{ closed *int }
+
+func (s stmtStmt) Close() error  { *s.closed++; return nil }
+func (s stmtStmt) NumInput() int { return -1 }
+func (s stmtStmt) Exec(args []driver.Value) (driver.Result, error) {
+	return driver.RowsAffected(1), nil
+}
+func (s stmtStmt) Query(args []driver.Value) (driver.Rows, error) {
+	return nil, errors.New("not supported")
+}
+
+type stmtTx struct{}
+
+func (stmtTx) Commit() error   { return nil }
+func (stmtTx) Rollback() error { return nil }
+
+func TestStmtCache(t *testing.T) {
+	var prepared, closed int
+	db := sql.OpenDB(stmtConnector{prepared: &prepared, closed: &closed})
+	db.SetMaxOpenConns(1)
+	ctx := context.Background()
+	c := NewStmtCache(2)
+	exec := func(db *sql.DB, tx *sql.Tx, query string) {
+		t.Helper()
+		err := c.Do(ctx, db, tx, query, func(st *sql.Stmt) error {
+			_, err := st.ExecContext(ctx)
+			return err
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	exec(db, nil, "A")
+	exec(db, nil, "A")
+	exec(db, nil, "B")
+	exec(db, nil, "C") // evicts A
+	if st := c.Stats(); st.Hits != 1 || st.Misses != 3 || st.Evictions != 1 || st.Size != 2 {
+		t.Fatalf("unexpected stats %+v", st)
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exec(db, tx, "C")
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if st := c.Stats(); st.Hits != 2 {
+		t.Fatalf("expected the transaction to use the cached statement, got %+v", st)
+	}
+
+	// a new pool, as after a reconnection, drops the statements of the old one
+	db2 := sql.OpenDB(stmtConnector{prepared: &prepared, closed: &closed})
+	exec(db2, nil, "B")
+	if st := c.Stats(); st.Size != 1 || st.Evictions != 3 {
+		t.Fatalf("unexpected stats after pool change %+v", st)
+	}
+
+	// handles over the same pool share its cache, closed pools drop it
+	SetStmtCache(db2, c)
+	if StmtCacheFor(db2) != c || StmtCacheFor(db) == c {
+		t.Fatal("cache not kept by pool")
+	}
+	DropStmtCache(db2)
+	if st := c.Stats(); st.Size != 0 || StmtCacheFor(db2) == c {
+		t.Fatalf("cache kept after DropStmtCache: %+v", st)
+	}
+	DropStmtCache(db2)
+	DropStmtCache(db)
+
+	for q, want := range map[string]bool{
+		"SELECT 1":                         true,
+		"SELECT ';'":                       true,
+		"SELECT 1; SELECT 2":               false,
+		"SELECT 1 /*app='api',trace='1'*/": false,
+		"SELECT 1 /* plain */; SELECT 2":   false,
+	} {
+		for range 2 {
+			if got := c.Cacheable(q); got != want {
+				t.Errorf("Cacheable(%q) = %v", q, got)
+			}
+		}
+	}
+}
+
+func TestResultCache(t *testing.T) {
+	rc := NewResultCache(nil)
+	fh := newFakeHelper()
+	dh := Wrap(fh, rc.Interceptor())
+	if err := dh.Acquire(context.Background(), newFakeHandle("main")); err != nil {
+		t.Fatal(err)
+	}
+	reads := func() int {
+		n := 0
+		for _, c := range *fh.calls {
+			if strings.HasPrefix(c, "QueryArray") {
+				n++
+			}
+		}
+		return n
+	}
+
+	var out []string
+	q := `SELECT code FROM {ref.currency} WHERE active = ?`
+	for range 2 {
+		if err := Cached(dh, time.Minute).QueryArray(q, &out, true); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if reads() != 1 {
+		t.Fatalf("expected one database read, got %d", reads())
+	}
+	if err := Cached(dh, time.Minute).QueryArray(q, &out, false); err != nil {
+		t.Fatal(err)
+	}
+	if reads() != 2 {
+		t.Fatal("different arguments must not share a cached result")
+	}
+
+	// pointers are keyed on what they point to
+	for _, v := range []bool{true, false} {
+		if err := Cached(dh, time.Minute).QueryArray(q, &out, &v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if reads() != 2 {
+		t.Fatalf("expected pointers to the same values to be served from the cache, got %d reads", reads())
+	}
+
+	// placeholders that fingerprint alike are keyed apart
+	for _, pq := range []string{`SELECT code FROM {ref.currency} WHERE active = $1 OR id = $2`, `SELECT code FROM {ref.currency} WHERE active = $2 OR id = $1`} {
+		if err := Cached(dh, time.Minute).QueryArray(pq, &out, true, 1); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if reads() != 4 {
+		t.Fatalf("expected statements with other placeholders to reach the database, got %d reads", reads())
+	}
+
+	// tenants do not share results, whatever the order of the interceptors
+	th := Wrap(fh, rc.Interceptor())
+	if err := th.Acquire(WithTenant(context.Background(), "acme"), newFakeHandle("main")); err != nil {
+		t.Fatal(err)
+	}
+	if err := Cached(th, time.Minute).QueryArray(q, &out, true); err != nil {
+		t.Fatal(err)
+	}
+	if reads() != 5 {
+		t.Fatal("expected the read of another tenant to reach the database")
+	}
+
+	// a write to the table invalidates its results
+	if _, err := dh.Exec(`UPDATE ref.Currency SET active = ?`, false); err != nil {
+		t.Fatal(err)
+	}
+	if err := Cached(dh, time.Minute).QueryArray(q, &out, true); err != nil {
+		t.Fatal(err)
+	}
+	if reads() != 6 {
+		t.Fatal("expected the write to invalidate the cached result")
+	}
+
+	// reads inside a transaction skip the cache
+	if err := dh.Begin(); err != nil {
+		t.Fatal(err)
+	}
+	if err := Cached(dh, time.Minute).QueryArray(q, &out, true); err != nil {
+		t.Fatal(err)
+	}
+	if reads() != 7 {
+		t.Fatal("expected the read inside a transaction to reach the database")
+	}
+	if st := rc.Stats(); st.Hits != 3 {
+		t.Errorf("unexpected stats %+v", st)
+	}
+}
+
+func TestResultCacheKeys(t *testing.T) {
+	rc := NewResultCache(nil)
+	fh := newFakeHelper()
+	racing := false
+	dh := Wrap(fh, rc.Interceptor(), func(op *Operation, next Invoker) error {
+		if racing && op.Method == "QueryArray" {
+			// A write commits while the read runs
+			rc.Invalidate("currency")
+		}
+		return next(op)
+	})
+	reads := func() int { return strings.Count(strings.Join(*fh.calls, ","), "QueryArray") }
+	read := func(h DataHelperHandle) {
+		t.Helper()
+		if err := dh.Acquire(context.Background(), h); err != nil {
+			t.Fatal(err)
+		}
+		var out []string
+		if err := Cached(dh, time.Minute).QueryArray(`SELECT code FROM {currency}`, &out); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	main := newFakeHandle("main")
+	read(main)
+	read(main)
+	read(newFakeHandle("other"))
+	if reads() != 2 {
+		t.Fatalf("expected each handle to read its own database, got %d reads", reads())
+	}
+	for _, schema := range []string{"a", "b"} {
+		h := newFakeHandle("main")
+		h.di = dn.New(dn.Schema(schema))
+		read(h)
+	}
+	if reads() != 4 {
+		t.Fatalf("expected each schema to be read, got %d reads", reads())
+	}
+
+	rc.Invalidate("currency")
+	racing = true
+	read(main)
+	racing = false
+	read(main)
+	if reads() != 6 {
+		t.Fatalf("expected the result read across an invalidation not to be stored, got %d reads", reads())
+	}
+}
+
+func TestTableResolver(t *testing.T) {
+	if got, want := InterpolateTable(`SELECT * FROM {orders} JOIN {audit.log}`, "dbo"), `SELECT * FROM dbo.orders JOIN audit.log`; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	tr := &TableResolver{
+		Schema:  "app",
+		Tables:  map[string]string{"orders": "archive.orders_2024", "user": "user"},
+		Dialect: DialectPostgres,
+	}
+	got, err := tr.Resolve(`SELECT * FROM {orders} o JOIN {user} u ON u.id = o.user_id JOIN {[Line Item]} l ON 1=1`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `SELECT * FROM archive.orders_2024 o JOIN app."user" u ON u.id = o.user_id JOIN app.[Line Item] l ON 1=1`; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	tr = TableResolverFor(nil, map[string]string{"order": "order"})
+	tr.Escape, tr.Strict = "[]", true
+	if got, _ := tr.Table("order"); got != "[order]" {
+		t.Errorf("got %q", got)
+	}
+	if _, err := tr.Resolve(`SELECT * FROM {missing}`); !errors.Is(err, ErrUnknownTable) {
+		t.Errorf("got %v, want ErrUnknownTable", err)
+	}
+	if got := DialectOfDriver("pgx"); got != DialectPostgres {
+		t.Errorf("got %q", got)
+	}
+}
+
+func TestTenants(t *testing.T) {
+	var seen []string
+	record := func(op *Operation, next Invoker) error {
+		switch {
+		case op.SQL != "":
+			seen = append(seen, op.SQL)
+		case op.Table != "":
+			seen = append(seen, op.Table)
+		}
+		return next(op)
+	}
+	tenantDB := newFakeHandle("tenant-db")
+	resolver := TenantResolverFunc(func(ctx context.Context, id string) (Tenant, error) {
+		if id == "big" {
+			return Tenant{ID: id, Schema: "big", Handle: tenantDB, Tables: map[string]string{"events": "archive.events"}}, nil
+		}
+		return SchemaPerTenant("tenant_%s").ResolveTenant(ctx, id)
+	})
+	fake := newFakeHelper()
+	dh := Wrap(fake, Tenants(TenantOptions{Resolver: resolver, Required: true, SearchPath: true, Dialect: DialectPostgres}), record)
+
+	if err := dh.Acquire(context.Background(), newFakeHandle("main")); !errors.Is(err, ErrNoTenant) {
+		t.Fatalf("got %v, want ErrNoTenant", err)
+	}
+	if err := dh.Acquire(WithTenant(context.Background(), "a;drop"), newFakeHandle("main")); !errors.Is(err, ErrInvalidTenant) {
+		t.Fatalf("got %v, want ErrInvalidTenant", err)
+	}
+	if err := dh.Acquire(WithTenant(context.Background(), "acme"), newFakeHandle("main")); err != nil {
+		t.Fatal(err)
+	}
+	dh.Exec(`DELETE FROM {orders} WHERE id = ?`, 1)
+	dh.ExistsExt("orders", nil)
+	if err := dh.Begin(); err != nil {
+		t.Fatal(err)
+	}
+	dh.Rollback()
+	want := []string{`DELETE FROM tenant_acme.orders WHERE id = ?`, `tenant_acme.orders`}
+	if strings.Join(seen, "|") != strings.Join(want, "|") {
+		t.Errorf("got %q, want %q", seen, want)
+	}
+	if got := strings.Join(*fake.calls, ","); got != "Exec@main,ExistsExt@main,Begin@main,Exec@main,Rollback@main" {
+		t.Errorf("calls %s", got)
+	}
+
+	seen = nil
+	if err := dh.Acquire(WithTenant(context.Background(), "big"), newFakeHandle("main")); err != nil {
+		t.Fatal(err)
+	}
+	dh.QueryRow(`SELECT * FROM {events} JOIN {users} ON 1=1`)
+	if want := `SELECT * FROM archive.events JOIN big.users ON 1=1`; len(seen) != 1 || seen[0] != want {
+		t.Errorf("got %q, want %q", seen, want)
+	}
+	if fake.handle != tenantDB {
+		t.Errorf("tenant handle was not acquired")
+	}
+
+	fake = newFakeHelper()
+	dh = Wrap(fake, Tenants(TenantOptions{SearchPath: true, Dialect: DialectSQLite}))
+	if err := dh.Acquire(WithTenant(context.Background(), "acme"), newFakeHandle("main")); err != nil {
+		t.Fatal(err)
+	}
+	dh.Begin()
+	if got := strings.Join(*fake.calls, ","); got != "Begin@main" {
+		t.Errorf("search path set on SQLite: calls %s", got)
+	}
+}
+
+// recConnector connects to a fake database that records the statements executed on each connection
+type recConnector struct {
+	mu     sync.Mutex
+	execs  []string
+	fail   string
+	conns  int
+	closed int
+}
+
+func (c *recConnector) Connect(context.Context) (driver.Conn, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.conns++
+	return &recConn{c: c, id: c.conns}, nil
+}
+
+func (c *recConnector) Driver() driver.Driver { return nil }
+
+type recConn struct {
+	c  *recConnector
+	id int
+}
+
+func (rc *recConn) Prepare(string) (driver.Stmt, error) { return nil, errors.New("not supported") }
+func (rc *recConn) Begin() (driver.Tx, error)           { return nil, errors.New("not supported") }
+func (rc *recConn) Close() error {
+	rc.c.mu.Lock()
+	rc.c.closed++
+	rc.c.mu.Unlock()
+	return nil
+}
+func (rc *recConn) ExecContext(_ context.Context, query string, _ []driver.NamedValue) (driver.Result, error) {
+	rc.c.mu.Lock()
+	defer rc.c.mu.Unlock()
+	if query == rc.c.fail {
+		return nil, errors.New("syntax error")
+	}
+	rc.c.execs = append(rc.c.execs, fmt.Sprintf("%d:%s", rc.id, query))
+	return driver.RowsAffected(0), nil
+}
+
+type pinningHelper struct {
+	*fakeHelper
+	mu   sync.Mutex
+	conn *sql.Conn
+}
+
+func (p *pinningHelper) PinConn(conn *sql.Conn) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.conn = conn
+}
+
+func (p *pinningHelper) pinned() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.conn != nil
+}
+
+func TestSessionInit(t *testing.T) {
+	rc := &recConnector{}
+	h := &fakeHandle{name: "main", db: sql.OpenDB(rc)}
+	SetSessionInit(h, SessionInit{Statements: []string{"SET TIME ZONE 'UTC'"}, Reset: []string{"RESET ALL"}})
+	defer SetSessionInit(h, SessionInit{})
+
+	ph := &pinningHelper{fakeHelper: newFakeHelper()}
+	dh := Wrap(ph, SessionInitializer())
+	ctx, cancel := context.WithCancel(context.Background())
+	ctx = WithSessionInit(ctx, SessionInit{Statements: []string{"SET application_name = 'api'"}})
+	if err := dh.Acquire(ctx, h); err != nil {
+		t.Fatal(err)
+	}
+	if !ph.pinned() {
+		t.Fatal("connection was not pinned")
+	}
+	// The end of the context returns the connection, the helper keeps it pinned until it is released
+	cancel()
+	execs := func() string {
+		rc.mu.Lock()
+		defer rc.mu.Unlock()
+		return strings.Join(rc.execs, "|")
+	}
+	want := "1:SET TIME ZONE 'UTC'|1:SET application_name = 'api'|1:RESET ALL"
+	deadline := time.Now().Add(time.Second)
+	for execs() != want && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if got := execs(); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if !ph.pinned() {
+		t.Fatal("connection unpinned when the context ended")
+	}
+	if err := dh.Release(); err != nil {
+		t.Fatal(err)
+	}
+	if ph.pinned() {
+		t.Error("connection still pinned after release")
+	}
+	if got := execs(); got != want {
+		t.Errorf("reset twice: got %q", got)
+	}
+
+	// Without reset statements, a connection set up by the handle alone goes back to the pool
+	SetSessionInit(h, SessionInit{Statements: []string{"SET TIME ZONE 'UTC'"}})
+	if err := dh.Acquire(context.Background(), h); err != nil {
+		t.Fatal(err)
+	}
+	if err := dh.Release(); err != nil {
+		t.Fatal(err)
+	}
+	rc.mu.Lock()
+	if rc.closed != 0 || rc.conns != 1 {
+		t.Errorf("connection not reused, opened %d, closed %d", rc.conns, rc.closed)
+	}
+	rc.mu.Unlock()
+
+	rc.mu.Lock()
+	rc.fail = "SET LOCK_TIMEOUT 1000"
+	rc.mu.Unlock()
+	err := dh.Acquire(WithSessionInit(context.Background(), SessionInit{Statements: []string{"SET LOCK_TIMEOUT 1000"}}), h)
+	if !errors.Is(err, ErrSessionInit) {
+		t.Errorf("got %v, want ErrSessionInit", err)
+	}
+	rc.mu.Lock()
+	if rc.closed != 1 {
+		t.Errorf("failed session was not discarded, closed %d", rc.closed)
+	}
+	rc.mu.Unlock()
+
+	if err := Wrap(newFakeHelper(), SessionInitializer()).Acquire(context.Background(), h); !errors.Is(err, ErrConnPinUnsupported) {
+		t.Errorf("got %v, want ErrConnPinUnsupported", err)
+	}
+}
+
+func TestRelease(t *testing.T) {
+	fake := newFakeHelper()
+	b := NewBulkhead(map[string]int64{DefaultLane: 1})
+	var buf strings.Builder
+	ld := NewLeakDetector(slog.New(slog.NewTextHandler(&buf, nil)), 20*time.Millisecond)
+	dh := Wrap(fake, ld.Interceptor(), b.Interceptor())
+
+	if err := dh.Acquire(context.Background(), newFakeHandle("main")); err != nil {
+		t.Fatal(err)
+	}
+	if err := dh.Begin(); err != nil {
+		t.Fatal(err)
+	}
+	if err := dh.Release(); err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(*fake.calls, ","); got != "Begin@main,Rollback@main,Release@main" {
+		t.Errorf("calls %s", got)
+	}
+	if st := b.Stats()[DefaultLane]; st.InUse != 0 {
+		t.Errorf("permits held after release: %d", st.InUse)
+	}
+
+	// Acquired and never released
+	if err := dh.Acquire(context.Background(), newFakeHandle("main")); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(time.Second)
+	for ld.Leaks() == 0 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if ld.Leaks() != 1 {
+		t.Fatalf("leak not detected")
+	}
+	if out := buf.String(); !strings.Contains(out, "helper not released") || !strings.Contains(out, "TestRelease") {
+		t.Errorf("log %q", out)
+	}
+	dh.Release()
+}
+
+func TestStrictMode(t *testing.T) {
+	SetHelper("strict-fake", newFakeHelper())
+	SetStrictMode(true)
+	t.Cleanup(func() { SetStrictMode(false) })
+	dh, err := New(nil, "strict-fake")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	check := func(what string, got, want error) {
+		t.Helper()
+		if !errors.Is(got, want) {
+			t.Errorf("%s: got %v, want %v", what, got, want)
+		}
+	}
+	check("exec before acquire", func() error { _, err := dh.Exec("SELECT 1"); return err }(), ErrHandleNotSet)
+	if err := dh.Acquire(context.Background(), newFakeHandle("main")); err != nil {
+		t.Fatal(err)
+	}
+	check("commit without begin", dh.Commit(), ErrNoTx)
+	check("mark outside tx", dh.Mark("a"), ErrNoTx)
+
+	if err := dh.Begin(); err != nil {
+		t.Fatal(err)
+	}
+	check("begin twice", dh.Begin(), ErrHandleTxNotNil)
+	check("mark", dh.Mark("a"), nil)
+	check("mark b", dh.Mark("b"), nil)
+	check("mark again", dh.Mark("a"), ErrSavepointExists)
+	check("discard a", dh.Discard("a"), nil)
+	check("save discarded", dh.Save("b"), ErrUnknownSavepoint)
+	check("commit", dh.Commit(), nil)
+	check("deferred rollback", dh.Rollback(), ErrNoTx) // the fake has no deferred rollback support
+	check("second rollback", dh.Rollback(), ErrNoTx)
+
+	if err := dh.BeginManually(); err != nil {
+		t.Fatal(err)
+	}
+	check("rollback", dh.Rollback(), nil)
+	check("exec after rollback", func() error { _, err := dh.Exec("SELECT 1"); return err }(), nil)
+	check("commit after rollback", dh.Commit(), ErrTxRolledBack)
+	check("mark after rollback", dh.Mark("a"), ErrTxRolledBack)
+
+	// A failed commit ends the transaction
+	commitErr := errors.New("serialization failure")
+	failing := Strict(Wrap(newFakeHelper(), func(op *Operation, next Invoker) error {
+		if err := next(op); err != nil || op.Method != "Commit" {
+			return err
+		}
+		return commitErr
+	}))
+	if err := failing.Acquire(context.Background(), newFakeHandle("main")); err != nil {
+		t.Fatal(err)
+	}
+	if err := failing.Begin(); err != nil {
+		t.Fatal(err)
+	}
+	check("failed commit", failing.Commit(), commitErr)
+	check("mark after a failed commit", failing.Mark("a"), ErrNoTx)
+	check("begin after a failed commit", failing.Begin(), nil)
+
+	check("release", dh.Release(), nil)
+	check("ping after release", dh.Ping(), ErrHelperReleased)
+}
+
+func TestClassifyError(t *testing.T) {
+	for err, want := range map[error]ErrorClass{
+		nil:                                  ErrorClassNone,
+		fmt.Errorf("get: %w", sql.ErrNoRows): ErrorClassNoRows,
+		ErrUnknownSavepoint:                  ErrorClassUsage,
+		ErrSavepointExists:                   ErrorClassUsage,
+		ErrTxRolledBack:                      ErrorClassUsage,
+		ErrHelperReleased:                    ErrorClassUsage,
+		ErrNoTx:                              ErrorClassTx,
+		sql.ErrTxDone:                        ErrorClassTx,
+		ErrHandleNotSet:                      ErrorClassConnection,
+		errors.New("syntax error"):           ErrorClassOther,
+	} {
+		if got := ClassifyError(err); got != want {
+			t.Errorf("ClassifyError(%v) = %q, want %q", err, got, want)
+		}
+	}
+	if !errors.Is(ErrTxRolledBack, sql.ErrTxDone) {
+		t.Error("ErrTxRolledBack does not wrap sql.ErrTxDone")
+	}
+}
+
+func TestWrapState(t *testing.T) {
+	type key struct{}
+	set := func(v any) Interceptor {
+		return func(op *Operation, next Invoker) error {
+			op.SetValue(key{}, v)
+			return next(op)
+		}
+	}
+	inner := Wrap(newFakeHelper())
+	if err := inner.Begin(); err != nil {
+		t.Fatal(err)
+	}
+	outer := Wrap(inner, set("outer"))
+	var ran bool
+	if err := outer.(TxCallbacks).OnCommit(func() { ran = true }); err != nil {
+		t.Fatal(err)
+	}
+	outer.Exec(`UPDATE t SET a = 1`)
+	if v := inner.(*wrappedHelper).values[key{}]; v != nil {
+		t.Errorf("value set through the outer helper shows in the inner one: %v", v)
+	}
+	if err := inner.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if ran {
+		t.Error("callback registered through the outer helper ran on the commit of the inner one")
+	}
+
+	failing := Wrap(newFakeHelper(), func(op *Operation, next Invoker) error {
+		if err := next(op); err != nil || op.Method != "Commit" {
+			return err
+		}
+		return errors.New("connection reset")
+	})
+	if err := failing.Begin(); err != nil {
+		t.Fatal(err)
+	}
+	if err := failing.Commit(); err == nil {
+		t.Fatal("commit did not fail")
+	}
+	if in, err := InTx(failing); err != nil || in {
+		t.Errorf("InTx after a failed commit: %v, %v", in, err)
+	}
+}
+
+func TestTxCallbacks(t *testing.T) {
+	dh := Wrap(newFakeHelper())
+	if err := dh.Acquire(context.Background(), newFakeHandle("main")); err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	if err := OnCommit(dh, func() {}); !errors.Is(err, ErrNoTx) {
+		t.Errorf("got %v, want ErrNoTx", err)
+	}
+	if err := OnCommit(newFakeHelper(), func() {}); !errors.Is(err, ErrTxCallbacksUnsupported) {
+		t.Errorf("got %v, want ErrTxCallbacksUnsupported", err)
+	}
+	if in, err := InTx(dh); in || err != nil {
+		t.Errorf("InTx before Begin: %v, %v", in, err)
+	}
+	if _, err := InTx(newFakeHelper()); !errors.Is(err, ErrTxStateUnsupported) {
+		t.Errorf("got %v, want ErrTxStateUnsupported", err)
+	}
+
+	dh.Begin()
+	if in, _ := InTx(dh); !in {
+		t.Error("InTx after Begin: false")
+	}
+	OnCommit(dh, func() { got = append(got, "first") })
+	dh.Mark("a")
+	OnCommit(dh, func() { got = append(got, "discarded") })
+	dh.Discard("a")
+	dh.Mark("b")
+	OnCommit(dh, func() { got = append(got, "saved") })
+	dh.Save("b")
+	OnCommit(dh, func() { got = append(got, "last") })
+	OnRollback(dh, func(error) { got = append(got, "rolled back") })
+	if len(got) != 0 {
+		t.Fatalf("callbacks ran before commit: %q", got)
+	}
+	if err := dh.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if want := "first,saved,last"; strings.Join(got, ",") != want {
+		t.Errorf("got %q, want %s", got, want)
+	}
+
+	got = nil
+	dh.Begin()
+	OnCommit(dh, func() { got = append(got, "committed") })
+	OnRollback(dh, func(err error) { got = append(got, fmt.Sprint("rolled back ", err)) })
+	dh.Rollback()
+	dh.Rollback()
+	if want := "rolled back <nil>"; strings.Join(got, ",") != want {
+		t.Errorf("got %q, want %s", got, want)
+	}
+}
+
+func TestExponentialBackoff(t *testing.T) {
+	b := ExponentialBackoff(time.Second, 5*time.Second)
+	for attempts, want := range map[int]time.Duration{1: time.Second, 2: 2 * time.Second, 3: 4 * time.Second, 4: 5 * time.Second} {
+		if got := b(attempts); got != want {
+			t.Errorf("attempt %d: got %v, want %v", attempts, got, want)
+		}
+	}
+}
@@ -0,0 +1,93 @@
+package datahelperlite
+
+import (
+	"strings"
+
+	dn "github.com/eaglebush/datainfo"
+)
+
+// Dialect is the SQL dialect of a database
+type Dialect string
+
+// Dialects
+const (
+	DialectGeneric   Dialect = `generic`
+	DialectPostgres  Dialect = `postgres`
+	DialectSQLServer Dialect = `sqlserver`
+	DialectMySQL     Dialect = `mysql`
+	DialectSQLite    Dialect = `sqlite`
+)
+
+// DialectOf returns the dialect of a database info by its driver name.
+// It returns DialectGeneric when the driver is not known.
+func DialectOf(di *dn.DataInfo) Dialect {
+	if di == nil || di.DriverName == nil {
+		return DialectGeneric
+	}
+	return DialectOfDriver(*di.DriverName)
+}
+
+// DialectOfDriver returns the dialect of a database/sql driver name
+func DialectOfDriver(driver string) Dialect {
+	switch strings.ToLower(driver) {
+	case "postgres", "pgx", "pq", "pgx/v5", "cloudsqlpostgres":
+		return DialectPostgres
+	case "sqlserver", "mssql", "azuresql":
+		return DialectSQLServer
+	case "mysql", "mariadb":
+		return DialectMySQL
+	case "sqlite", "sqlite3":
+		return DialectSQLite
+	}
+	return DialectGeneric
+}
+
+// QuoteIdent quotes an identifier part for the dialect, escaping the closing quote inside it
+func (d Dialect) QuoteIdent(name string) string {
+	switch d {
+	case DialectSQLServer:
+		return `[` + strings.ReplaceAll(name, `]`, `]]`) + `]`
+	case DialectMySQL:
+		return "`" + strings.ReplaceAll(name, "`", "``") + "`"
+	default:
+		return `"` + strings.ReplaceAll(name, `"`, `""`) + `"`
+	}
+}
+
+// reservedWords are words commonly reserved across dialects that need quoting when used as identifiers
+var reservedWords = map[string]bool{
+	"all": true, "and": true, "any": true, "as": true, "asc": true, "between": true, "by": true,
+	"case": true, "check": true, "column": true, "constraint": true, "create": true, "cross": true,
+	"current": true, "default": true, "delete": true, "desc": true, "distinct": true, "drop": true,
+	"else": true, "end": true, "except": true, "exists": true, "fetch": true, "for": true,
+	"foreign": true, "from": true, "full": true, "grant": true, "group": true, "having": true,
+	"in": true, "index": true, "inner": true, "insert": true, "intersect": true, "into": true,
+	"is": true, "join": true, "key": true, "left": true, "like": true, "limit": true, "not": true,
+	"null": true, "offset": true, "on": true, "or": true, "order": true, "outer": true,
+	"primary": true, "references": true, "right": true, "rows": true, "select": true, "session": true,
+	"set": true, "table": true, "then": true, "to": true, "top": true, "union": true, "unique": true,
+	"update": true, "user": true, "using": true, "values": true, "view": true, "when": true,
+	"where": true, "with": true,
+}
+
+// needsQuote reports if an identifier part must be quoted to be used as is
+func needsQuote(name string) bool {
+	if name == "" || reservedWords[strings.ToLower(name)] {
+		return true
+	}
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		switch {
+		case c == '_', c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z':
+		case c >= '0' && c <= '9' && i > 0:
+		default:
+			return true
+		}
+	}
+	return false
+}
+
+// isQuotedIdent reports if an identifier part is already quoted
+func isQuotedIdent(name string) bool {
+	return unquoteIdent(name) != name
+}
@@ -0,0 +1,71 @@
+package datahelperlite
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"net"
+)
+
+// ErrorClass is a coarse classification of errors returned by helpers
+type ErrorClass string
+
+// Error classes
+const (
+	ErrorClassNone       ErrorClass = ``           // No error
+	ErrorClassNoRows     ErrorClass = `no_rows`    // No rows were returned
+	ErrorClassTimeout    ErrorClass = `timeout`    // A deadline was exceeded
+	ErrorClassCanceled   ErrorClass = `canceled`   // The context was canceled
+	ErrorClassConnection ErrorClass = `connection` // The connection is bad or the handle is not set
+	ErrorClassTx         ErrorClass = `tx`         // Transaction misuse or a finished transaction
+	ErrorClassUsage      ErrorClass = `usage`      // Misuse caught before reaching the database, such as by StrictMode
+	ErrorClassRejected   ErrorClass = `rejected`   // Rejected before reaching the database, such as by an open circuit breaker
+	ErrorClassOther      ErrorClass = `other`      // Everything else, usually errors from the database
+)
+
+// ClassifyError returns the class of an error
+func ClassifyError(err error) ErrorClass {
+	if err == nil {
+		return ErrorClassNone
+	}
+	if errors.Is(err, sql.ErrNoRows) || (ErrNoRows != nil && errors.Is(err, ErrNoRows)) {
+		return ErrorClassNoRows
+	}
+	if errors.Is(err, ErrCircuitOpen) {
+		return ErrorClassRejected
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return ErrorClassTimeout
+	}
+	if errors.Is(err, context.Canceled) {
+		return ErrorClassCanceled
+	}
+	if errors.Is(err, driver.ErrBadConn) ||
+		errors.Is(err, sql.ErrConnDone) ||
+		errors.Is(err, ErrHandleNotSet) ||
+		errors.Is(err, ErrHandleDBNotSet) ||
+		errors.Is(err, ErrHandleNoConn) ||
+		errors.Is(err, ErrHandleNoHandle) {
+		return ErrorClassConnection
+	}
+	var nerr net.Error
+	if errors.As(err, &nerr) {
+		if nerr.Timeout() {
+			return ErrorClassTimeout
+		}
+		return ErrorClassConnection
+	}
+	if errors.Is(err, ErrUnknownSavepoint) ||
+		errors.Is(err, ErrSavepointExists) ||
+		errors.Is(err, ErrTxRolledBack) ||
+		errors.Is(err, ErrHelperReleased) {
+		return ErrorClassUsage
+	}
+	if errors.Is(err, sql.ErrTxDone) ||
+		errors.Is(err, ErrNoTx) ||
+		errors.Is(err, ErrHandleTxNotNil) {
+		return ErrorClassTx
+	}
+	return ErrorClassOther
+}
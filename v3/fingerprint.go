@@ -0,0 +1,107 @@
+package datahelperlite
+
+import (
+	"strings"
+)
+
+// Fingerprint returns the shape of a statement for grouping in metrics and logs.
+//
+// Literals and placeholders become ?, IN lists collapse to IN (?+), comments are dropped,
+// keywords and bare identifiers are lower-cased and whitespace is normalized.
+// Statements that differ only in their values have the same fingerprint.
+func Fingerprint(sql string) string {
+	fp, _ := fingerprint(sql)
+	return fp
+}
+
+// fingerprint returns the fingerprint of a statement and the literals it removed
+func fingerprint(sql string) (string, []string) {
+	toks := lexSQL(sql)
+	var literals []string
+
+	// Keep only meaningful tokens, with values reduced to ?
+	sig := make([]token, 0, len(toks))
+	for _, t := range toks {
+		switch t.kind {
+		case tokSpace, tokComment:
+			continue
+		case tokString, tokNumber, tokPlaceholder:
+			lit := t.text
+			// A sign directly in front of a number is part of the literal
+			if t.kind == tokNumber && len(sig) > 1 && sig[len(sig)-1].text == "-" && !isValueToken(sig[len(sig)-2]) {
+				sig = sig[:len(sig)-1]
+				lit = "-" + lit
+			}
+			if t.kind != tokPlaceholder {
+				literals = append(literals, lit)
+			}
+			sig = append(sig, token{kind: tokPlaceholder, text: "?"})
+		case tokWord:
+			sig = append(sig, token{kind: tokWord, text: strings.ToLower(t.text)})
+		default:
+			sig = append(sig, t)
+		}
+	}
+
+	var sb strings.Builder
+	sb.Grow(len(sql))
+	var prev *token
+	for i := 0; i < len(sig); i++ {
+		t := sig[i]
+		if prev != nil && spaceBetween(*prev, t) {
+			sb.WriteByte(' ')
+		}
+		// Collapse IN (?, ?, ...) into IN (?+)
+		if t.text == "(" && prev != nil && prev.kind == tokWord && prev.text == "in" {
+			if end, ok := valueList(sig, i); ok {
+				sb.WriteString("(?+)")
+				i = end
+				prev = &sig[end]
+				continue
+			}
+		}
+		sb.WriteString(t.text)
+		prev = &sig[i]
+	}
+	return strings.TrimRight(sb.String(), "; "), literals
+}
+
+// valueList reports if the parenthesis at start only encloses ? separated by commas, returning the index of the closing parenthesis
+func valueList(sig []token, start int) (int, bool) {
+	want := tokPlaceholder
+	for j := start + 1; j < len(sig); j++ {
+		t := sig[j]
+		switch {
+		case t.text == ")" && want == tokPunct:
+			return j, true
+		case want == tokPlaceholder && t.kind == tokPlaceholder:
+			want = tokPunct
+		case want == tokPunct && t.text == ",":
+			want = tokPlaceholder
+		default:
+			return 0, false
+		}
+	}
+	return 0, false
+}
+
+// spaceBetween decides the normalized spacing between two tokens
+func spaceBetween(prev, t token) bool {
+	switch prev.text {
+	case "(", ".":
+		return false
+	}
+	switch t.text {
+	case ")", ",", ".", ";":
+		return false
+	}
+	return true
+}
+
+func isValueToken(t token) bool {
+	switch t.kind {
+	case tokWord, tokQuotedIdent, tokPlaceholder, tokString, tokNumber:
+		return true
+	}
+	return t.text == ")"
+}
@@ -0,0 +1,414 @@
+package datahelperlite
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// Operation describes a helper operation passing through an interceptor chain.
+//
+// Interceptors may change the request fields (SQL, Args and Table) before calling next.
+// The result fields are set after next returns.
+type Operation struct {
+	Method  string           // Name of the DataHelperLite method, such as Exec or QueryRow
+	Context context.Context  // Context given to Acquire. It is context.Background before Acquire.
+	Handle  DataHelperHandle // Handle given to Acquire. Set only for Acquire and the operations after it.
+	TxID    string           // Identifier of the active transaction. Empty if there is none.
+
+	SQL     string         // Statement of Exec, Exists, Query, QueryArray and QueryRow
+	Args    []any          // Arguments of the statement or the values of UpsertReturning
+	Table   string         // Table of ExistsExt and UpsertReturning
+	Columns []string       // Insert columns of UpsertReturning
+	Filters []ColumnFilter // Column filters of ExistsExt
+	Name    string         // Savepoint name of Mark, Save and Discard, or the serial of Next
+	Out     any            // Destination of QueryArray
+
+	CacheTTL  time.Duration // Time to keep the result in a result cache. Set by helpers returned by Cached.
+	CacheTags []string      // Tags of the cached result. Set by helpers returned by Cached.
+
+	RowsAffected int64 // Rows affected by Exec
+	Exists       bool  // Result of Exists and ExistsExt
+	Rows         Rows  // Result of Query
+	Row          Row   // Result of QueryRow and UpsertReturning
+	Err          error // Error of the operation
+
+	values map[any]any    // state of the wrapped helper shared by its operations
+	helper DataHelperLite // wrapped helper
+}
+
+// Helper returns the wrapped helper running the operation.
+//
+// Interceptors may use it to run statements of their own, such as session settings. Such statements
+// do not pass through the interceptor chain.
+func (op *Operation) Helper() DataHelperLite {
+	return op.helper
+}
+
+// Value returns a value stored by an interceptor in the state of the helper running the operation
+func (op *Operation) Value(key any) any {
+	return op.values[key]
+}
+
+// SetValue stores a value in the state of the helper running the operation.
+//
+// The state lasts as long as the helper. It is not shared with helpers created by NewHelper.
+func (op *Operation) SetValue(key, val any) {
+	if op.values == nil {
+		return
+	}
+	if val == nil {
+		delete(op.values, key)
+		return
+	}
+	op.values[key] = val
+}
+
+// Invoker runs the rest of the interceptor chain and the helper operation
+type Invoker func(op *Operation) error
+
+// Interceptor intercepts a helper operation. It must call next to continue the operation.
+type Interceptor func(op *Operation, next Invoker) error
+
+// wrappedHelper passes helper operations through an interceptor chain
+type wrappedHelper struct {
+	dh           DataHelperLite
+	interceptors []Interceptor
+	ctx          context.Context
+	handle       DataHelperHandle
+	txID         string
+	values       map[any]any
+	scopes       []txScope // callbacks of the transaction by savepoint, see OnCommit
+}
+
+var txSeq atomic.Uint64
+
+// Wrap wraps a helper with interceptors. The first interceptor is the outermost.
+//
+// Helpers created by NewHelper of the returned helper keep the same chain.
+func Wrap(dh DataHelperLite, interceptors ...Interceptor) DataHelperLite {
+	if dh == nil {
+		return nil
+	}
+	ics := make([]Interceptor, 0, len(interceptors))
+	for _, ic := range interceptors {
+		if ic != nil {
+			ics = append(ics, ic)
+		}
+	}
+	if w, ok := dh.(*wrappedHelper); ok {
+		// Flatten so that the chain is built once
+		return w.clone(append(append([]Interceptor(nil), w.interceptors...), ics...))
+	}
+	return &wrappedHelper{
+		dh:           dh,
+		interceptors: ics,
+		ctx:          context.Background(),
+		values:       make(map[any]any),
+	}
+}
+
+// clone returns a helper with the state of w and another interceptor chain. The state is copied,
+// so that changes through one of the helpers do not show in the other.
+func (w *wrappedHelper) clone(interceptors []Interceptor) *wrappedHelper {
+	values := make(map[any]any, len(w.values))
+	for k, v := range w.values {
+		values[k] = v
+	}
+	var scopes []txScope
+	for _, sc := range w.scopes {
+		scopes = append(scopes, txScope{
+			savepoint:  sc.savepoint,
+			onCommit:   append([]func(){}, sc.onCommit...),
+			onRollback: append([]func(error){}, sc.onRollback...),
+		})
+	}
+	return &wrappedHelper{
+		dh:           w.dh,
+		interceptors: interceptors,
+		ctx:          w.ctx,
+		handle:       w.handle,
+		txID:         w.txID,
+		values:       values,
+		scopes:       scopes,
+	}
+}
+
+// invoke runs the operation through the chain, ending with the call to the helper
+func (w *wrappedHelper) invoke(op *Operation, call Invoker) error {
+	op.Context = w.ctx
+	if op.Handle == nil {
+		op.Handle = w.handle
+	}
+	op.TxID = w.txID
+	op.values = w.values
+	op.helper = w.dh
+	next := call
+	for i := len(w.interceptors) - 1; i >= 0; i-- {
+		ic, inner := w.interceptors[i], next
+		next = func(op *Operation) error {
+			return ic(op, inner)
+		}
+	}
+	op.Err = next(op)
+	return op.Err
+}
+
+// HandleOf returns the handle a helper returned by Wrap was acquired with. It returns nil for other helpers.
+func HandleOf(dh DataHelperLite) DataHelperHandle {
+	switch w := dh.(type) {
+	case *wrappedHelper:
+		return w.handle
+	case *cachedHelper:
+		return w.handle
+	}
+	return nil
+}
+
+func (w *wrappedHelper) NewHelper() DataHelperLite {
+	return &wrappedHelper{
+		dh:           w.dh.NewHelper(),
+		interceptors: w.interceptors,
+		ctx:          context.Background(),
+		values:       make(map[any]any),
+	}
+}
+
+func (w *wrappedHelper) Acquire(ctx context.Context, h DataHelperHandle) error {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	w.ctx = ctx
+	op := &Operation{Method: "Acquire", Handle: h}
+	err := w.invoke(op, func(op *Operation) error {
+		return w.dh.Acquire(op.Context, op.Handle)
+	})
+	if err == nil {
+		w.handle = op.Handle
+	}
+	return err
+}
+
+func (w *wrappedHelper) begin(method string, fn func() error) error {
+	id := strconv.FormatUint(txSeq.Add(1), 10)
+	op := &Operation{Method: method}
+	err := w.invoke(op, func(op *Operation) error {
+		// The transaction id is visible to interceptors once the transaction exists
+		if err := fn(); err != nil {
+			return err
+		}
+		op.TxID = id
+		return nil
+	})
+	if err == nil {
+		w.txID = id
+		w.scopes = []txScope{{}}
+	}
+	return err
+}
+
+func (w *wrappedHelper) Begin() error {
+	return w.begin("Begin", w.dh.Begin)
+}
+
+func (w *wrappedHelper) BeginManually() error {
+	return w.begin("BeginManually", w.dh.BeginManually)
+}
+
+func (w *wrappedHelper) Commit() error {
+	op := &Operation{Method: "Commit"}
+	err := w.invoke(op, func(op *Operation) error {
+		return w.dh.Commit()
+	})
+	// A failed commit ends the transaction too in database/sql
+	w.txID = ""
+	if err == nil {
+		w.endTx(true, nil)
+		return nil
+	}
+	w.endTx(false, err)
+	return err
+}
+
+func (w *wrappedHelper) Rollback() error {
+	op := &Operation{Method: "Rollback"}
+	err := w.invoke(op, func(op *Operation) error {
+		return w.dh.Rollback()
+	})
+	w.txID = ""
+	w.endTx(false, err)
+	return err
+}
+
+func (w *wrappedHelper) DatabaseVersion() string {
+	return w.dh.DatabaseVersion()
+}
+
+func (w *wrappedHelper) Discard(name string) error {
+	op := &Operation{Method: "Discard", Name: name}
+	err := w.invoke(op, func(op *Operation) error {
+		return w.dh.Discard(op.Name)
+	})
+	if err == nil {
+		w.endScope(name, false)
+	}
+	return err
+}
+
+func (w *wrappedHelper) Escape(fv string) string {
+	return w.dh.Escape(fv)
+}
+
+func (w *wrappedHelper) Exec(sql string, args ...any) (int64, error) {
+	op := &Operation{Method: "Exec", SQL: sql, Args: args}
+	err := w.invoke(op, func(op *Operation) error {
+		var err error
+		op.RowsAffected, err = w.dh.Exec(op.SQL, op.Args...)
+		return err
+	})
+	return op.RowsAffected, err
+}
+
+func (w *wrappedHelper) Exists(sqlWithParams string, args ...any) (bool, error) {
+	op := &Operation{Method: "Exists", SQL: sqlWithParams, Args: args}
+	err := w.invoke(op, func(op *Operation) error {
+		var err error
+		op.Exists, err = w.dh.Exists(op.SQL, op.Args...)
+		return err
+	})
+	return op.Exists, err
+}
+
+func (w *wrappedHelper) ExistsExt(tableName string, values []ColumnFilter) (bool, error) {
+	op := &Operation{Method: "ExistsExt", Table: tableName, Filters: values}
+	err := w.invoke(op, func(op *Operation) error {
+		var err error
+		op.Exists, err = w.dh.ExistsExt(op.Table, op.Filters)
+		return err
+	})
+	return op.Exists, err
+}
+
+func (w *wrappedHelper) Mark(name string) error {
+	op := &Operation{Method: "Mark", Name: name}
+	err := w.invoke(op, func(op *Operation) error {
+		return w.dh.Mark(op.Name)
+	})
+	if err == nil {
+		w.markScope(name)
+	}
+	return err
+}
+
+func (w *wrappedHelper) Next(serial string, next *int64) error {
+	op := &Operation{Method: "Next", Name: serial}
+	return w.invoke(op, func(op *Operation) error {
+		return w.dh.Next(op.Name, next)
+	})
+}
+
+func (w *wrappedHelper) Now() *time.Time {
+	return w.dh.Now()
+}
+
+func (w *wrappedHelper) NowUTC() *time.Time {
+	return w.dh.NowUTC()
+}
+
+func (w *wrappedHelper) Ping() error {
+	op := &Operation{Method: "Ping"}
+	return w.invoke(op, func(op *Operation) error {
+		return w.dh.Ping()
+	})
+}
+
+func (w *wrappedHelper) Query(sql string, args ...any) (Rows, error) {
+	op := &Operation{Method: "Query", SQL: sql, Args: args}
+	err := w.invoke(op, func(op *Operation) error {
+		var err error
+		op.Rows, err = w.dh.Query(op.SQL, op.Args...)
+		return err
+	})
+	return op.Rows, err
+}
+
+func (w *wrappedHelper) QueryArray(sql string, out any, args ...any) error {
+	op := &Operation{Method: "QueryArray", SQL: sql, Args: args, Out: out}
+	return w.invoke(op, func(op *Operation) error {
+		return w.dh.QueryArray(op.SQL, op.Out, op.Args...)
+	})
+}
+
+// QueryRow does not return an error. Interceptors see the error only if they wrap op.Row.
+func (w *wrappedHelper) QueryRow(sql string, args ...any) Row {
+	op := &Operation{Method: "QueryRow", SQL: sql, Args: args}
+	err := w.invoke(op, func(op *Operation) error {
+		op.Row = w.dh.QueryRow(op.SQL, op.Args...)
+		return nil
+	})
+	if err != nil {
+		return errRow{err: err}
+	}
+	return op.Row
+}
+
+// Release rolls back an open transaction through the chain, so that interceptors see it, before releasing the helper
+func (w *wrappedHelper) Release() error {
+	var err error
+	if w.txID != "" {
+		err = w.Rollback()
+	}
+	op := &Operation{Method: "Release"}
+	err = errors.Join(err, w.invoke(op, func(op *Operation) error {
+		return w.dh.Release()
+	}))
+	w.handle = nil
+	return err
+}
+
+func (w *wrappedHelper) Save(name string) error {
+	op := &Operation{Method: "Save", Name: name}
+	err := w.invoke(op, func(op *Operation) error {
+		return w.dh.Save(op.Name)
+	})
+	if err == nil {
+		w.endScope(name, true)
+	}
+	return err
+}
+
+func (w *wrappedHelper) UpsertReturning(
+	tableName string,
+	insertColumns []string,
+	uniqueColumns []string,
+	updateColumns []string,
+	returnColumns []string,
+	args ...any,
+) (Row, error) {
+	op := &Operation{Method: "UpsertReturning", Table: tableName, Columns: insertColumns, Args: args}
+	err := w.invoke(op, func(op *Operation) error {
+		var err error
+		op.Row, err = w.dh.UpsertReturning(op.Table, op.Columns, uniqueColumns, updateColumns, returnColumns, op.Args...)
+		return err
+	})
+	return op.Row, err
+}
+
+func (w *wrappedHelper) VendorStatement(key string) string {
+	return w.dh.VendorStatement(key)
+}
+
+func (w *wrappedHelper) VendorStatements() []string {
+	return w.dh.VendorStatements()
+}
+
+// errRow is a row that fails on Scan, returned when an interceptor rejects a QueryRow
+type errRow struct {
+	err error
+}
+
+func (r errRow) Scan(dest ...any) error {
+	return r.err
+}
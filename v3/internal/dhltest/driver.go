@@ -0,0 +1,179 @@
+package dhltest
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"io"
+	"sync/atomic"
+)
+
+// DB is a database whose statements are answered by functions, for code that runs on a *sql.DB or a
+// *sql.Conn of a handle rather than through a helper.
+//
+// Statements whose function is not set succeed with no rows. The connections of a pool share the
+// functions and the log of calls, and are numbered in the Conn of the calls they make. The
+// functions may be called concurrently.
+type DB struct {
+	OnExec  func(sql string, args ...any) (int64, error)             // Answers ExecContext. The default affects one row.
+	OnQuery func(sql string, args ...any) ([]string, [][]any, error) // Answers QueryContext with columns and rows. The default returns no rows.
+
+	log   callLog
+	conns atomic.Int32
+}
+
+// Open returns a connection pool on the database
+func (d *DB) Open() *sql.DB {
+	return sql.OpenDB(connector{d})
+}
+
+// Calls returns the calls made on the connections of the database, in order.
+// Their methods are Exec, Query, Begin, Commit and Rollback.
+func (d *DB) Calls() []Call {
+	d.log.mu.Lock()
+	defer d.log.mu.Unlock()
+	return append([]Call(nil), d.log.calls...)
+}
+
+// Log returns the calls as strings, leaving out those whose method is in skip
+func (d *DB) Log(skip ...string) []string {
+	var out []string
+	for _, c := range d.Calls() {
+		if !contains(skip, c.Method) {
+			out = append(out, c.String())
+		}
+	}
+	return out
+}
+
+func (d *DB) record(conn int, method, sql string, args []driver.NamedValue) {
+	d.log.mu.Lock()
+	d.log.calls = append(d.log.calls, Call{Method: method, SQL: sql, Args: values(args), Conn: conn})
+	d.log.mu.Unlock()
+}
+
+type connector struct{ db *DB }
+
+func (c connector) Connect(context.Context) (driver.Conn, error) {
+	return &conn{db: c.db, id: int(c.db.conns.Add(1))}, nil
+}
+
+func (c connector) Driver() driver.Driver { return dbDriver{} }
+
+type dbDriver struct{}
+
+func (dbDriver) Open(string) (driver.Conn, error) { return nil, driver.ErrSkip }
+
+// conn is a connection of a DB
+type conn struct {
+	db *DB
+	id int
+}
+
+func (c *conn) Prepare(query string) (driver.Stmt, error) {
+	return &stmt{c: c, query: query}, nil
+}
+
+func (c *conn) Close() error { return nil }
+
+func (c *conn) Begin() (driver.Tx, error) {
+	return c.BeginTx(context.Background(), driver.TxOptions{})
+}
+
+func (c *conn) BeginTx(context.Context, driver.TxOptions) (driver.Tx, error) {
+	c.db.record(c.id, "Begin", "", nil)
+	return tx{c}, nil
+}
+
+func (c *conn) ExecContext(_ context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	c.db.record(c.id, "Exec", query, args)
+	if c.db.OnExec == nil {
+		return driver.RowsAffected(1), nil
+	}
+	n, err := c.db.OnExec(query, values(args)...)
+	if err != nil {
+		return nil, err
+	}
+	return driver.RowsAffected(n), nil
+}
+
+func (c *conn) QueryContext(_ context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	c.db.record(c.id, "Query", query, args)
+	if c.db.OnQuery == nil {
+		return &driverRows{}, nil
+	}
+	cols, vals, err := c.db.OnQuery(query, values(args)...)
+	if err != nil {
+		return nil, err
+	}
+	return &driverRows{cols: cols, vals: vals}, nil
+}
+
+// CheckNamedValue passes arguments to the functions as they are given
+func (c *conn) CheckNamedValue(*driver.NamedValue) error { return nil }
+
+func values(args []driver.NamedValue) []any {
+	out := make([]any, len(args))
+	for i, a := range args {
+		out[i] = a.Value
+	}
+	return out
+}
+
+type tx struct{ c *conn }
+
+func (t tx) Commit() error {
+	t.c.db.record(t.c.id, "Commit", "", nil)
+	return nil
+}
+
+func (t tx) Rollback() error {
+	t.c.db.record(t.c.id, "Rollback", "", nil)
+	return nil
+}
+
+// stmt is a prepared statement, run as its connection runs statements
+type stmt struct {
+	c     *conn
+	query string
+}
+
+func (s *stmt) Close() error  { return nil }
+func (s *stmt) NumInput() int { return -1 }
+
+func (s *stmt) Exec(args []driver.Value) (driver.Result, error) {
+	return s.c.ExecContext(context.Background(), s.query, named(args))
+}
+
+func (s *stmt) Query(args []driver.Value) (driver.Rows, error) {
+	return s.c.QueryContext(context.Background(), s.query, named(args))
+}
+
+func named(args []driver.Value) []driver.NamedValue {
+	out := make([]driver.NamedValue, len(args))
+	for i, a := range args {
+		out[i] = driver.NamedValue{Ordinal: i + 1, Value: a}
+	}
+	return out
+}
+
+// driverRows is the result set of a query
+type driverRows struct {
+	cols []string
+	vals [][]any
+	i    int
+}
+
+func (r *driverRows) Columns() []string { return r.cols }
+func (r *driverRows) Close() error      { return nil }
+
+func (r *driverRows) Next(dest []driver.Value) error {
+	if r.i >= len(r.vals) {
+		return io.EOF
+	}
+	for i, v := range r.vals[r.i] {
+		dest[i] = v
+	}
+	r.i++
+	return nil
+}
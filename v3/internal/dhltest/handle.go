@@ -0,0 +1,53 @@
+package dhltest
+
+import (
+	"database/sql"
+
+	dn "github.com/eaglebush/datainfo"
+)
+
+// Handle is a DataHelperHandle over a database that may be nil
+type Handle struct {
+	Database *sql.DB      // Returned by DB
+	Info     *dn.DataInfo // Set by Open, returned by DI
+	Closed   bool         // Set by Close
+}
+
+func (h *Handle) Open(di *dn.DataInfo) error {
+	h.Info = di
+	return nil
+}
+
+func (h *Handle) Ping() error {
+	if h.Database == nil {
+		return nil
+	}
+	return h.Database.Ping()
+}
+
+func (h *Handle) DB() *sql.DB {
+	return h.Database
+}
+
+func (h *Handle) DI() *dn.DataInfo {
+	return h.Info
+}
+
+func (h *Handle) Close() error {
+	h.Closed = true
+	if h.Database == nil {
+		return nil
+	}
+	return h.Database.Close()
+}
+
+func (h *Handle) Err() error {
+	return nil
+}
+
+func (h *Handle) Stats() sql.DBStats {
+	if h.Database == nil {
+		return sql.DBStats{}
+	}
+	return h.Database.Stats()
+}
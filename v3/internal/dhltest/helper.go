@@ -0,0 +1,371 @@
+// Package dhltest provides test doubles for the subpackages of datahelperlite: a scripted helper,
+// and a handle over a scripted database/sql driver.
+package dhltest
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	dhl "github.com/NarsilWorks-Inc/datahelperlite/v3"
+)
+
+// Call is a call made to a Helper or a DB
+type Call struct {
+	Method string // Name of the method
+	SQL    string // Statement, table or savepoint name
+	Args   []any  // Arguments of the statement
+	Conn   int    // Connection of a DB the call was made on, from 1
+}
+
+// String returns the method and statement of the call
+func (c Call) String() string {
+	if c.SQL == "" {
+		return c.Method
+	}
+	return c.Method + " " + c.SQL
+}
+
+// Helper is a DataHelperLite whose statements are answered by functions.
+//
+// Every method is implemented. Statements whose function is not set succeed with no rows, so that
+// tests only script what they look at. Helpers created with NewHelper share the functions and the
+// log of calls, each with a transaction state of its own. The functions may be called concurrently.
+type Helper struct {
+	OnExec     func(sql string, args ...any) (int64, error)                                                                          // Answers Exec. The default affects one row.
+	OnExists   func(sql string, args ...any) (bool, error)                                                                           // Answers Exists. The default finds nothing.
+	OnQuery    func(sql string, args ...any) (dhl.Rows, error)                                                                       // Answers Query. The default returns no rows.
+	OnQueryRow func(sql string, args ...any) dhl.Row                                                                                 // Answers QueryRow. The default has no row.
+	OnUpsert   func(table string, insertColumns, uniqueColumns, updateColumns, returnColumns []string, args ...any) (dhl.Row, error) // Answers UpsertReturning
+	Version    string                                                                                                                // Returned by DatabaseVersion
+	Vendor     map[string]string                                                                                                     // Vendor statements by key
+
+	log *callLog
+	tx  bool
+}
+
+type callLog struct {
+	mu    sync.Mutex
+	calls []Call
+}
+
+var initMu sync.Mutex
+
+func (h *Helper) calls() *callLog {
+	initMu.Lock()
+	defer initMu.Unlock()
+	if h.log == nil {
+		h.log = &callLog{}
+	}
+	return h.log
+}
+
+func (h *Helper) record(method, sql string, args ...any) {
+	l := h.calls()
+	l.mu.Lock()
+	l.calls = append(l.calls, Call{Method: method, SQL: sql, Args: args})
+	l.mu.Unlock()
+}
+
+// Calls returns the calls made to the helper and the helpers created from it, in order
+func (h *Helper) Calls() []Call {
+	l := h.calls()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([]Call(nil), l.calls...)
+}
+
+// Log returns the calls as strings, leaving out those whose method is in skip
+func (h *Helper) Log(skip ...string) []string {
+	var out []string
+	for _, c := range h.Calls() {
+		if !contains(skip, c.Method) {
+			out = append(out, c.String())
+		}
+	}
+	return out
+}
+
+// InTx reports if the helper has an open transaction
+func (h *Helper) InTx() bool {
+	return h.tx
+}
+
+func (h *Helper) NewHelper() dhl.DataHelperLite {
+	c := *h
+	c.log, c.tx = h.calls(), false
+	return &c
+}
+
+// Acquire records the context in the arguments of the call
+func (h *Helper) Acquire(ctx context.Context, _ dhl.DataHelperHandle) error {
+	h.record("Acquire", "", ctx)
+	return nil
+}
+
+func (h *Helper) Begin() error {
+	h.record("Begin", "")
+	h.tx = true
+	return nil
+}
+
+func (h *Helper) BeginManually() error {
+	return h.Begin()
+}
+
+func (h *Helper) Commit() error {
+	if !h.tx {
+		return dhl.ErrNoTx
+	}
+	h.record("Commit", "")
+	h.tx = false
+	return nil
+}
+
+func (h *Helper) Rollback() error {
+	if !h.tx {
+		return nil
+	}
+	h.record("Rollback", "")
+	h.tx = false
+	return nil
+}
+
+func (h *Helper) Release() error {
+	_ = h.Rollback()
+	h.record("Release", "")
+	return nil
+}
+
+func (h *Helper) DatabaseVersion() string {
+	return h.Version
+}
+
+func (h *Helper) Mark(name string) error {
+	h.record("Mark", name)
+	return nil
+}
+
+func (h *Helper) Save(name string) error {
+	h.record("Save", name)
+	return nil
+}
+
+func (h *Helper) Discard(name string) error {
+	h.record("Discard", name)
+	return nil
+}
+
+func (h *Helper) Escape(fv string) string {
+	return strings.ReplaceAll(fv, `'`, `''`)
+}
+
+func (h *Helper) Exec(sql string, args ...any) (int64, error) {
+	h.record("Exec", sql, args...)
+	if h.OnExec == nil {
+		return 1, nil
+	}
+	return h.OnExec(sql, args...)
+}
+
+func (h *Helper) Exists(sql string, args ...any) (bool, error) {
+	h.record("Exists", sql, args...)
+	if h.OnExists == nil {
+		return false, nil
+	}
+	return h.OnExists(sql, args...)
+}
+
+func (h *Helper) ExistsExt(tableName string, values []dhl.ColumnFilter) (bool, error) {
+	h.record("ExistsExt", tableName)
+	return false, nil
+}
+
+func (h *Helper) Next(serial string, next *int64) error {
+	if next == nil {
+		return dhl.ErrVarMustBeInit
+	}
+	h.record("Next", serial)
+	*next++
+	return nil
+}
+
+func (h *Helper) Now() *time.Time {
+	now := time.Now()
+	return &now
+}
+
+func (h *Helper) NowUTC() *time.Time {
+	now := time.Now().UTC()
+	return &now
+}
+
+func (h *Helper) Ping() error {
+	return nil
+}
+
+func (h *Helper) Query(sql string, args ...any) (dhl.Rows, error) {
+	h.record("Query", sql, args...)
+	if h.OnQuery == nil {
+		return NewRows(nil), nil
+	}
+	return h.OnQuery(sql, args...)
+}
+
+func (h *Helper) QueryArray(sql string, out any, args ...any) error {
+	h.record("QueryArray", sql, args...)
+	return nil
+}
+
+func (h *Helper) QueryRow(sql string, args ...any) dhl.Row {
+	h.record("QueryRow", sql, args...)
+	if h.OnQueryRow == nil {
+		return NoRow()
+	}
+	return h.OnQueryRow(sql, args...)
+}
+
+func (h *Helper) UpsertReturning(tableName string, insertColumns, uniqueColumns, updateColumns, returnColumns []string, args ...any) (dhl.Row, error) {
+	h.record("UpsertReturning", tableName, args...)
+	if h.OnUpsert == nil {
+		return NoRow(), nil
+	}
+	return h.OnUpsert(tableName, insertColumns, uniqueColumns, updateColumns, returnColumns, args...)
+}
+
+func (h *Helper) VendorStatement(key string) string {
+	return h.Vendor[key]
+}
+
+func (h *Helper) VendorStatements() []string {
+	keys := make([]string, 0, len(h.Vendor))
+	for k := range h.Vendor {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// row is a single result row
+type row struct {
+	vals []any
+	err  error
+}
+
+// NewRow returns a row holding values, which Scan assigns to its destinations in order
+func NewRow(vals ...any) dhl.Row {
+	return row{vals: vals}
+}
+
+// NoRow returns a row whose Scan fails with sql.ErrNoRows
+func NoRow() dhl.Row {
+	return row{err: sql.ErrNoRows}
+}
+
+// ErrRow returns a row whose Scan fails with err
+func ErrRow(err error) dhl.Row {
+	return row{err: err}
+}
+
+func (r row) Scan(dest ...any) error {
+	if r.err != nil {
+		return r.err
+	}
+	return scan(r.vals, dest)
+}
+
+// rows is a result set
+type rows struct {
+	cols []string
+	vals [][]any
+	i    int
+}
+
+// NewRows returns a result set with columns and rows of values
+func NewRows(cols []string, vals ...[]any) dhl.Rows {
+	return &rows{cols: cols, vals: vals, i: -1}
+}
+
+func (r *rows) Close() error { return nil }
+func (r *rows) Err() error   { return nil }
+func (r *rows) Next() bool   { r.i++; return r.i < len(r.vals) }
+
+func (r *rows) Columns() ([]dhl.Column, error) {
+	out := make([]dhl.Column, len(r.cols))
+	for i, c := range r.cols {
+		out[i] = column(c)
+	}
+	return out, nil
+}
+
+func (r *rows) RawValues() [][]byte {
+	out := make([][]byte, len(r.vals[r.i]))
+	for i, v := range r.vals[r.i] {
+		if v != nil {
+			out[i] = []byte(fmt.Sprint(v))
+		}
+	}
+	return out
+}
+
+func (r *rows) Scan(dest ...any) error {
+	return scan(r.vals[r.i], dest)
+}
+
+func (r *rows) Values() ([]any, error) {
+	return append([]any(nil), r.vals[r.i]...), nil
+}
+
+type column string
+
+func (c column) Name() string             { return string(c) }
+func (c column) DatabaseTypeName() string { return "" }
+func (c column) ScanType() reflect.Type   { return nil }
+
+// scan assigns values to destinations, converting them as database/sql would for the common types
+func scan(vals, dest []any) error {
+	if len(dest) > len(vals) {
+		return fmt.Errorf("dhltest: %d destinations for %d values", len(dest), len(vals))
+	}
+	for i, d := range dest {
+		if s, ok := d.(sql.Scanner); ok {
+			if err := s.Scan(vals[i]); err != nil {
+				return err
+			}
+			continue
+		}
+		dv := reflect.ValueOf(d)
+		if dv.Kind() != reflect.Pointer || dv.IsNil() {
+			return fmt.Errorf("dhltest: destination %d is not a pointer", i)
+		}
+		dv = dv.Elem()
+		if vals[i] == nil {
+			dv.SetZero()
+			continue
+		}
+		v := reflect.ValueOf(vals[i])
+		switch {
+		case v.Type().AssignableTo(dv.Type()):
+			dv.Set(v)
+		case v.Type().ConvertibleTo(dv.Type()):
+			dv.Set(v.Convert(dv.Type()))
+		default:
+			return fmt.Errorf("dhltest: cannot scan %T into %s", vals[i], dv.Type())
+		}
+	}
+	return nil
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
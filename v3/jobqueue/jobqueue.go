@@ -0,0 +1,164 @@
+// Package jobqueue implements a background job queue on DataHelperLite.
+//
+// Jobs are rows of a jobs table. Workers claim them with SKIP LOCKED, or READPAST on SQL Server,
+// under a lease: a job whose worker does not finish it before the lease expires is claimed again.
+// Failed jobs are retried with a backoff until they run out of attempts.
+package jobqueue
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	dhl "github.com/NarsilWorks-Inc/datahelperlite/v3"
+)
+
+// Table is the logical name of the jobs table. Statements write it as a {table} placeholder.
+var Table = `jobs`
+
+// Job statuses
+const (
+	StatusPending = `pending`
+	StatusRunning = `running`
+	StatusFailed  = `failed`
+)
+
+// Errors
+var (
+	ErrEmptyQueue error = errors.New(`job queue name is empty`)
+)
+
+// Job is a job of the queue
+type Job struct {
+	ID          int64  // Identifier of the job
+	Queue       string // Queue of the job
+	Payload     []byte // Arguments of the job
+	Priority    int    // Jobs of higher priority are claimed first
+	Attempts    int    // Attempts so far, the current one included
+	MaxAttempts int    // Attempts before the job fails for good
+	UniqueKey   string // Key that prevents duplicate jobs
+}
+
+type enqueueConfig struct {
+	delay       time.Duration
+	priority    int
+	maxAttempts int
+	uniqueKey   string
+}
+
+// EnqueueOption is an option of Enqueue
+type EnqueueOption func(*enqueueConfig)
+
+// WithDelay makes the job wait before it can be claimed
+func WithDelay(d time.Duration) EnqueueOption {
+	return func(c *enqueueConfig) { c.delay = d }
+}
+
+// WithPriority sets the priority of the job. The default is 0.
+func WithPriority(p int) EnqueueOption {
+	return func(c *enqueueConfig) { c.priority = p }
+}
+
+// WithMaxAttempts sets the attempts before the job fails for good. The default is 25.
+func WithMaxAttempts(n int) EnqueueOption {
+	return func(c *enqueueConfig) { c.maxAttempts = n }
+}
+
+// WithUniqueKey makes Enqueue return the job already queued with the key instead of adding another one
+func WithUniqueKey(key string) EnqueueOption {
+	return func(c *enqueueConfig) { c.uniqueKey = key }
+}
+
+// Enqueue adds a job to a queue and returns its id.
+//
+// Inside a transaction, the job can only be claimed once the transaction commits, which also
+// wakes the worker pools of the process. A job with the unique key of a job still in the table,
+// whether pending, running or failed, is not added; the id of that job is returned.
+func Enqueue(dh dhl.DataHelperLite, queue string, payload []byte, opts ...EnqueueOption) (int64, error) {
+	if queue == "" {
+		return 0, ErrEmptyQueue
+	}
+	cfg := enqueueConfig{maxAttempts: 25}
+	for _, o := range opts {
+		o(&cfg)
+	}
+	if cfg.uniqueKey == "" {
+		// Every job has a key so that the insert is always an upsert
+		var b [16]byte
+		if _, err := rand.Read(b[:]); err != nil {
+			return 0, err
+		}
+		cfg.uniqueKey = hex.EncodeToString(b[:])
+	}
+	inTx := true
+	switch err := dhl.OnCommit(dh, wakePools); {
+	case errors.Is(err, dhl.ErrNoTx), errors.Is(err, dhl.ErrTxCallbacksUnsupported):
+		// Waking the workers too early only costs them a poll
+		inTx = false
+	case err != nil:
+		return 0, err
+	}
+
+	now := time.Now().UTC()
+	row, err := dh.UpsertReturning(
+		Table,
+		[]string{"queue", "payload", "priority", "attempts", "max_attempts", "status", "run_at", "unique_key", "created_at"},
+		[]string{"unique_key"},
+		nil,
+		[]string{"id"},
+		queue, payload, cfg.priority, 0, cfg.maxAttempts, StatusPending, now.Add(cfg.delay), cfg.uniqueKey, now,
+	)
+	if err != nil {
+		return 0, err
+	}
+	var id int64
+	if err := row.Scan(&id); err != nil {
+		return 0, err
+	}
+	if !inTx {
+		wakePools()
+	}
+	return id, nil
+}
+
+// DDL returns the statements that create the jobs table for a dialect
+func DDL(d dhl.Dialect) []string {
+	id, blob, ts, text, key := `BIGINT GENERATED ALWAYS AS IDENTITY PRIMARY KEY`, `BYTEA`, `TIMESTAMP`, `TEXT`, `VARCHAR(255)`
+	switch d {
+	case dhl.DialectSQLServer:
+		id, blob, ts, text, key = `BIGINT IDENTITY(1,1) PRIMARY KEY`, `VARBINARY(MAX)`, `DATETIME2`, `NVARCHAR(MAX)`, `NVARCHAR(255)`
+	case dhl.DialectMySQL:
+		id, blob, ts = `BIGINT AUTO_INCREMENT PRIMARY KEY`, `LONGBLOB`, `DATETIME(6)`
+	case dhl.DialectSQLite:
+		id, blob = `INTEGER PRIMARY KEY AUTOINCREMENT`, `BLOB`
+	}
+	table := `{` + Table + `}`
+	return []string{
+		fmt.Sprintf(`CREATE TABLE %s (id %s, queue VARCHAR(100) NOT NULL, payload %s, priority INT NOT NULL, `+
+			`attempts INT NOT NULL, max_attempts INT NOT NULL, status VARCHAR(20) NOT NULL, run_at %s NOT NULL, `+
+			`locked_by VARCHAR(100) NULL, locked_until %s NULL, last_error %s NULL, unique_key %s NOT NULL, created_at %s NOT NULL)`,
+			table, id, blob, ts, ts, text, key, ts),
+		fmt.Sprintf(`CREATE UNIQUE INDEX jobs_unique_key ON %s (unique_key)`, table),
+		fmt.Sprintf(`CREATE INDEX jobs_claim ON %s (queue, status, priority, run_at)`, table),
+	}
+}
+
+var (
+	poolsMu sync.Mutex
+	pools   = make(map[chan struct{}]struct{})
+)
+
+// wakePools makes the waiting workers poll now
+func wakePools() {
+	poolsMu.Lock()
+	defer poolsMu.Unlock()
+	for ch := range pools {
+		select {
+		case ch <- struct{}{}:
+		default:
+		}
+	}
+}
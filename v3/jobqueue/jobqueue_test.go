@@ -0,0 +1,183 @@
+package jobqueue
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+	"testing"
+	"time"
+
+	dhl "github.com/NarsilWorks-Inc/datahelperlite/v3"
+	"github.com/NarsilWorks-Inc/datahelperlite/v3/internal/dhltest"
+)
+
+// queueHelper serves job to the claim query while it is not nil
+func queueHelper(job **Job) *dhltest.Helper {
+	return &dhltest.Helper{
+		OnQueryRow: func(string, ...any) dhl.Row {
+			j := *job
+			if j == nil {
+				return dhltest.NoRow()
+			}
+			return dhltest.NewRow(j.ID, j.Queue, j.Payload, j.Priority, j.Attempts, j.MaxAttempts, j.UniqueKey)
+		},
+		OnUpsert: func(string, []string, []string, []string, []string, ...any) (dhl.Row, error) {
+			return dhltest.NewRow(int64(7)), nil
+		},
+	}
+}
+
+// execs returns the first word and the first argument of the statements executed
+func execs(h *dhltest.Helper) string {
+	var out []string
+	for _, c := range h.Calls() {
+		if c.Method == "Exec" {
+			out = append(out, fmt.Sprintf("%s %v", strings.Fields(c.SQL)[0], c.Args[0]))
+		}
+	}
+	return strings.Join(out, "|")
+}
+
+func TestEnqueue(t *testing.T) {
+	var job *Job
+	fake := queueHelper(&job)
+	id, err := Enqueue(fake, "mail", []byte("hi"), WithUniqueKey("welcome:42"), WithPriority(5))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id != 7 {
+		t.Errorf("got id %d", id)
+	}
+	upsert := fake.Calls()[0]
+	if got := fmt.Sprint(upsert.SQL, upsert.Args[:3]); got != "jobs[mail [104 105] 5]" {
+		t.Errorf("upsert %q", got)
+	}
+	if got := upsert.Args[7]; got != "welcome:42" {
+		t.Errorf("unique key %v", got)
+	}
+}
+
+func TestPool(t *testing.T) {
+	job := &Job{ID: 1, Queue: "mail", MaxAttempts: 2, Attempts: 1}
+	fake := queueHelper(&job)
+	p := NewPool(fake, nil, func(ctx context.Context, j Job) error {
+		if _, ok := ctx.Deadline(); !ok {
+			t.Error("job context has no lease deadline")
+		}
+		return errors.New("smtp down")
+	}, PoolOptions{
+		Queues:   []string{"mail", "sms"},
+		Dialect:  dhl.DialectSQLServer,
+		WorkerID: "w1",
+		Logger:   slog.New(slog.NewTextHandler(io.Discard, nil)),
+	})
+	if got := p.claimSQL(); !strings.Contains(got, "READPAST") || !strings.Contains(got, "queue IN (?, ?)") {
+		t.Errorf("claim %q", got)
+	}
+
+	j, ok, err := p.Claim(context.Background())
+	if err != nil || !ok {
+		t.Fatalf("claim: %v %v", ok, err)
+	}
+	if j.Attempts != 2 {
+		t.Errorf("attempts %d, want 2", j.Attempts)
+	}
+	p.run(context.Background(), j)
+	if got, want := execs(fake), "UPDATE running|UPDATE failed"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	job = nil
+	if _, ok, err := p.Claim(context.Background()); ok || err != nil {
+		t.Errorf("claim of an empty queue: %v %v", ok, err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := p.Run(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("run: %v", err)
+	}
+}
+
+// jobTable keeps one row of the jobs table in memory
+type jobTable struct {
+	job         Job
+	status      string
+	lockedBy    any
+	lockedUntil time.Time
+}
+
+func (t *jobTable) queryRow(sql string, args ...any) dhl.Row {
+	now := args[len(args)-1].(time.Time)
+	if t.status == StatusPending || (t.status == StatusRunning && !t.lockedUntil.After(now)) {
+		j := t.job
+		return dhltest.NewRow(j.ID, j.Queue, j.Payload, j.Priority, j.Attempts, j.MaxAttempts, j.UniqueKey)
+	}
+	return dhltest.NoRow()
+}
+
+func (t *jobTable) exec(sql string, args ...any) (int64, error) {
+	switch {
+	case strings.Contains(sql, "attempts = ?, locked_by"):
+		t.status, t.job.Attempts, t.lockedBy, t.lockedUntil = args[0].(string), args[1].(int), args[2], args[3].(time.Time)
+		return 1, nil
+	case strings.Contains(sql, "WHERE id = ? AND locked_by = ?"):
+		owner := args[len(args)-1]
+		if strings.HasSuffix(sql, "AND attempts = ?") {
+			if t.job.Attempts != owner {
+				return 0, nil
+			}
+			owner = args[len(args)-2]
+		}
+		if t.status == "" || t.lockedBy != owner {
+			return 0, nil
+		}
+		if strings.HasPrefix(sql, "DELETE") {
+			t.status = ""
+		} else {
+			t.status, t.lockedBy = args[0].(string), nil
+		}
+		return 1, nil
+	}
+	return 0, errors.New("unexpected statement: " + sql)
+}
+
+func TestExpiredLeaseClaimedAgain(t *testing.T) {
+	table := &jobTable{job: Job{ID: 1, Queue: "mail", MaxAttempts: 5}, status: StatusPending}
+	now := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	p := NewPool(&dhltest.Helper{OnQueryRow: table.queryRow, OnExec: table.exec}, nil, nil, PoolOptions{
+		Queues:   []string{"mail"},
+		Dialect:  dhl.DialectPostgres,
+		WorkerID: "w1",
+		Lease:    time.Minute,
+		Logger:   slog.New(slog.NewTextHandler(io.Discard, nil)),
+		Now:      func() time.Time { return now },
+	})
+
+	first, ok, err := p.Claim(context.Background())
+	if err != nil || !ok {
+		t.Fatalf("claim: %v %v", ok, err)
+	}
+	now = now.Add(2 * time.Minute)
+	second, ok, err := p.Claim(context.Background())
+	if err != nil || !ok {
+		t.Fatalf("claim after the lease expired: %v %v", ok, err)
+	}
+
+	// The first claim of the same worker finishes late, it must not settle the second
+	if err := p.finish(context.Background(), first, nil); err != nil {
+		t.Fatal(err)
+	}
+	if table.status != StatusRunning {
+		t.Fatalf("late finish of attempt %d settled attempt %d: status %q", first.Attempts, second.Attempts, table.status)
+	}
+	if err := p.finish(context.Background(), second, errors.New("smtp down")); err != nil {
+		t.Fatal(err)
+	}
+	if table.status != StatusPending || table.lockedBy != nil {
+		t.Errorf("status %q locked by %v after the failure of the current claim", table.status, table.lockedBy)
+	}
+}
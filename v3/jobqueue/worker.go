@@ -0,0 +1,269 @@
+package jobqueue
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+
+	dhl "github.com/NarsilWorks-Inc/datahelperlite/v3"
+)
+
+// Handler runs a job. Returning an error retries the job after a backoff.
+// The context ends when the lease of the job expires or the pool shuts down.
+type Handler func(ctx context.Context, j Job) error
+
+// PoolOptions configures a worker Pool
+type PoolOptions struct {
+	Queues          []string                         // Queues to work on. Required.
+	Workers         int                              // Jobs run at once. The default is 1.
+	PollInterval    time.Duration                    // Time between polls when the queues are empty. The default is one second.
+	Lease           time.Duration                    // Time a worker has to finish a job. The default is five minutes.
+	ShutdownTimeout time.Duration                    // Time running jobs get to finish after Run's context ends. The default is 30 seconds.
+	Backoff         func(attempts int) time.Duration // Delay before a retry. The default doubles from one second up to one hour.
+	Dialect         dhl.Dialect                      // Dialect of the locking clause. Derived from the handle when empty.
+	WorkerID        string                           // Identifier of the pool in locked_by. The default is random.
+	Logger          *slog.Logger                     // Logger of job and claim errors. The default is slog.Default.
+	Now             func() time.Time                 // Clock. The default is time.Now.
+}
+
+// Pool runs the jobs of queues with a number of workers
+type Pool struct {
+	dh      dhl.DataHelperLite
+	handle  dhl.DataHelperHandle
+	handler Handler
+	opts    PoolOptions
+}
+
+// NewPool creates a worker pool that works with helpers created from dh and acquired with a handle
+func NewPool(dh dhl.DataHelperLite, h dhl.DataHelperHandle, handler Handler, opts PoolOptions) *Pool {
+	if opts.Workers <= 0 {
+		opts.Workers = 1
+	}
+	if opts.PollInterval <= 0 {
+		opts.PollInterval = time.Second
+	}
+	if opts.Lease <= 0 {
+		opts.Lease = 5 * time.Minute
+	}
+	if opts.ShutdownTimeout <= 0 {
+		opts.ShutdownTimeout = 30 * time.Second
+	}
+	if opts.Backoff == nil {
+		opts.Backoff = dhl.ExponentialBackoff(time.Second, time.Hour)
+	}
+	if opts.Dialect == "" && h != nil {
+		opts.Dialect = dhl.DialectOf(h.DI())
+	}
+	if opts.WorkerID == "" {
+		var b [8]byte
+		_, _ = rand.Read(b[:])
+		opts.WorkerID = hex.EncodeToString(b[:])
+	}
+	if opts.Logger == nil {
+		opts.Logger = slog.Default()
+	}
+	if opts.Now == nil {
+		opts.Now = time.Now
+	}
+	return &Pool{dh: dh, handle: h, handler: handler, opts: opts}
+}
+
+// Run works on jobs until the context ends, then waits for the running jobs.
+//
+// Running jobs keep their context for up to ShutdownTimeout after the context of Run ends. Jobs that
+// do not finish by then are canceled and claimed again by another worker once their lease expires.
+func (p *Pool) Run(ctx context.Context) error {
+	if len(p.opts.Queues) == 0 {
+		return ErrEmptyQueue
+	}
+	wake := make(chan struct{}, 1)
+	poolsMu.Lock()
+	pools[wake] = struct{}{}
+	poolsMu.Unlock()
+	defer func() {
+		poolsMu.Lock()
+		delete(pools, wake)
+		poolsMu.Unlock()
+	}()
+
+	// Jobs outlive ctx by the shutdown timeout
+	jobCtx, cancelJobs := context.WithCancel(context.WithoutCancel(ctx))
+	defer cancelJobs()
+	stop := context.AfterFunc(ctx, func() {
+		time.AfterFunc(p.opts.ShutdownTimeout, cancelJobs)
+	})
+	defer stop()
+
+	var wg sync.WaitGroup
+	for range p.opts.Workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			p.work(ctx, jobCtx, wake)
+		}()
+	}
+	wg.Wait()
+	return ctx.Err()
+}
+
+// work claims and runs jobs until ctx ends
+func (p *Pool) work(ctx, jobCtx context.Context, wake chan struct{}) {
+	for ctx.Err() == nil {
+		job, ok, err := p.Claim(ctx)
+		if err != nil && ctx.Err() == nil {
+			p.opts.Logger.Error("job claim failed", slog.Any("error", err))
+		}
+		if ok {
+			p.run(jobCtx, job)
+			continue
+		}
+		select {
+		case <-ctx.Done():
+		case <-wake:
+		case <-time.After(p.opts.PollInterval):
+		}
+	}
+}
+
+// run runs a claimed job and records its outcome
+func (p *Pool) run(ctx context.Context, j Job) {
+	ctx, cancel := context.WithTimeout(ctx, p.opts.Lease)
+	defer cancel()
+	err := p.safeHandle(ctx, j)
+	if ferr := p.finish(ctx, j, err); ferr != nil {
+		p.opts.Logger.Error("job outcome not recorded",
+			slog.Int64("id", j.ID),
+			slog.String("queue", j.Queue),
+			slog.Any("error", ferr),
+		)
+	}
+}
+
+// safeHandle runs the handler, turning a panic into an error
+func (p *Pool) safeHandle(ctx context.Context, j Job) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("job panicked: %v", r)
+		}
+	}()
+	return p.handler(ctx, j)
+}
+
+// claimSQL returns the statement that locks the next due job of the queues
+func (p *Pool) claimSQL() string {
+	cols := `id, queue, payload, priority, attempts, max_attempts, unique_key`
+	where := `queue IN (?` + strings.Repeat(`, ?`, len(p.opts.Queues)-1) + `) AND ` +
+		`((status = '` + StatusPending + `' AND run_at <= ?) OR (status = '` + StatusRunning + `' AND locked_until <= ?))`
+	order := `ORDER BY priority DESC, run_at, id`
+	table := `{` + Table + `}`
+	switch p.opts.Dialect {
+	case dhl.DialectSQLServer:
+		return fmt.Sprintf(`SELECT TOP (1) %s FROM %s WITH (UPDLOCK, ROWLOCK, READPAST) WHERE %s %s`, cols, table, where, order)
+	case dhl.DialectSQLite:
+		// SQLite has a single writer, the transaction is the lock
+		return fmt.Sprintf(`SELECT %s FROM %s WHERE %s %s LIMIT 1`, cols, table, where, order)
+	}
+	return fmt.Sprintf(`SELECT %s FROM %s WHERE %s %s LIMIT 1 FOR UPDATE SKIP LOCKED`, cols, table, where, order)
+}
+
+// Claim takes the next due job of the queues under a lease, including jobs whose lease expired.
+// It reports false when there is none.
+func (p *Pool) Claim(ctx context.Context) (job Job, ok bool, err error) {
+	dh := p.dh.NewHelper()
+	if err := dh.Acquire(ctx, p.handle); err != nil {
+		return Job{}, false, err
+	}
+	defer func() {
+		err = errors.Join(err, dh.Release())
+	}()
+
+	for {
+		if err := dh.BeginManually(); err != nil {
+			return Job{}, false, err
+		}
+		now := p.opts.Now().UTC()
+		args := make([]any, 0, len(p.opts.Queues)+2)
+		for _, q := range p.opts.Queues {
+			args = append(args, q)
+		}
+		args = append(args, now, now)
+		var j Job
+		if err := dh.QueryRow(p.claimSQL(), args...).Scan(
+			&j.ID, &j.Queue, &j.Payload, &j.Priority, &j.Attempts, &j.MaxAttempts, &j.UniqueKey,
+		); err != nil {
+			_ = dh.Rollback()
+			if dhl.ClassifyError(err) == dhl.ErrorClassNoRows {
+				return Job{}, false, nil
+			}
+			return Job{}, false, err
+		}
+
+		if j.Attempts >= j.MaxAttempts {
+			// The lease of the last attempt expired
+			if _, err := dh.Exec(
+				`UPDATE {`+Table+`} SET status = ?, locked_by = NULL, locked_until = NULL, last_error = ? WHERE id = ?`,
+				StatusFailed, `lease expired`, j.ID,
+			); err != nil {
+				return Job{}, false, err
+			}
+			if err := dh.Commit(); err != nil {
+				return Job{}, false, err
+			}
+			continue
+		}
+
+		j.Attempts++
+		if _, err := dh.Exec(
+			`UPDATE {`+Table+`} SET status = ?, attempts = ?, locked_by = ?, locked_until = ? WHERE id = ?`,
+			StatusRunning, j.Attempts, p.opts.WorkerID, now.Add(p.opts.Lease), j.ID,
+		); err != nil {
+			return Job{}, false, err
+		}
+		if err := dh.Commit(); err != nil {
+			return Job{}, false, err
+		}
+		return j, true, nil
+	}
+}
+
+// finish deletes a done job, or schedules a retry of a failed one. Jobs claimed again are left alone:
+// the attempt count a claim writes tells it apart from the claims before it, whichever worker made them.
+func (p *Pool) finish(ctx context.Context, j Job, jerr error) (err error) {
+	dh := p.dh.NewHelper()
+	// The job context may be over, recording the outcome must not be
+	if err := dh.Acquire(context.WithoutCancel(ctx), p.handle); err != nil {
+		return err
+	}
+	defer func() {
+		err = errors.Join(err, dh.Release())
+	}()
+
+	if jerr == nil {
+		_, err = dh.Exec(`DELETE FROM {`+Table+`} WHERE id = ? AND locked_by = ? AND attempts = ?`, j.ID, p.opts.WorkerID, j.Attempts)
+		return err
+	}
+	p.opts.Logger.Warn("job failed",
+		slog.Int64("id", j.ID),
+		slog.String("queue", j.Queue),
+		slog.Int("attempts", j.Attempts),
+		slog.Any("error", jerr),
+	)
+	if j.Attempts >= j.MaxAttempts {
+		_, err = dh.Exec(
+			`UPDATE {`+Table+`} SET status = ?, locked_by = NULL, locked_until = NULL, last_error = ? WHERE id = ? AND locked_by = ? AND attempts = ?`,
+			StatusFailed, jerr.Error(), j.ID, p.opts.WorkerID, j.Attempts,
+		)
+		return err
+	}
+	_, err = dh.Exec(
+		`UPDATE {`+Table+`} SET status = ?, run_at = ?, locked_by = NULL, locked_until = NULL, last_error = ? WHERE id = ? AND locked_by = ? AND attempts = ?`,
+		StatusPending, p.opts.Now().UTC().Add(p.opts.Backoff(j.Attempts)), jerr.Error(), j.ID, p.opts.WorkerID, j.Attempts,
+	)
+	return err
+}
@@ -0,0 +1,186 @@
+// Package leader elects one active instance among the replicas of a service with a lease row in the database.
+//
+// The leader renews its lease on an interval. Other instances take the lease over only after it has
+// expired by more than the tolerated clock skew, and the leader gives up its leadership that much before
+// the lease expires by its own clock, so that two instances whose clocks differ by less than MaxSkew
+// are never leaders at the same time.
+package leader
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+
+	dhl "github.com/NarsilWorks-Inc/datahelperlite/v3"
+)
+
+// Options configures an Elector
+type Options struct {
+	ID            string           // Identity of the instance. The default is the host name with a random suffix.
+	LeaseDuration time.Duration    // Time a lease lasts after a renewal. The default is 15 seconds.
+	RenewInterval time.Duration    // Time between renewals. The default is a third of the lease, minus the skew.
+	MaxSkew       time.Duration    // Largest tolerated difference between the clocks of instances. The default is one second.
+	Now           func() time.Time // Clock. The default is time.Now.
+	Logger        *slog.Logger     // Logger of renewal errors. The default is slog.Default.
+}
+
+// Elector takes part in the election of a leader for a name
+type Elector struct {
+	name  string
+	opts  Options
+	store leaseStore
+
+	mu          sync.Mutex
+	leader      bool
+	leaderUntil time.Time // end of the leadership by the local clock
+	onElected   []func()
+	onRevoked   []func()
+
+	// transition is held across a change of leadership and its callbacks, so that callbacks run in the
+	// order of the changes. It is taken before mu.
+	transition sync.Mutex
+}
+
+// NewElector creates an elector for a name whose leases are kept in the database of a handle, through
+// helpers created from dh
+func NewElector(dh dhl.DataHelperLite, h dhl.DataHelperHandle, name string, opts Options) *Elector {
+	if opts.ID == "" {
+		host, _ := os.Hostname()
+		var b [4]byte
+		_, _ = rand.Read(b[:])
+		opts.ID = host + "-" + hex.EncodeToString(b[:])
+	}
+	if opts.LeaseDuration <= 0 {
+		opts.LeaseDuration = 15 * time.Second
+	}
+	if opts.MaxSkew <= 0 {
+		opts.MaxSkew = time.Second
+	}
+	if opts.MaxSkew >= opts.LeaseDuration/2 {
+		opts.MaxSkew = opts.LeaseDuration / 4
+	}
+	if valid := opts.LeaseDuration - opts.MaxSkew; opts.RenewInterval <= 0 || opts.RenewInterval >= valid {
+		opts.RenewInterval = valid / 3
+	}
+	if opts.Now == nil {
+		opts.Now = time.Now
+	}
+	if opts.Logger == nil {
+		opts.Logger = slog.Default()
+	}
+	return &Elector{name: name, opts: opts, store: &sqlStore{dh: dh, handle: h}}
+}
+
+// ID returns the identity of the instance
+func (e *Elector) ID() string {
+	return e.opts.ID
+}
+
+// IsLeader reports if the instance holds a lease that is still valid by its own clock
+func (e *Elector) IsLeader() bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.leader && e.opts.Now().Before(e.leaderUntil)
+}
+
+// OnElected registers a function to run when the instance becomes the leader.
+//
+// Elected and revoked callbacks run one at a time, in the order of the changes of leadership, and the
+// next change waits for them to return.
+func (e *Elector) OnElected(fn func()) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.onElected = append(e.onElected, fn)
+}
+
+// OnRevoked registers a function to run when the instance stops being the leader
+func (e *Elector) OnRevoked(fn func()) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.onRevoked = append(e.onRevoked, fn)
+}
+
+// Run takes part in the election until the context ends, then steps down and releases the lease
+func (e *Elector) Run(ctx context.Context) error {
+	t := time.NewTicker(e.opts.RenewInterval)
+	defer t.Stop()
+	for {
+		e.Tick(ctx)
+		select {
+		case <-ctx.Done():
+			e.stepDown()
+			if err := e.store.release(context.Background(), e.name, e.opts.ID); err != nil {
+				e.opts.Logger.Warn("leader lease not released", slog.String("name", e.name), slog.Any("error", err))
+			}
+			return ctx.Err()
+		case <-t.C:
+		}
+	}
+}
+
+// Tick takes or renews the lease once. Run calls it on every renewal interval.
+func (e *Elector) Tick(ctx context.Context) {
+	now := e.opts.Now()
+	ok, err := e.store.acquire(ctx, e.name, e.opts.ID, now, now.Add(e.opts.LeaseDuration), now.Add(-e.opts.MaxSkew))
+	if err != nil {
+		e.opts.Logger.Warn("leader lease not renewed", slog.String("name", e.name), slog.Any("error", err))
+		// Leadership lasts as long as the lease that was renewed last
+		e.mu.Lock()
+		lapsed := e.leader && !e.opts.Now().Before(e.leaderUntil)
+		e.mu.Unlock()
+		if lapsed {
+			e.stepDown()
+		}
+		return
+	}
+	if !ok {
+		e.stepDown()
+		return
+	}
+
+	e.transition.Lock()
+	defer e.transition.Unlock()
+	e.mu.Lock()
+	e.leaderUntil = now.Add(e.opts.LeaseDuration - e.opts.MaxSkew)
+	elected := !e.leader
+	e.leader = true
+	fns := e.onElected
+	e.mu.Unlock()
+	if elected {
+		for _, fn := range fns {
+			fn()
+		}
+	}
+}
+
+// stepDown gives up the leadership, running the revocation callbacks if the instance was the leader
+func (e *Elector) stepDown() {
+	e.transition.Lock()
+	defer e.transition.Unlock()
+	e.mu.Lock()
+	was := e.leader
+	e.leader = false
+	e.leaderUntil = time.Time{}
+	fns := e.onRevoked
+	e.mu.Unlock()
+	if !was {
+		return
+	}
+	for _, fn := range fns {
+		fn()
+	}
+}
+
+// ReconnectHook returns a hook for Reconnect (see datahelperlite.OnReconnectEvent) that steps down when the connection is lost.
+// The lease is taken again at a later tick once the connection is back.
+func (e *Elector) ReconnectHook() func(dhl.ReconnectEvent) {
+	return func(ev dhl.ReconnectEvent) {
+		if ev.Kind == dhl.ReconnectLost {
+			e.stepDown()
+		}
+	}
+}
@@ -0,0 +1,178 @@
+package leader
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	dhl "github.com/NarsilWorks-Inc/datahelperlite/v3"
+	"github.com/NarsilWorks-Inc/datahelperlite/v3/internal/dhltest"
+)
+
+// memStore keeps leases in memory with the semantics of the lease table
+type memStore struct {
+	mu     sync.Mutex
+	holder map[string]string
+	expiry map[string]time.Time
+}
+
+func newMemStore() *memStore {
+	return &memStore{holder: map[string]string{}, expiry: map[string]time.Time{}}
+}
+
+func (s *memStore) acquire(_ context.Context, name, id string, now, expires, staleBefore time.Time) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	h, ok := s.holder[name]
+	if ok && h != id && !s.expiry[name].Before(staleBefore) {
+		return false, nil
+	}
+	s.holder[name], s.expiry[name] = id, expires
+	return true, nil
+}
+
+func (s *memStore) release(_ context.Context, name, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.holder[name] == id {
+		s.expiry[name] = time.Time{}
+	}
+	return nil
+}
+
+// clock is a manual clock shared by instances, each seeing it with its own skew
+type clock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (c *clock) advance(d time.Duration) {
+	c.mu.Lock()
+	c.now = c.now.Add(d)
+	c.mu.Unlock()
+}
+
+func (c *clock) skewed(skew time.Duration) func() time.Time {
+	return func() time.Time {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		return c.now.Add(skew)
+	}
+}
+
+func newTestElector(store leaseStore, id string, now func() time.Time) *Elector {
+	e := NewElector(nil, nil, "scheduler", Options{
+		ID:            id,
+		LeaseDuration: 10 * time.Second,
+		MaxSkew:       time.Second,
+		Now:           now,
+		Logger:        slog.New(slog.NewTextHandler(io.Discard, nil)),
+	})
+	e.store = store
+	return e
+}
+
+func TestElectionWithClockSkew(t *testing.T) {
+	for _, skew := range []time.Duration{-900 * time.Millisecond, 0, 900 * time.Millisecond} {
+		store := newMemStore()
+		c := &clock{now: time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)}
+		a := newTestElector(store, "a", c.skewed(0))
+		b := newTestElector(store, "b", c.skewed(skew))
+
+		a.Tick(context.Background())
+		b.Tick(context.Background())
+		if !a.IsLeader() || b.IsLeader() {
+			t.Fatalf("skew %v: a should lead alone", skew)
+		}
+
+		// a renews for a while, b never takes over
+		for range 10 {
+			c.advance(a.opts.RenewInterval)
+			a.Tick(context.Background())
+			b.Tick(context.Background())
+			if !a.IsLeader() || b.IsLeader() {
+				t.Fatalf("skew %v: b took over a renewed lease", skew)
+			}
+		}
+
+		// a stops renewing, as if it were partitioned away; there is never more than one leader
+		for step := 0; !b.IsLeader(); step++ {
+			if step > 1000 {
+				t.Fatalf("skew %v: b never took over", skew)
+			}
+			c.advance(100 * time.Millisecond)
+			b.Tick(context.Background())
+			if a.IsLeader() && b.IsLeader() {
+				t.Fatalf("skew %v: two leaders at %v", skew, c.skewed(0)())
+			}
+		}
+	}
+}
+
+func TestCallbacksAndReconnect(t *testing.T) {
+	store := newMemStore()
+	c := &clock{now: time.Now()}
+	e := newTestElector(store, "a", c.skewed(0))
+	var events []string
+	e.OnElected(func() { events = append(events, "elected") })
+	e.OnRevoked(func() { events = append(events, "revoked") })
+
+	e.Tick(context.Background())
+	e.Tick(context.Background())
+	e.ReconnectHook()(dhl.ReconnectEvent{Kind: dhl.ReconnectLost})
+	if e.IsLeader() {
+		t.Error("still leader after the connection was lost")
+	}
+	e.Tick(context.Background())
+	if got, want := strings.Join(events, ","), "elected,revoked,elected"; got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	e.Run(ctx)
+	if e.IsLeader() || !store.expiry["scheduler"].IsZero() {
+		t.Error("lease was not released when Run ended")
+	}
+}
+
+func TestSQLStoreInsert(t *testing.T) {
+	for _, c := range []struct {
+		insertErr error
+		rowAfter  bool // the row exists after the insert failed
+		want      bool
+		wantErr   bool
+	}{
+		{nil, false, true, false},
+		{errors.New("duplicate key"), true, false, false},
+		{errors.New("permission denied"), false, false, true},
+	} {
+		exists := 0
+		dh := &dhltest.Helper{
+			OnExec: func(sql string, args ...any) (int64, error) {
+				if strings.HasPrefix(sql, "INSERT") {
+					return 0, c.insertErr
+				}
+				return 0, nil
+			},
+			OnExists: func(sql string, args ...any) (bool, error) {
+				exists++
+				return exists > 1 && c.rowAfter, nil
+			},
+		}
+		s := &sqlStore{dh: dh, handle: &dhltest.Handle{}}
+		now := time.Now()
+		ok, err := s.acquire(context.Background(), "scheduler", "a", now, now.Add(time.Minute), now)
+		if ok != c.want || (err != nil) != c.wantErr {
+			t.Errorf("insert error %v: got %v, %v", c.insertErr, ok, err)
+		}
+		if c.insertErr != nil && err != nil && !errors.Is(err, c.insertErr) {
+			t.Errorf("got %v, want the insert error", err)
+		}
+	}
+}
@@ -0,0 +1,90 @@
+package leader
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	dhl "github.com/NarsilWorks-Inc/datahelperlite/v3"
+)
+
+// Table is the logical name of the lease table. Statements write it as a {table} placeholder.
+var Table = `leader_leases`
+
+// DDL returns the statements that create the lease table for a dialect
+func DDL(d dhl.Dialect) []string {
+	ts := `TIMESTAMP`
+	switch d {
+	case dhl.DialectSQLServer:
+		ts = `DATETIME2`
+	case dhl.DialectMySQL:
+		ts = `DATETIME(6)`
+	}
+	return []string{
+		fmt.Sprintf(`CREATE TABLE {%s} (name VARCHAR(255) NOT NULL PRIMARY KEY, holder VARCHAR(255) NOT NULL, expires_at %s NOT NULL)`, Table, ts),
+	}
+}
+
+// leaseStore keeps the lease of each name
+type leaseStore interface {
+	// acquire takes or renews the lease of a name until expires. Leases of other holders can be
+	// taken once they expired before staleBefore.
+	acquire(ctx context.Context, name, id string, now, expires, staleBefore time.Time) (bool, error)
+	// release ends the lease of a name if the holder still has it
+	release(ctx context.Context, name, id string) error
+}
+
+// sqlStore keeps leases in the lease table of the database of a handle, through helpers created from dh
+type sqlStore struct {
+	dh     dhl.DataHelperLite
+	handle dhl.DataHelperHandle
+}
+
+// with runs fn with a helper acquired with the handle of the store
+func (s *sqlStore) with(ctx context.Context, fn func(dh dhl.DataHelperLite) error) (err error) {
+	dh := s.dh.NewHelper()
+	if err := dh.Acquire(ctx, s.handle); err != nil {
+		return err
+	}
+	defer func() {
+		err = errors.Join(err, dh.Release())
+	}()
+	return fn(dh)
+}
+
+func (s *sqlStore) acquire(ctx context.Context, name, id string, now, expires, staleBefore time.Time) (ok bool, err error) {
+	err = s.with(ctx, func(dh dhl.DataHelperLite) error {
+		n, err := dh.Exec(
+			`UPDATE {`+Table+`} SET holder = ?, expires_at = ? WHERE name = ? AND (holder = ? OR expires_at < ?)`,
+			id, expires.UTC(), name, id, staleBefore.UTC(),
+		)
+		if err != nil || n > 0 {
+			ok = err == nil
+			return err
+		}
+
+		// No lease yet, or another holder has it
+		held, err := dh.Exists(`SELECT 1 FROM {`+Table+`} WHERE name = ?`, name)
+		if err != nil || held {
+			return err
+		}
+		if _, err := dh.Exec(`INSERT INTO {`+Table+`} (name, holder, expires_at) VALUES (?, ?, ?)`, name, id, expires.UTC()); err != nil {
+			// Another instance may have inserted it first. Any other failure is an error.
+			if held, xerr := dh.Exists(`SELECT 1 FROM {`+Table+`} WHERE name = ?`, name); xerr != nil || !held {
+				return err
+			}
+			return nil
+		}
+		ok = true
+		return nil
+	})
+	return ok && err == nil, err
+}
+
+func (s *sqlStore) release(ctx context.Context, name, id string) error {
+	return s.with(ctx, func(dh dhl.DataHelperLite) error {
+		_, err := dh.Exec(`UPDATE {`+Table+`} SET expires_at = ? WHERE name = ? AND holder = ?`, time.Unix(0, 0).UTC(), name, id)
+		return err
+	})
+}
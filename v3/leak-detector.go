@@ -0,0 +1,65 @@
+package datahelperlite
+
+import (
+	"log/slog"
+	"runtime/debug"
+	"sync/atomic"
+	"time"
+)
+
+// LeakDetector finds helpers that are acquired but not released in time.
+//
+// It is meant for debugging, since it takes the stack of every Acquire.
+type LeakDetector struct {
+	logger  *slog.Logger
+	timeout time.Duration
+	leaks   atomic.Uint64
+}
+
+// NewLeakDetector creates a leak detector that logs a warning with the stack of Acquire for
+// helpers not released within timeout. A nil logger uses slog.Default.
+func NewLeakDetector(logger *slog.Logger, timeout time.Duration) *LeakDetector {
+	if logger == nil {
+		logger = slog.Default()
+	}
+	return &LeakDetector{logger: logger, timeout: timeout}
+}
+
+// Leaks returns the number of helpers found not released in time
+func (ld *LeakDetector) Leaks() uint64 {
+	return ld.leaks.Load()
+}
+
+type leakTimerKey struct{}
+
+// Interceptor returns an interceptor that watches helpers from Acquire to Release
+func (ld *LeakDetector) Interceptor() Interceptor {
+	return func(op *Operation, next Invoker) error {
+		switch op.Method {
+		case "Acquire", "Release":
+		default:
+			return next(op)
+		}
+		if t, ok := op.Value(leakTimerKey{}).(*time.Timer); ok {
+			t.Stop()
+			op.SetValue(leakTimerKey{}, nil)
+		}
+		err := next(op)
+		if op.Method == "Release" || err != nil {
+			return err
+		}
+
+		stack := string(debug.Stack())
+		handle := HandleName(op.Handle)
+		acquired := time.Now()
+		op.SetValue(leakTimerKey{}, time.AfterFunc(ld.timeout, func() {
+			ld.logger.Warn("helper not released",
+				slog.String("handle", handle),
+				slog.Duration("held", time.Since(acquired)),
+				slog.String("stack", stack),
+			)
+			ld.leaks.Add(1)
+		}))
+		return nil
+	}
+}
@@ -0,0 +1,103 @@
+package lock
+
+import (
+	"context"
+	"crypto/sha1"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/hex"
+	"sync"
+
+	dhl "github.com/NarsilWorks-Inc/datahelperlite/v3"
+)
+
+// sessionLocker takes session locks on a dedicated connection. Statements use the placeholders of the driver.
+type sessionLocker struct {
+	conn    *sql.Conn
+	dialect dhl.Dialect
+}
+
+func (l *sessionLocker) tryLock(ctx context.Context, name string) (bool, error) {
+	var ok bool
+	switch l.dialect {
+	case dhl.DialectPostgres:
+		err := l.conn.QueryRowContext(ctx, `SELECT pg_try_advisory_lock($1)`, key(name)).Scan(&ok)
+		return ok, err
+	case dhl.DialectSQLServer:
+		var rc int
+		err := l.conn.QueryRowContext(ctx,
+			`DECLARE @rc int; EXEC @rc = sp_getapplock @Resource = @p1, @LockMode = 'Exclusive', @LockOwner = 'Session', @LockTimeout = 0; SELECT @rc`,
+			name,
+		).Scan(&rc)
+		return rc >= 0, err
+	}
+	var rc sql.NullInt64
+	err := l.conn.QueryRowContext(ctx, `SELECT GET_LOCK(?, 0)`, mysqlName(name)).Scan(&rc)
+	return rc.Valid && rc.Int64 == 1, err
+}
+
+func (l *sessionLocker) unlocker(name string) func() error {
+	var once sync.Once
+	var err error
+	return func() error {
+		once.Do(func() {
+			// The lock must be released even if the context of Lock is over
+			ctx := context.Background()
+			switch l.dialect {
+			case dhl.DialectPostgres:
+				_, err = l.conn.ExecContext(ctx, `SELECT pg_advisory_unlock($1)`, key(name))
+			case dhl.DialectSQLServer:
+				_, err = l.conn.ExecContext(ctx, `EXEC sp_releaseapplock @Resource = @p1, @LockOwner = 'Session'`, name)
+			default:
+				_, err = l.conn.ExecContext(ctx, `SELECT RELEASE_LOCK(?)`, mysqlName(name))
+			}
+			if err != nil {
+				// Closing a session releases its locks, do not give it back to the pool
+				_ = l.conn.Raw(func(any) error { return driver.ErrBadConn })
+			}
+			if cerr := l.conn.Close(); err == nil {
+				err = cerr
+			}
+		})
+		return err
+	}
+}
+
+func (l *sessionLocker) close() {
+	_ = l.conn.Close()
+}
+
+// mysqlName shortens names longer than the 64 characters MySQL allows
+func mysqlName(name string) string {
+	if len(name) <= 64 {
+		return name
+	}
+	sum := sha1.Sum([]byte(name))
+	return hex.EncodeToString(sum[:])
+}
+
+// txLocker takes transaction locks in the active transaction of a helper
+type txLocker struct {
+	dh      dhl.DataHelperLite
+	dialect dhl.Dialect
+}
+
+func (l *txLocker) tryLock(ctx context.Context, name string) (bool, error) {
+	if l.dialect == dhl.DialectSQLServer {
+		var rc int
+		err := l.dh.QueryRow(
+			`DECLARE @rc int; EXEC @rc = sp_getapplock @Resource = ?, @LockMode = 'Exclusive', @LockOwner = 'Transaction', @LockTimeout = 0; SELECT @rc`,
+			name,
+		).Scan(&rc)
+		return rc >= 0, err
+	}
+	var ok bool
+	err := l.dh.QueryRow(`SELECT pg_try_advisory_xact_lock(?)`, key(name)).Scan(&ok)
+	return ok, err
+}
+
+func (l *txLocker) unlocker(string) func() error {
+	return func() error { return nil }
+}
+
+func (l *txLocker) close() {}
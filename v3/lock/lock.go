@@ -0,0 +1,149 @@
+// Package lock provides distributed locks on the database of a DataHelperLite.
+//
+// PostgreSQL uses advisory locks, SQL Server application locks and MySQL named locks.
+// Other databases, and transaction-scoped locks on MySQL, use rows of a lock table.
+package lock
+
+import (
+	"context"
+	"errors"
+	"hash/fnv"
+	"time"
+
+	dhl "github.com/NarsilWorks-Inc/datahelperlite/v3"
+)
+
+// Scope tells how long a lock is held
+type Scope int
+
+// Scopes
+const (
+	ScopeSession     Scope = iota // Held until Unlock, across transactions, on a dedicated connection
+	ScopeTransaction              // Held until the active transaction of the helper ends
+)
+
+// Errors
+var (
+	ErrNotAcquired error = errors.New(`lock is held by another owner`)
+	ErrEmptyName   error = errors.New(`lock name is empty`)
+	ErrNoDialect   error = errors.New(`lock dialect is unknown without a handle`)
+)
+
+// Options configures a lock
+type Options struct {
+	Scope   Scope                // Scope of the lock. The default is ScopeSession.
+	Timeout time.Duration        // Time to wait for the lock. Zero waits until the context ends, negative tries once.
+	Dialect dhl.Dialect          // Dialect of the database. Derived from the handle when empty; Lock fails with ErrNoDialect when there is none.
+	Handle  dhl.DataHelperHandle // Handle of session locks. The default is the handle the helper was acquired with (see datahelperlite.HandleOf).
+	Lease   time.Duration        // Time after which a session lock of the lock table can be taken over. The default is one hour.
+}
+
+// Lock acquires the named lock and returns the function that releases it.
+//
+// Session locks are taken on a connection of their own, kept until Unlock. Transaction locks are taken
+// in the active transaction of the helper and are released when it ends; their Unlock does nothing.
+// Lock fails with ErrNotAcquired when the lock is not acquired within the timeout.
+//
+// With the lock table, session locks must be taken outside of a transaction. Transaction locks on MySQL
+// are retried until the timeout; on other databases they wait for the row lock as long as the database
+// lets them, whatever the timeout.
+func Lock(ctx context.Context, dh dhl.DataHelperLite, name string, opts Options) (Unlock func() error, err error) {
+	if name == "" {
+		return nil, ErrEmptyName
+	}
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	h := opts.Handle
+	if h == nil {
+		h = dhl.HandleOf(dh)
+	}
+	if opts.Dialect == "" {
+		// Falling back to the lock table would not exclude the holders of database locks
+		if h == nil {
+			return nil, ErrNoDialect
+		}
+		opts.Dialect = dhl.DialectOf(h.DI())
+	}
+	if opts.Lease <= 0 {
+		opts.Lease = time.Hour
+	}
+
+	if opts.Scope == ScopeTransaction {
+		// A transaction lock outside of a transaction would be released at once
+		if in, err := dhl.InTx(dh); err == nil && !in {
+			return nil, dhl.ErrNoTx
+		}
+	}
+
+	var l locker
+	switch {
+	case opts.Scope == ScopeTransaction && opts.Dialect != dhl.DialectPostgres && opts.Dialect != dhl.DialectSQLServer:
+		l = &tableLocker{dh: dh, dialect: opts.Dialect, tx: true}
+	case opts.Scope == ScopeTransaction:
+		l = &txLocker{dh: dh, dialect: opts.Dialect}
+	case opts.Dialect == dhl.DialectPostgres, opts.Dialect == dhl.DialectSQLServer, opts.Dialect == dhl.DialectMySQL:
+		if h == nil || h.DB() == nil {
+			return nil, dhl.ErrHandleDBNotSet
+		}
+		conn, err := h.DB().Conn(ctx)
+		if err != nil {
+			return nil, err
+		}
+		l = &sessionLocker{conn: conn, dialect: opts.Dialect}
+	default:
+		l = &tableLocker{dh: dh, dialect: opts.Dialect, lease: opts.Lease}
+	}
+
+	if opts.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, opts.Timeout)
+		defer cancel()
+	}
+	// Poll with growing delays, the lock functions do not wait
+	delay := 10 * time.Millisecond
+	for {
+		ok, err := l.tryLock(ctx, name)
+		if err != nil {
+			l.close()
+			return nil, err
+		}
+		if ok {
+			return l.unlocker(name), nil
+		}
+		if opts.Timeout < 0 {
+			l.close()
+			return nil, ErrNotAcquired
+		}
+		select {
+		case <-ctx.Done():
+			l.close()
+			if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+				return nil, ErrNotAcquired
+			}
+			return nil, ctx.Err()
+		case <-time.After(delay):
+		}
+		delay = min(delay*2, time.Second)
+	}
+}
+
+// TryLock acquires the named lock if it is free, failing with ErrNotAcquired otherwise
+func TryLock(ctx context.Context, dh dhl.DataHelperLite, name string, opts Options) (Unlock func() error, err error) {
+	opts.Timeout = -1
+	return Lock(ctx, dh, name, opts)
+}
+
+// locker takes a lock without waiting
+type locker interface {
+	tryLock(ctx context.Context, name string) (bool, error)
+	unlocker(name string) func() error
+	close() // give back what the locker holds when the lock was not taken
+}
+
+// key returns the 64-bit key of a lock name for databases that lock integers
+func key(name string) int64 {
+	h := fnv.New64a()
+	h.Write([]byte(name))
+	return int64(h.Sum64())
+}
@@ -0,0 +1,215 @@
+package lock
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	dhl "github.com/NarsilWorks-Inc/datahelperlite/v3"
+	"github.com/NarsilWorks-Inc/datahelperlite/v3/internal/dhltest"
+)
+
+// tableHelper keeps the lock table in memory
+func tableHelper() *dhltest.Helper {
+	rows := map[string]string{} // owner by name
+	return &dhltest.Helper{
+		OnExec: func(sql string, args ...any) (int64, error) {
+			name := args[0].(string)
+			switch {
+			case strings.HasPrefix(sql, "INSERT"):
+				if _, ok := rows[name]; ok {
+					return 0, errors.New("duplicate key")
+				}
+				rows[name] = args[1].(string)
+			case strings.HasPrefix(sql, "DELETE") && strings.Contains(sql, "owner"):
+				if rows[name] == args[1] {
+					delete(rows, name)
+				}
+			}
+			return 1, nil
+		},
+		OnExists: func(sql string, args ...any) (bool, error) {
+			_, ok := rows[args[0].(string)]
+			return ok, nil
+		},
+	}
+}
+
+func TestTableLock(t *testing.T) {
+	dh := tableHelper()
+	opts := Options{Dialect: dhl.DialectSQLite}
+	unlock, err := TryLock(context.Background(), dh, "nightly", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := TryLock(context.Background(), dh, "nightly", opts); !errors.Is(err, ErrNotAcquired) {
+		t.Errorf("got %v, want ErrNotAcquired", err)
+	}
+	opts.Timeout = 30 * time.Millisecond
+	if _, err := Lock(context.Background(), dh, "nightly", opts); !errors.Is(err, ErrNotAcquired) {
+		t.Errorf("got %v, want ErrNotAcquired after the timeout", err)
+	}
+	if err := unlock(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := TryLock(context.Background(), dh, "nightly", opts); err != nil {
+		t.Errorf("lock not free after unlock: %v", err)
+	}
+}
+
+func TestTransactionLockNeedsTx(t *testing.T) {
+	dh := dhl.Wrap(tableHelper())
+	_, err := Lock(context.Background(), dh, "x", Options{Scope: ScopeTransaction, Dialect: dhl.DialectPostgres})
+	if !errors.Is(err, dhl.ErrNoTx) {
+		t.Errorf("got %v, want ErrNoTx", err)
+	}
+}
+
+func TestKeys(t *testing.T) {
+	if key("a") != key("a") || key("a") == key("b") {
+		t.Error("keys are not stable")
+	}
+	long := strings.Repeat("x", 100)
+	if got := mysqlName(long); len(got) > 64 || got != mysqlName(long) {
+		t.Errorf("mysql name %q", got)
+	}
+}
+
+func TestNoDialect(t *testing.T) {
+	if _, err := TryLock(context.Background(), tableHelper(), "x", Options{}); !errors.Is(err, ErrNoDialect) {
+		t.Errorf("got %v, want ErrNoDialect", err)
+	}
+}
+
+func TestSessionLock(t *testing.T) {
+	held := false
+	db := &dhltest.DB{
+		OnQuery: func(sql string, args ...any) ([]string, [][]any, error) {
+			free := !held
+			held = true
+			return []string{"ok"}, [][]any{{free}}, nil
+		},
+		OnExec: func(sql string, args ...any) (int64, error) {
+			held = false
+			return 1, nil
+		},
+	}
+	h := &dhltest.Handle{Database: db.Open()}
+	defer h.Close()
+	opts := Options{Dialect: dhl.DialectPostgres, Handle: h}
+
+	unlock, err := TryLock(context.Background(), tableHelper(), "nightly", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := TryLock(context.Background(), tableHelper(), "nightly", opts); !errors.Is(err, ErrNotAcquired) {
+		t.Errorf("got %v, want ErrNotAcquired", err)
+	}
+	if err := unlock(); err != nil {
+		t.Fatal(err)
+	}
+
+	calls := db.Calls()
+	if len(calls) != 3 || calls[0].SQL != `SELECT pg_try_advisory_lock($1)` || calls[0].Args[0] != key("nightly") {
+		t.Fatalf("calls %v", calls)
+	}
+	// The lock is released on the connection that holds it
+	if calls[2].SQL != `SELECT pg_advisory_unlock($1)` || calls[2].Conn != calls[0].Conn || calls[1].Conn == calls[0].Conn {
+		t.Errorf("locked on %d, tried on %d, unlocked on %d", calls[0].Conn, calls[1].Conn, calls[2].Conn)
+	}
+}
+
+func TestTransactionLock(t *testing.T) {
+	free := true
+	inner := &dhltest.Helper{
+		OnQueryRow: func(sql string, args ...any) dhl.Row {
+			ok := free
+			free = false
+			return dhltest.NewRow(ok)
+		},
+	}
+	dh := dhl.Wrap(inner)
+	if err := dh.Begin(); err != nil {
+		t.Fatal(err)
+	}
+	opts := Options{Scope: ScopeTransaction, Dialect: dhl.DialectPostgres}
+	unlock, err := TryLock(context.Background(), dh, "nightly", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := TryLock(context.Background(), dh, "nightly", opts); !errors.Is(err, ErrNotAcquired) {
+		t.Errorf("got %v, want ErrNotAcquired", err)
+	}
+	if err := unlock(); err != nil {
+		t.Fatal(err)
+	}
+	got := strings.Join(inner.Log(), "\n")
+	if want := "Begin\nQueryRow SELECT pg_try_advisory_xact_lock(?)\nQueryRow SELECT pg_try_advisory_xact_lock(?)"; got != want {
+		t.Errorf("got\n%s\nwant\n%s", got, want)
+	}
+	if err := dh.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := TryLock(context.Background(), dh, "nightly", opts); !errors.Is(err, dhl.ErrNoTx) {
+		t.Errorf("got %v, want ErrNoTx after the transaction", err)
+	}
+}
+
+func TestMySQLTransactionTableLock(t *testing.T) {
+	rows := map[string]bool{}
+	holders := map[string]string{} // transaction holding the row lock by name
+	tx := func(id string) dhl.DataHelperLite {
+		return dhl.Wrap(&dhltest.Helper{
+			OnExec: func(sql string, args ...any) (int64, error) {
+				name := args[0].(string)
+				switch {
+				case strings.HasPrefix(sql, "INSERT IGNORE"):
+					if rows[name] {
+						return 0, nil
+					}
+				case strings.HasPrefix(sql, "INSERT"):
+					if rows[name] {
+						return 0, errors.New("duplicate key")
+					}
+				case strings.HasPrefix(sql, "UPDATE"):
+					// MySQL counts changed rows only
+					return 0, nil
+				}
+				rows[name] = true
+				return 1, nil
+			},
+			OnExists: func(sql string, args ...any) (bool, error) {
+				name := args[0].(string)
+				if !strings.Contains(sql, "FOR UPDATE SKIP LOCKED") {
+					return rows[name], nil
+				}
+				if h, ok := holders[name]; !rows[name] || ok && h != id {
+					return false, nil
+				}
+				holders[name] = id
+				return true, nil
+			},
+		})
+	}
+	opts := Options{Scope: ScopeTransaction, Dialect: dhl.DialectMySQL}
+	a, b := tx("a"), tx("b")
+	for i := range 2 {
+		if err := a.Begin(); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := TryLock(context.Background(), a, "nightly", opts); err != nil {
+			t.Fatalf("lock %d: %v", i+1, err)
+		}
+		if err := b.Begin(); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := TryLock(context.Background(), b, "nightly", opts); !errors.Is(err, ErrNotAcquired) {
+			t.Errorf("lock %d held by another transaction: got %v, want ErrNotAcquired", i+1, err)
+		}
+		_ = a.Commit()
+		_ = b.Rollback()
+		delete(holders, "nightly")
+	}
+}
@@ -0,0 +1,116 @@
+package lock
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"sync"
+	"time"
+
+	dhl "github.com/NarsilWorks-Inc/datahelperlite/v3"
+)
+
+// Table is the logical name of the lock table. Statements write it as a {table} placeholder.
+var Table = `locks`
+
+// DDL returns the statements that create the lock table for a dialect
+func DDL(d dhl.Dialect) []string {
+	ts := `TIMESTAMP`
+	switch d {
+	case dhl.DialectSQLServer:
+		ts = `DATETIME2`
+	case dhl.DialectMySQL:
+		ts = `DATETIME(6)`
+	}
+	return []string{
+		fmt.Sprintf(`CREATE TABLE {%s} (name VARCHAR(255) NOT NULL PRIMARY KEY, owner VARCHAR(64) NULL, expires_at %s NULL)`, Table, ts),
+	}
+}
+
+// tableLocker takes locks as rows of the lock table.
+//
+// Session locks insert a row owned by the locker, which Unlock deletes. The row can be taken over
+// once its lease has expired, so that a crashed owner does not hold the lock forever.
+// Transaction locks insert the row of the name if it is missing and lock it in the active transaction,
+// which holds the row lock until the transaction ends. MySQL locks it with SELECT ... FOR UPDATE SKIP LOCKED,
+// so that a held lock is reported rather than waited for; other databases update it.
+type tableLocker struct {
+	dh      dhl.DataHelperLite
+	dialect dhl.Dialect
+	tx      bool
+	lease   time.Duration
+	owner   string
+}
+
+func (l *tableLocker) tryLock(ctx context.Context, name string) (bool, error) {
+	if l.tx {
+		if err := l.ensureRow(name); err != nil {
+			return false, err
+		}
+		if l.dialect == dhl.DialectMySQL {
+			// MySQL counts changed rows only, so an update of the row would not tell if it is there
+			return l.dh.Exists(`SELECT 1 FROM {`+Table+`} WHERE name = ? FOR UPDATE SKIP LOCKED`, name)
+		}
+		_, err := l.dh.Exec(`UPDATE {`+Table+`} SET owner = NULL WHERE name = ?`, name)
+		return err == nil, err
+	}
+
+	if l.owner == "" {
+		var b [16]byte
+		if _, err := rand.Read(b[:]); err != nil {
+			return false, err
+		}
+		l.owner = hex.EncodeToString(b[:])
+	}
+	now := time.Now().UTC()
+	if _, err := l.dh.Exec(`DELETE FROM {`+Table+`} WHERE name = ? AND expires_at < ?`, name, now); err != nil {
+		return false, err
+	}
+	if _, err := l.dh.Exec(
+		`INSERT INTO {`+Table+`} (name, owner, expires_at) VALUES (?, ?, ?)`,
+		name, l.owner, now.Add(l.lease),
+	); err != nil {
+		// A unique violation means another owner has it, anything else is an error
+		held, xerr := l.dh.Exists(`SELECT 1 FROM {`+Table+`} WHERE name = ?`, name)
+		if xerr != nil || !held {
+			return false, err
+		}
+		return false, nil
+	}
+	return true, nil
+}
+
+// ensureRow inserts the row of a name on its first use. The read does not lock, so that a held row is not
+// waited for; a concurrent first use waits on the unique key and then finds the row.
+func (l *tableLocker) ensureRow(name string) error {
+	found, err := l.dh.Exists(`SELECT 1 FROM {`+Table+`} WHERE name = ?`, name)
+	if err != nil || found {
+		return err
+	}
+	switch l.dialect {
+	case dhl.DialectMySQL:
+		_, err = l.dh.Exec(`INSERT IGNORE INTO {`+Table+`} (name) VALUES (?)`, name)
+	case dhl.DialectSQLite:
+		_, err = l.dh.Exec(`INSERT OR IGNORE INTO {`+Table+`} (name) VALUES (?)`, name)
+	default:
+		_, err = l.dh.Exec(`INSERT INTO {`+Table+`} (name) SELECT ? WHERE NOT EXISTS (SELECT 1 FROM {`+Table+`} WHERE name = ?)`, name, name)
+	}
+	return err
+}
+
+func (l *tableLocker) unlocker(name string) func() error {
+	if l.tx {
+		return func() error { return nil }
+	}
+	var once sync.Once
+	var err error
+	return func() error {
+		once.Do(func() {
+			_, err = l.dh.Exec(`DELETE FROM {`+Table+`} WHERE name = ? AND owner = ?`, name, l.owner)
+		})
+		return err
+	}
+}
+
+func (l *tableLocker) close() {}
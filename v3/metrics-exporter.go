@@ -0,0 +1,407 @@
+package datahelperlite
+
+import (
+	"bufio"
+	"database/sql"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultBuckets are the query duration histogram buckets in seconds
+var DefaultBuckets = []float64{.001, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// Metrics collects helper and handle metrics and serves them in the Prometheus text exposition format.
+//
+// Query metrics are fed by helpers wrapped by Instrument or by its Interceptor. Pool statistics are read
+// from the registered handles (see HandleStats) on every scrape.
+type Metrics struct {
+	mu          sync.Mutex
+	buckets     []float64
+	durations   map[[2]string]*histogram // by operation and fingerprint
+	errors      map[[2]string]uint64     // by operation and error class
+	commits     uint64                   // committed transactions
+	rollbacks   uint64                   // rolled back transactions
+	reconnects  map[string]*[2]uint64    // by handle name: attempts, successes
+	pools       func() map[string]sql.DBStats
+	fingerprint bool
+	bulkheads   map[string]*Bulkhead
+	stmtCaches  func() map[string]StmtCacheStats
+}
+
+type histogram struct {
+	counts []uint64 // per bucket, not cumulative
+	sum    float64
+	count  uint64
+}
+
+// MetricsOption configures Metrics
+type MetricsOption func(m *Metrics)
+
+// WithBuckets sets the query duration histogram buckets in seconds
+func WithBuckets(buckets []float64) MetricsOption {
+	return func(m *Metrics) {
+		b := append([]float64(nil), buckets...)
+		sort.Float64s(b)
+		m.buckets = b
+	}
+}
+
+// WithFingerprints labels query durations with the statement fingerprint (see Fingerprint).
+//
+// Each distinct statement shape becomes a series, so it should only be used with a bounded set of statements.
+func WithFingerprints() MetricsOption {
+	return func(m *Metrics) {
+		m.fingerprint = true
+	}
+}
+
+// NewMetrics creates a metrics collector
+func NewMetrics(opts ...MetricsOption) *Metrics {
+	m := &Metrics{
+		buckets:    DefaultBuckets,
+		durations:  make(map[[2]string]*histogram),
+		errors:     make(map[[2]string]uint64),
+		reconnects: make(map[string]*[2]uint64),
+		bulkheads:  make(map[string]*Bulkhead),
+		stmtCaches: StmtCacheStatsByHandle,
+		pools:      HandleStats,
+	}
+	for _, o := range opts {
+		if o == nil {
+			continue
+		}
+		o(m)
+	}
+	return m
+}
+
+// ObserveQuery records the duration and the error of an operation. Errors of the no_rows class are not counted as errors.
+func (m *Metrics) ObserveQuery(op string, d time.Duration, err error) {
+	m.ObserveStatement(op, "", d, err)
+}
+
+// ObserveStatement records the duration and the error of an operation with the fingerprint of its statement
+func (m *Metrics) ObserveStatement(op, fingerprint string, d time.Duration, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	key := [2]string{op, fingerprint}
+	h, ok := m.durations[key]
+	if !ok {
+		h = &histogram{counts: make([]uint64, len(m.buckets))}
+		m.durations[key] = h
+	}
+	secs := d.Seconds()
+	for i, ub := range m.buckets {
+		if secs <= ub {
+			h.counts[i]++
+			break
+		}
+	}
+	h.sum += secs
+	h.count++
+	// A query finding no rows is an answer, not a failure
+	if cls := ClassifyError(err); cls != ErrorClassNone && cls != ErrorClassNoRows {
+		m.errors[[2]string{op, string(cls)}]++
+	}
+}
+
+// ObserveTx records the outcome of a transaction
+func (m *Metrics) ObserveTx(committed bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if committed {
+		m.commits++
+		return
+	}
+	m.rollbacks++
+}
+
+// ReconnectHook returns a hook for Reconnect (see OnReconnectEvent) that counts attempts and successes of a named handle
+func (m *Metrics) ReconnectHook(handleName string) func(ReconnectEvent) {
+	return func(ev ReconnectEvent) {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		c, ok := m.reconnects[handleName]
+		if !ok {
+			c = new([2]uint64)
+			m.reconnects[handleName] = c
+		}
+		switch ev.Kind {
+		case ReconnectAttempt:
+			c[0]++
+		case ReconnectConnected:
+			c[1]++
+		}
+	}
+}
+
+// AddBulkhead exports the lane statistics of a bulkhead under a name
+func (m *Metrics) AddBulkhead(name string, b *Bulkhead) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.bulkheads[name] = b
+}
+
+// ServeHTTP writes the metrics in the Prometheus text exposition format
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	_ = m.Export(w)
+}
+
+// Export writes the metrics in the Prometheus text exposition format
+func (m *Metrics) Export(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+
+	m.mu.Lock()
+	m.writeQueries(bw)
+	m.writeTx(bw)
+	m.writeReconnects(bw)
+	bulkheads := make(map[string]*Bulkhead, len(m.bulkheads))
+	for n, b := range m.bulkheads {
+		bulkheads[n] = b
+	}
+	m.mu.Unlock()
+
+	m.writePools(bw)
+	m.writeStmtCaches(bw)
+	writeBulkheads(bw, bulkheads)
+	return bw.Flush()
+}
+
+func (m *Metrics) writeQueries(w io.Writer) {
+	const name = `datahelperlite_query_duration_seconds`
+	fmt.Fprintf(w, "# HELP %s Duration of helper operations.\n# TYPE %s histogram\n", name, name)
+	for _, key := range sortedPairs(m.durations) {
+		h := m.durations[key]
+		labels := "operation=" + quoteLabel(key[0])
+		if key[1] != "" {
+			labels += ",fingerprint=" + quoteLabel(key[1])
+		}
+		var cum uint64
+		for i, ub := range m.buckets {
+			cum += h.counts[i]
+			fmt.Fprintf(w, "%s_bucket{%s,le=%s} %d\n", name, labels, quoteLabel(formatFloat(ub)), cum)
+		}
+		fmt.Fprintf(w, "%s_bucket{%s,le=\"+Inf\"} %d\n", name, labels, h.count)
+		fmt.Fprintf(w, "%s_sum{%s} %s\n", name, labels, formatFloat(h.sum))
+		fmt.Fprintf(w, "%s_count{%s} %d\n", name, labels, h.count)
+	}
+
+	const ename = `datahelperlite_query_errors_total`
+	fmt.Fprintf(w, "# HELP %s Errors of helper operations by error class, leaving out no rows.\n# TYPE %s counter\n", ename, ename)
+	for _, k := range sortedPairs(m.errors) {
+		fmt.Fprintf(w, "%s{operation=%s,type=%s} %d\n", ename, quoteLabel(k[0]), quoteLabel(k[1]), m.errors[k])
+	}
+}
+
+func (m *Metrics) writeTx(w io.Writer) {
+	const name = `datahelperlite_transactions_total`
+	fmt.Fprintf(w, "# HELP %s Finished transactions by outcome.\n# TYPE %s counter\n", name, name)
+	fmt.Fprintf(w, "%s{outcome=\"commit\"} %d\n", name, m.commits)
+	fmt.Fprintf(w, "%s{outcome=\"rollback\"} %d\n", name, m.rollbacks)
+}
+
+func (m *Metrics) writeReconnects(w io.Writer) {
+	const aname, sname = `datahelperlite_reconnect_attempts_total`, `datahelperlite_reconnect_successes_total`
+	fmt.Fprintf(w, "# HELP %s Reconnection attempts by handle.\n# TYPE %s counter\n", aname, aname)
+	names := sortedKeys(m.reconnects)
+	for _, n := range names {
+		fmt.Fprintf(w, "%s{handle=%s} %d\n", aname, quoteLabel(n), m.reconnects[n][0])
+	}
+	fmt.Fprintf(w, "# HELP %s Successful reconnections by handle.\n# TYPE %s counter\n", sname, sname)
+	for _, n := range names {
+		fmt.Fprintf(w, "%s{handle=%s} %d\n", sname, quoteLabel(n), m.reconnects[n][1])
+	}
+}
+
+func (m *Metrics) writePools(w io.Writer) {
+	if m.pools == nil {
+		return
+	}
+	pools := m.pools()
+	names := sortedKeys(pools)
+
+	pool := []struct {
+		name, typ, help string
+		value           func(s sql.DBStats) string
+	}{
+		{`datahelperlite_pool_max_open_connections`, `gauge`, `Maximum number of open connections.`,
+			func(s sql.DBStats) string { return strconv.Itoa(s.MaxOpenConnections) }},
+		{`datahelperlite_pool_open_connections`, `gauge`, `Number of established connections.`,
+			func(s sql.DBStats) string { return strconv.Itoa(s.OpenConnections) }},
+		{`datahelperlite_pool_in_use_connections`, `gauge`, `Number of connections in use.`,
+			func(s sql.DBStats) string { return strconv.Itoa(s.InUse) }},
+		{`datahelperlite_pool_idle_connections`, `gauge`, `Number of idle connections.`,
+			func(s sql.DBStats) string { return strconv.Itoa(s.Idle) }},
+		{`datahelperlite_pool_wait_count_total`, `counter`, `Number of connections waited for.`,
+			func(s sql.DBStats) string { return strconv.FormatInt(s.WaitCount, 10) }},
+		{`datahelperlite_pool_wait_duration_seconds_total`, `counter`, `Time blocked waiting for a connection.`,
+			func(s sql.DBStats) string { return formatFloat(s.WaitDuration.Seconds()) }},
+		{`datahelperlite_pool_max_idle_closed_total`, `counter`, `Connections closed due to SetMaxIdleConns.`,
+			func(s sql.DBStats) string { return strconv.FormatInt(s.MaxIdleClosed, 10) }},
+		{`datahelperlite_pool_max_idle_time_closed_total`, `counter`, `Connections closed due to SetConnMaxIdleTime.`,
+			func(s sql.DBStats) string { return strconv.FormatInt(s.MaxIdleTimeClosed, 10) }},
+		{`datahelperlite_pool_max_lifetime_closed_total`, `counter`, `Connections closed due to SetConnMaxLifetime.`,
+			func(s sql.DBStats) string { return strconv.FormatInt(s.MaxLifetimeClosed, 10) }},
+	}
+	for _, p := range pool {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", p.name, p.help, p.name, p.typ)
+		for _, n := range names {
+			fmt.Fprintf(w, "%s{handle=%s} %s\n", p.name, quoteLabel(n), p.value(pools[n]))
+		}
+	}
+}
+
+func (m *Metrics) writeStmtCaches(w io.Writer) {
+	if m.stmtCaches == nil {
+		return
+	}
+	caches := m.stmtCaches()
+	if len(caches) == 0 {
+		return
+	}
+	names := sortedKeys(caches)
+	metrics := []struct {
+		name, typ, help string
+		value           func(s StmtCacheStats) string
+	}{
+		{`datahelperlite_stmt_cache_size`, `gauge`, `Prepared statements in the cache.`,
+			func(s StmtCacheStats) string { return strconv.Itoa(s.Size) }},
+		{`datahelperlite_stmt_cache_hits_total`, `counter`, `Prepared statement cache hits.`,
+			func(s StmtCacheStats) string { return strconv.FormatUint(s.Hits, 10) }},
+		{`datahelperlite_stmt_cache_misses_total`, `counter`, `Prepared statement cache misses.`,
+			func(s StmtCacheStats) string { return strconv.FormatUint(s.Misses, 10) }},
+		{`datahelperlite_stmt_cache_evictions_total`, `counter`, `Prepared statements evicted or invalidated.`,
+			func(s StmtCacheStats) string { return strconv.FormatUint(s.Evictions, 10) }},
+	}
+	for _, mt := range metrics {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", mt.name, mt.help, mt.name, mt.typ)
+		for _, n := range names {
+			fmt.Fprintf(w, "%s{handle=%s} %s\n", mt.name, quoteLabel(n), mt.value(caches[n]))
+		}
+	}
+}
+
+func writeBulkheads(w io.Writer, bulkheads map[string]*Bulkhead) {
+	type series struct {
+		bulkhead, lane string
+		stats          LaneStats
+	}
+	var all []series
+	for _, n := range sortedKeys(bulkheads) {
+		st := bulkheads[n].Stats()
+		for _, lane := range sortedKeys(st) {
+			all = append(all, series{n, lane, st[lane]})
+		}
+	}
+	metrics := []struct {
+		name, typ, help string
+		value           func(s LaneStats) string
+	}{
+		{`datahelperlite_bulkhead_capacity`, `gauge`, `Permits of the lane.`,
+			func(s LaneStats) string { return strconv.FormatInt(s.Capacity, 10) }},
+		{`datahelperlite_bulkhead_in_use`, `gauge`, `Permits held.`,
+			func(s LaneStats) string { return strconv.FormatInt(s.InUse, 10) }},
+		{`datahelperlite_bulkhead_queue_depth`, `gauge`, `Acquirers waiting for permits.`,
+			func(s LaneStats) string { return strconv.Itoa(s.Waiting) }},
+		{`datahelperlite_bulkhead_acquired_total`, `counter`, `Successful acquisitions.`,
+			func(s LaneStats) string { return strconv.FormatUint(s.Acquired, 10) }},
+		{`datahelperlite_bulkhead_canceled_total`, `counter`, `Acquisitions abandoned because the context ended.`,
+			func(s LaneStats) string { return strconv.FormatUint(s.Canceled, 10) }},
+		{`datahelperlite_bulkhead_wait_seconds_total`, `counter`, `Time spent waiting for permits.`,
+			func(s LaneStats) string { return formatFloat(s.WaitTotal.Seconds()) }},
+	}
+	if len(all) == 0 {
+		return
+	}
+	for _, mt := range metrics {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", mt.name, mt.help, mt.name, mt.typ)
+		for _, s := range all {
+			fmt.Fprintf(w, "%s{bulkhead=%s,lane=%s} %s\n", mt.name, quoteLabel(s.bulkhead), quoteLabel(s.lane), mt.value(s.stats))
+		}
+	}
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func sortedPairs[V any](m map[[2]string]V) [][2]string {
+	keys := make([][2]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i][0] != keys[j][0] {
+			return keys[i][0] < keys[j][0]
+		}
+		return keys[i][1] < keys[j][1]
+	})
+	return keys
+}
+
+func quoteLabel(v string) string {
+	return `"` + labelEscaper.Replace(v) + `"`
+}
+
+func formatFloat(f float64) string {
+	if math.IsInf(f, +1) {
+		return `+Inf`
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// timedMethods are the operations recorded in the query duration histogram
+var timedMethods = map[string]bool{
+	"Exec":            true,
+	"Exists":          true,
+	"ExistsExt":       true,
+	"Next":            true,
+	"Query":           true,
+	"QueryArray":      true,
+	"QueryRow":        true,
+	"UpsertReturning": true,
+}
+
+// Interceptor returns an interceptor that records operations in the metrics collector
+func (m *Metrics) Interceptor() Interceptor {
+	return func(op *Operation, next Invoker) error {
+		start := time.Now()
+		err := next(op)
+		switch {
+		case timedMethods[op.Method] && m.fingerprint && op.SQL != "":
+			m.ObserveStatement(op.Method, Fingerprint(op.SQL), time.Since(start), err)
+		case timedMethods[op.Method]:
+			m.ObserveQuery(op.Method, time.Since(start), err)
+		case op.Method == "Commit" && err == nil:
+			m.ObserveTx(true)
+		case op.Method == "Rollback" && err == nil:
+			m.ObserveTx(false)
+		}
+		return err
+	}
+}
+
+// Instrument wraps a helper so that its operations are recorded in the metrics collector.
+//
+// It is a shorthand for Wrap(dh, m.Interceptor()).
+func Instrument(dh DataHelperLite, m *Metrics) DataHelperLite {
+	if dh == nil || m == nil {
+		return dh
+	}
+	return Wrap(dh, m.Interceptor())
+}
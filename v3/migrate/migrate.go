@@ -0,0 +1,165 @@
+// Package migrate applies versioned SQL migrations through a DataHelperLite.
+//
+// Migrations are pairs of files named <version>_<name>.up.sql and <version>_<name>.down.sql,
+// usually in an embed.FS. Each file may hold several statements (see datahelperlite.SplitStatements)
+// and writes tables as {table} placeholders, which are expanded with InterpolateTable.
+// A file runs in a transaction with its record in the history table, unless it holds the line
+//
+//	-- migrate:no-transaction
+//
+// for statements that cannot run in a transaction, such as CREATE INDEX CONCURRENTLY. Such a file
+// is recorded once all its statements ran; if one fails, the ones before it stay applied.
+//
+// Concurrent runs are serialized by a lock (see the lock package), and the checksums of applied
+// migrations are checked against their files before anything runs.
+package migrate
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	dhl "github.com/NarsilWorks-Inc/datahelperlite/v3"
+)
+
+// Table is the logical name of the history table. Statements write it as a {table} placeholder.
+var Table = `schema_migrations`
+
+// NoTransaction is the directive line that makes a migration file run outside of a transaction
+const NoTransaction = `-- migrate:no-transaction`
+
+// Errors
+var (
+	ErrBadFileName      error = errors.New(`migration file name is not <version>_<name>.up.sql or <version>_<name>.down.sql`)
+	ErrDuplicateVersion error = errors.New(`migration version is used twice`)
+	ErrNoUp             error = errors.New(`migration has no up file`)
+	ErrNoDown           error = errors.New(`migration has no down file`)
+	ErrChecksumMismatch error = errors.New(`applied migration was changed`)
+	ErrUnknownVersion   error = errors.New(`migration version is unknown`)
+	ErrMigrationFailed  error = errors.New(`migration failed`)
+)
+
+// Migration is a versioned change of the schema
+type Migration struct {
+	Version  int64  // Version, from the leading number of the file names
+	Name     string // Name, from the rest of the file names
+	Up       string // Script that applies the migration
+	Down     string // Script that reverts the migration. Empty when there is no down file.
+	UpTx     bool   // Up runs in a transaction
+	DownTx   bool   // Down runs in a transaction
+	Checksum string // SHA-256 of Up, in hex
+}
+
+// String returns the version and name of the migration
+func (m Migration) String() string {
+	return fmt.Sprintf("%d_%s", m.Version, m.Name)
+}
+
+// Status is the state of a migration
+type Status struct {
+	Migration
+	Applied   bool      // Recorded in the history table
+	AppliedAt time.Time // Time it was applied
+	Changed   bool      // Applied with another checksum than that of its file
+	Missing   bool      // Applied, but there is no file for it
+}
+
+// Load reads the migrations of a directory of a file system, in version order.
+// Files that do not end in .sql are ignored.
+func Load(fsys fs.FS, dir string) ([]Migration, error) {
+	if dir == "" {
+		dir = "."
+	}
+	entries, err := fs.ReadDir(fsys, dir)
+	if err != nil {
+		return nil, err
+	}
+	byVersion := make(map[int64]*Migration)
+	for _, e := range entries {
+		if e.IsDir() || !strings.HasSuffix(e.Name(), ".sql") {
+			continue
+		}
+		version, name, up, err := parseFileName(e.Name())
+		if err != nil {
+			return nil, err
+		}
+		b, err := fs.ReadFile(fsys, path.Join(dir, e.Name()))
+		if err != nil {
+			return nil, err
+		}
+		m := byVersion[version]
+		if m == nil {
+			m = &Migration{Version: version, Name: name}
+			byVersion[version] = m
+		}
+		if m.Name != name || (up && m.Checksum != "") || (!up && m.Down != "") {
+			return nil, fmt.Errorf("%w: %s", ErrDuplicateVersion, e.Name())
+		}
+		script, tx := string(b), !hasDirective(string(b))
+		if up {
+			sum := sha256.Sum256(b)
+			m.Up, m.UpTx, m.Checksum = script, tx, hex.EncodeToString(sum[:])
+		} else {
+			m.Down, m.DownTx = script, tx
+		}
+	}
+
+	out := make([]Migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		if m.Checksum == "" {
+			return nil, fmt.Errorf("%w: %s", ErrNoUp, m)
+		}
+		out = append(out, *m)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Version < out[j].Version })
+	return out, nil
+}
+
+// parseFileName splits a migration file name into its version and name, telling up files from down files
+func parseFileName(file string) (version int64, name string, up bool, err error) {
+	base, up := strings.CutSuffix(file, ".up.sql")
+	if !up {
+		var down bool
+		if base, down = strings.CutSuffix(file, ".down.sql"); !down {
+			return 0, "", false, fmt.Errorf("%w: %s", ErrBadFileName, file)
+		}
+	}
+	num, name, _ := strings.Cut(base, "_")
+	version, err = strconv.ParseInt(num, 10, 64)
+	if err != nil || version < 0 {
+		return 0, "", false, fmt.Errorf("%w: %s", ErrBadFileName, file)
+	}
+	return version, name, up, nil
+}
+
+// hasDirective reports if a script holds the no-transaction directive on a line of its own
+func hasDirective(script string) bool {
+	for _, line := range strings.Split(script, "\n") {
+		if strings.EqualFold(strings.TrimSpace(line), NoTransaction) {
+			return true
+		}
+	}
+	return false
+}
+
+// DDL returns the statements that create the history table for a dialect
+func DDL(d dhl.Dialect) []string {
+	ts := `TIMESTAMP`
+	switch d {
+	case dhl.DialectSQLServer:
+		ts = `DATETIME2`
+	case dhl.DialectMySQL:
+		ts = `DATETIME(6)`
+	}
+	return []string{
+		fmt.Sprintf(`CREATE TABLE {%s} (version BIGINT NOT NULL PRIMARY KEY, name VARCHAR(255) NOT NULL, `+
+			`checksum VARCHAR(64) NOT NULL, applied_at %s NOT NULL)`, Table, ts),
+	}
+}
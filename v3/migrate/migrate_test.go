@@ -0,0 +1,245 @@
+package migrate
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	dhl "github.com/NarsilWorks-Inc/datahelperlite/v3"
+	"github.com/NarsilWorks-Inc/datahelperlite/v3/internal/dhltest"
+)
+
+// fakeDB keeps the tables of a scripted helper in memory
+type fakeDB struct {
+	h       *dhltest.Helper
+	tables  map[string]bool
+	history map[int64]record
+	locked  bool
+	failOn  string
+}
+
+func newFakeDB() *fakeDB {
+	db := &fakeDB{tables: map[string]bool{}, history: map[int64]record{}}
+	db.h = &dhltest.Helper{OnExec: db.exec, OnExists: db.exists, OnQuery: db.query}
+	return db
+}
+
+// log returns the statements executed, with BEGIN, COMMIT and ROLLBACK, in order
+func (db *fakeDB) log() []string {
+	var out []string
+	for _, c := range db.h.Calls() {
+		switch c.Method {
+		case "Exec":
+			out = append(out, c.SQL)
+		case "Begin", "Commit", "Rollback":
+			out = append(out, strings.ToUpper(c.Method))
+		}
+	}
+	return out
+}
+
+func (db *fakeDB) exists(sql string, args ...any) (bool, error) {
+	for t := range db.tables {
+		if strings.Contains(sql, t) {
+			return false, nil
+		}
+	}
+	return false, errors.New("no such table")
+}
+
+func (db *fakeDB) exec(sql string, args ...any) (int64, error) {
+	if db.failOn != "" && strings.Contains(sql, db.failOn) {
+		return 0, errors.New("syntax error")
+	}
+	switch {
+	case strings.HasPrefix(sql, "CREATE TABLE "):
+		db.tables[strings.Fields(sql)[2]] = true
+	case strings.Contains(sql, "locks") && strings.HasPrefix(sql, "INSERT"):
+		if db.locked {
+			return 0, errors.New("duplicate key")
+		}
+		db.locked = true
+	case strings.Contains(sql, "locks") && strings.Contains(sql, "owner = ?"):
+		db.locked = false
+	case strings.HasPrefix(sql, "INSERT INTO schema_migrations"):
+		r := record{version: args[0].(int64), name: args[1].(string), checksum: args[2].(string), appliedAt: args[3].(time.Time)}
+		db.history[r.version] = r
+	case strings.HasPrefix(sql, "DELETE FROM schema_migrations"):
+		delete(db.history, args[0].(int64))
+	}
+	return 1, nil
+}
+
+func (db *fakeDB) query(sql string, args ...any) (dhl.Rows, error) {
+	var vals [][]any
+	for _, r := range db.history {
+		vals = append(vals, []any{r.version, r.name, r.checksum, r.appliedAt})
+	}
+	return dhltest.NewRows([]string{"version", "name", "checksum", "applied_at"}, vals...), nil
+}
+
+func testFS() fstest.MapFS {
+	return fstest.MapFS{
+		"sql/0001_users.up.sql":       {Data: []byte("CREATE TABLE {users} (id INT);\nINSERT INTO {users} VALUES (1);\n")},
+		"sql/0001_users.down.sql":     {Data: []byte("DROP TABLE {users};")},
+		"sql/0002_index.up.sql":       {Data: []byte("-- migrate:no-transaction\nCREATE INDEX CONCURRENTLY users_id ON {users} (id);")},
+		"sql/0002_index.down.sql":     {Data: []byte("-- migrate:no-transaction\nDROP INDEX CONCURRENTLY users_id;")},
+		"sql/0010_orders.up.sql":      {Data: []byte("CREATE TABLE {orders} (id INT);")},
+		"sql/README.md":               {Data: []byte("not a migration")},
+		"sql/0010_orders.down.sql":    {Data: []byte("DROP TABLE {orders};")},
+		"other/0001_elsewhere.up.sql": {Data: []byte("SELECT 1;")},
+	}
+}
+
+func newTestMigrator(t *testing.T, db *fakeDB, fsys fstest.MapFS, opts Options) *Migrator {
+	t.Helper()
+	opts.Dir = "sql"
+	opts.Dialect = dhl.DialectSQLite
+	opts.Logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+	m, err := New(db.h, nil, fsys, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+func TestLoad(t *testing.T) {
+	migs, err := Load(testFS(), "sql")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(migs) != 3 || migs[0].Version != 1 || migs[1].String() != "2_index" || migs[2].Version != 10 {
+		t.Fatalf("got %v", migs)
+	}
+	if !migs[0].UpTx || migs[1].UpTx || migs[1].DownTx || len(migs[0].Checksum) != 64 {
+		t.Errorf("got %+v", migs[:2])
+	}
+
+	for name, fsys := range map[string]fstest.MapFS{
+		"bad name":  {"1-users.up.sql": {}},
+		"no up":     {"0001_users.down.sql": {}},
+		"duplicate": {"0001_users.up.sql": {}, "0001_accounts.up.sql": {}},
+	} {
+		if _, err := Load(fsys, ""); err == nil {
+			t.Errorf("%s: loaded", name)
+		}
+	}
+}
+
+func TestUpStatusDown(t *testing.T) {
+	db := newFakeDB()
+	fsys := testFS()
+	m := newTestMigrator(t, db, fsys, Options{Schema: "app"})
+
+	done, err := m.UpTo(context.Background(), 2)
+	if err != nil || len(done) != 2 {
+		t.Fatalf("got %v, %v", done, err)
+	}
+	log := strings.Join(db.log(), "\n")
+	for _, want := range []string{
+		"CREATE TABLE app.schema_migrations",
+		"BEGIN\nCREATE TABLE app.users (id INT)\nINSERT INTO app.users VALUES (1)\nINSERT INTO app.schema_migrations",
+		"COMMIT\n-- migrate:no-transaction\nCREATE INDEX CONCURRENTLY users_id ON app.users (id)\nINSERT INTO app.schema_migrations",
+	} {
+		if !strings.Contains(log, want) {
+			t.Errorf("log lacks %q:\n%s", want, log)
+		}
+	}
+	if db.locked {
+		t.Error("lock not released")
+	}
+}
+
+func TestStatusAndChecksums(t *testing.T) {
+	db := newFakeDB()
+	fsys := testFS()
+	m := newTestMigrator(t, db, fsys, Options{})
+	if _, err := m.Up(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if len(db.history) != 3 {
+		t.Fatalf("history %v", db.history)
+	}
+	db.history[99] = record{version: 99, name: "gone"}
+
+	fsys["sql/0001_users.up.sql"] = &fstest.MapFile{Data: []byte("CREATE TABLE {users} (id BIGINT);")}
+	m = newTestMigrator(t, db, fsys, Options{})
+	st, err := m.Status(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(st) != 4 || !st[0].Changed || st[1].Changed || !st[2].Applied || !st[3].Missing {
+		t.Errorf("got %+v", st)
+	}
+	if _, err := m.Up(context.Background()); !errors.Is(err, ErrChecksumMismatch) {
+		t.Errorf("got %v, want ErrChecksumMismatch", err)
+	}
+
+	fsys = testFS()
+	m = newTestMigrator(t, db, fsys, Options{})
+	if _, err := m.Down(context.Background(), 1); !errors.Is(err, ErrUnknownVersion) {
+		t.Errorf("got %v, want ErrUnknownVersion for a version without file", err)
+	}
+	delete(db.history, 99)
+	for _, steps := range []int{0, -1} {
+		if done, err := m.Down(context.Background(), steps); err != nil || len(done) != 0 {
+			t.Errorf("Down(%d): got %v, %v", steps, done, err)
+		}
+	}
+	done, err := m.Down(context.Background(), 2)
+	if err != nil || len(done) != 2 || done[0].Version != 10 || done[1].Version != 2 {
+		t.Fatalf("got %v, %v", done, err)
+	}
+	if _, ok := db.history[1]; len(db.history) != 1 || !ok {
+		t.Errorf("history %v", db.history)
+	}
+
+	// Only a missing table is an empty history
+	down := errors.New("connection refused")
+	db = newFakeDB()
+	db.h.OnExists = func(string, ...any) (bool, error) { return false, down }
+	if _, err := newTestMigrator(t, db, testFS(), Options{}).Status(context.Background()); !errors.Is(err, down) {
+		t.Errorf("got %v, want the error of the probe", err)
+	}
+}
+
+func TestFailedMigrationRollsBack(t *testing.T) {
+	db := newFakeDB()
+	db.failOn = "INSERT INTO users"
+	m := newTestMigrator(t, db, testFS(), Options{})
+	done, err := m.Up(context.Background())
+	if !errors.Is(err, ErrMigrationFailed) || len(done) != 0 {
+		t.Fatalf("got %v, %v", done, err)
+	}
+	if !strings.Contains(err.Error(), "up 1_users, statement 2") {
+		t.Errorf("error %q", err)
+	}
+	if log := db.log(); len(db.history) != 0 || log[len(log)-2] != "ROLLBACK" {
+		t.Errorf("history %v, log %q", db.history, log)
+	}
+	if db.locked {
+		t.Error("lock not released")
+	}
+}
+
+func TestDryRun(t *testing.T) {
+	db := newFakeDB()
+	var out bytes.Buffer
+	m := newTestMigrator(t, db, testFS(), Options{DryRun: true, Output: &out})
+	done, err := m.Up(context.Background())
+	if err != nil || len(done) != 3 {
+		t.Fatalf("got %v, %v", done, err)
+	}
+	if log := db.log(); len(log) != 0 || len(db.tables) != 0 {
+		t.Errorf("dry run changed the database: %q", log)
+	}
+	if !strings.Contains(out.String(), "-- up 1_users\nCREATE TABLE users (id INT);\nINSERT INTO users VALUES (1);\n-- up 2_index") {
+		t.Errorf("output:\n%s", out.String())
+	}
+}
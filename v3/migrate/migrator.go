@@ -0,0 +1,361 @@
+package migrate
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"regexp"
+	"sort"
+	"time"
+
+	dhl "github.com/NarsilWorks-Inc/datahelperlite/v3"
+	"github.com/NarsilWorks-Inc/datahelperlite/v3/lock"
+)
+
+// LockName is the name of the lock that serializes migration runs
+var LockName = `migrate`
+
+// Options configures a Migrator
+type Options struct {
+	Dir         string           // Directory of the migrations in the file system. The default is its root.
+	Schema      string           // Schema of {table} placeholders. The default is the schema of the handle.
+	Dialect     dhl.Dialect      // Dialect of the lock and the history table. Derived from the handle when empty.
+	LockTimeout time.Duration    // Time to wait for another run to finish. The default is one minute.
+	DryRun      bool             // Write the statements that would run to Output instead of running them
+	Output      io.Writer        // Writer of dry runs. The default is os.Stdout.
+	Logger      *slog.Logger     // Logger of applied migrations. The default is slog.Default.
+	Now         func() time.Time // Clock of the history. The default is time.Now.
+}
+
+// Migrator applies the migrations of a file system to the database of a handle
+type Migrator struct {
+	dh         dhl.DataHelperLite
+	handle     dhl.DataHelperHandle
+	migrations []Migration
+	opts       Options
+}
+
+// record is a row of the history table
+type record struct {
+	version   int64
+	name      string
+	checksum  string
+	appliedAt time.Time
+}
+
+// New loads the migrations of a file system, such as an embed.FS, for helpers created from dh and acquired with a handle
+func New(dh dhl.DataHelperLite, h dhl.DataHelperHandle, fsys fs.FS, opts Options) (*Migrator, error) {
+	migrations, err := Load(fsys, opts.Dir)
+	if err != nil {
+		return nil, err
+	}
+	if h != nil {
+		if di := h.DI(); di != nil {
+			if opts.Schema == "" && di.Schema != nil {
+				opts.Schema = *di.Schema
+			}
+			if opts.Dialect == "" {
+				opts.Dialect = dhl.DialectOf(di)
+			}
+		}
+	}
+	if opts.LockTimeout <= 0 {
+		opts.LockTimeout = time.Minute
+	}
+	if opts.Output == nil {
+		opts.Output = os.Stdout
+	}
+	if opts.Logger == nil {
+		opts.Logger = slog.Default()
+	}
+	if opts.Now == nil {
+		opts.Now = time.Now
+	}
+	return &Migrator{dh: dh, handle: h, migrations: migrations, opts: opts}, nil
+}
+
+// Migrations returns the migrations that were loaded, in version order
+func (m *Migrator) Migrations() []Migration {
+	return append([]Migration(nil), m.migrations...)
+}
+
+// Status returns the state of every migration in version order, including applied versions that have no file
+func (m *Migrator) Status(ctx context.Context) (out []Status, err error) {
+	dh := m.dh.NewHelper()
+	if err := dh.Acquire(ctx, m.handle); err != nil {
+		return nil, err
+	}
+	defer func() {
+		err = errors.Join(err, dh.Release())
+	}()
+
+	applied, err := m.history(dh, false)
+	if err != nil {
+		return nil, err
+	}
+	for _, mig := range m.migrations {
+		st := Status{Migration: mig}
+		if r, ok := applied[mig.Version]; ok {
+			st.Applied, st.AppliedAt, st.Changed = true, r.appliedAt, r.checksum != mig.Checksum
+			delete(applied, mig.Version)
+		}
+		out = append(out, st)
+	}
+	for _, r := range applied {
+		out = append(out, Status{
+			Migration: Migration{Version: r.version, Name: r.name, Checksum: r.checksum},
+			Applied:   true,
+			AppliedAt: r.appliedAt,
+			Missing:   true,
+		})
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Version < out[j].Version })
+	return out, nil
+}
+
+// Up applies every pending migration in version order and returns them
+func (m *Migrator) Up(ctx context.Context) ([]Migration, error) {
+	return m.UpTo(ctx, -1)
+}
+
+// UpTo applies the pending migrations up to a version, or all of them if it is negative, and returns them.
+// Pending migrations older than applied ones are applied too.
+func (m *Migrator) UpTo(ctx context.Context, version int64) ([]Migration, error) {
+	if version >= 0 && !m.known(version) {
+		return nil, fmt.Errorf("%w: %d", ErrUnknownVersion, version)
+	}
+	return m.run(ctx, func(applied map[int64]record) ([]Migration, error) {
+		var todo []Migration
+		for _, mig := range m.migrations {
+			if _, ok := applied[mig.Version]; !ok && (version < 0 || mig.Version <= version) {
+				todo = append(todo, mig)
+			}
+		}
+		return todo, nil
+	}, true)
+}
+
+// Down reverts the latest applied migrations, up to a number of steps, and returns them.
+// It reverts nothing when steps is zero or less.
+func (m *Migrator) Down(ctx context.Context, steps int) ([]Migration, error) {
+	if steps <= 0 {
+		return nil, nil
+	}
+	return m.run(ctx, func(applied map[int64]record) ([]Migration, error) {
+		versions := make([]int64, 0, len(applied))
+		for v := range applied {
+			versions = append(versions, v)
+		}
+		sort.Slice(versions, func(i, j int) bool { return versions[i] > versions[j] })
+
+		var todo []Migration
+		for _, v := range versions[:min(steps, len(versions))] {
+			mig, ok := m.find(v)
+			if !ok {
+				return nil, fmt.Errorf("%w: %d has no file", ErrUnknownVersion, v)
+			}
+			if mig.Down == "" {
+				return nil, fmt.Errorf("%w: %s", ErrNoDown, mig)
+			}
+			todo = append(todo, mig)
+		}
+		return todo, nil
+	}, false)
+}
+
+// run takes the lock, checks the history and runs the migrations that plan picks from it
+func (m *Migrator) run(ctx context.Context, plan func(applied map[int64]record) ([]Migration, error), up bool) (done []Migration, err error) {
+	dh := m.dh.NewHelper()
+	if err := dh.Acquire(ctx, m.handle); err != nil {
+		return nil, err
+	}
+	defer func() {
+		err = errors.Join(err, dh.Release())
+	}()
+
+	if !m.opts.DryRun {
+		unlock, err := m.lock(ctx, dh)
+		if err != nil {
+			return nil, err
+		}
+		defer func() {
+			err = errors.Join(err, unlock())
+		}()
+	}
+
+	applied, err := m.history(dh, !m.opts.DryRun)
+	if err != nil {
+		return nil, err
+	}
+	for _, mig := range m.migrations {
+		if r, ok := applied[mig.Version]; ok && r.checksum != mig.Checksum {
+			return nil, fmt.Errorf("%w: %s", ErrChecksumMismatch, mig)
+		}
+	}
+	todo, err := plan(applied)
+	if err != nil {
+		return nil, err
+	}
+	for _, mig := range todo {
+		if err := m.apply(dh, mig, up); err != nil {
+			return done, err
+		}
+		done = append(done, mig)
+	}
+	return done, nil
+}
+
+// lock takes the migration lock, creating the lock table first on databases that need it
+func (m *Migrator) lock(ctx context.Context, dh dhl.DataHelperLite) (func() error, error) {
+	switch m.opts.Dialect {
+	case dhl.DialectPostgres, dhl.DialectSQLServer, dhl.DialectMySQL:
+	default:
+		if _, err := m.ensure(dh, lock.Table, lock.DDL(m.opts.Dialect)); err != nil {
+			return nil, err
+		}
+	}
+	return lock.Lock(ctx, dh, LockName, lock.Options{
+		Timeout: m.opts.LockTimeout,
+		Dialect: m.opts.Dialect,
+		Handle:  m.handle,
+	})
+}
+
+// ensure creates a table with its DDL if it does not exist, and reports if it exists afterwards.
+// A table created at the same time by another run counts as existing. Errors of the probe other
+// than a missing table, such as a lost connection, are returned.
+func (m *Migrator) ensure(dh dhl.DataHelperLite, table string, ddl []string) (bool, error) {
+	probe := dhl.InterpolateTable(`SELECT 1 FROM {`+table+`} WHERE 1 = 0`, m.opts.Schema)
+	_, err := dh.Exists(probe)
+	switch {
+	case err == nil:
+		return true, nil
+	case !missingTable(err):
+		return false, err
+	case ddl == nil:
+		return false, nil
+	}
+	for _, q := range ddl {
+		if _, err := dh.Exec(dhl.InterpolateTable(q, m.opts.Schema)); err != nil {
+			if _, perr := dh.Exists(probe); perr == nil {
+				return true, nil
+			}
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// missingTableRx matches the messages of the supported databases for a table that does not exist:
+// SQLite, PostgreSQL (42P01), MySQL (1146) and SQL Server (208), in that order
+var missingTableRx = regexp.MustCompile(`no such table|relation ".*" does not exist|Table '.*' doesn't exist|Invalid object name`)
+
+// missingTable reports if an error tells that a table does not exist
+func missingTable(err error) bool {
+	var se interface{ SQLState() string }
+	if errors.As(err, &se) {
+		switch se.SQLState() {
+		case "42P01", "42S02":
+			return true
+		}
+	}
+	return missingTableRx.MatchString(err.Error())
+}
+
+// history reads the history table, creating it when asked to. A missing table is an empty history.
+func (m *Migrator) history(dh dhl.DataHelperLite, create bool) (map[int64]record, error) {
+	var ddl []string
+	if create {
+		ddl = DDL(m.opts.Dialect)
+	}
+	exists, err := m.ensure(dh, Table, ddl)
+	if err != nil || !exists {
+		return map[int64]record{}, err
+	}
+
+	rows, err := dh.Query(dhl.InterpolateTable(`SELECT version, name, checksum, applied_at FROM {`+Table+`} ORDER BY version`, m.opts.Schema))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := make(map[int64]record)
+	for rows.Next() {
+		var r record
+		if err := rows.Scan(&r.version, &r.name, &r.checksum, &r.appliedAt); err != nil {
+			return nil, err
+		}
+		out[r.version] = r
+	}
+	return out, rows.Err()
+}
+
+// apply runs the up or down script of a migration and records it, in a transaction unless the file opted out
+func (m *Migrator) apply(dh dhl.DataHelperLite, mig Migration, up bool) error {
+	script, tx, dir := mig.Up, mig.UpTx, "up"
+	recordSQL, args := `INSERT INTO {`+Table+`} (version, name, checksum, applied_at) VALUES (?, ?, ?, ?)`,
+		[]any{mig.Version, mig.Name, mig.Checksum, m.opts.Now().UTC()}
+	if !up {
+		script, tx, dir = mig.Down, mig.DownTx, "down"
+		recordSQL, args = `DELETE FROM {`+Table+`} WHERE version = ?`, []any{mig.Version}
+	}
+	stmts := dhl.SplitStatements(dhl.InterpolateTable(script, m.opts.Schema))
+
+	if m.opts.DryRun {
+		fmt.Fprintf(m.opts.Output, "-- %s %s\n", dir, mig)
+		for _, s := range stmts {
+			fmt.Fprintf(m.opts.Output, "%s;\n", s)
+		}
+		return nil
+	}
+
+	start := time.Now()
+	if tx {
+		if err := dh.BeginManually(); err != nil {
+			return err
+		}
+	}
+	stmts = append(stmts, dhl.InterpolateTable(recordSQL, m.opts.Schema))
+	for i, s := range stmts {
+		var err error
+		if i == len(stmts)-1 {
+			_, err = dh.Exec(s, args...)
+		} else {
+			_, err = dh.Exec(s)
+		}
+		if err != nil {
+			if tx {
+				_ = dh.Rollback()
+			}
+			return fmt.Errorf("%w: %s %s, statement %d: %w", ErrMigrationFailed, dir, mig, i+1, err)
+		}
+	}
+	if tx {
+		if err := dh.Commit(); err != nil {
+			return fmt.Errorf("%w: %s %s: %w", ErrMigrationFailed, dir, mig, err)
+		}
+	}
+	m.opts.Logger.Info("migration "+dir,
+		slog.Int64("version", mig.Version),
+		slog.String("name", mig.Name),
+		slog.Duration("duration", time.Since(start)),
+	)
+	return nil
+}
+
+func (m *Migrator) known(version int64) bool {
+	_, ok := m.find(version)
+	return ok
+}
+
+func (m *Migrator) find(version int64) (Migration, bool) {
+	for _, mig := range m.migrations {
+		if mig.Version == version {
+			return mig, true
+		}
+	}
+	return Migration{}, false
+}
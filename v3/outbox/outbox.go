@@ -0,0 +1,97 @@
+// Package outbox implements a transactional outbox on DataHelperLite.
+//
+// Messages are written to an outbox table in the transaction that changes the business data,
+// so that they exist if and only if the transaction commits. A Relay reads them in order and
+// hands them to a publisher, retrying failures with a backoff and moving messages that keep
+// failing to a dead-letter table.
+package outbox
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	dhl "github.com/NarsilWorks-Inc/datahelperlite/v3"
+)
+
+// Logical names of the outbox tables. Statements write them as {table} placeholders.
+var (
+	Table           = `outbox`
+	DeadLetterTable = `outbox_dead`
+)
+
+// Errors
+var (
+	ErrEmptyTopic error = errors.New(`outbox topic is empty`)
+)
+
+// Message is a message of the outbox
+type Message struct {
+	ID        int64     // Sequence of the message in the outbox
+	Topic     string    // Topic to publish to
+	Payload   []byte    // Content of the message
+	Attempts  int       // Failed publish attempts so far
+	CreatedAt time.Time // Time the message was enqueued, in UTC
+}
+
+// Enqueue writes a message to the outbox in the active transaction of a helper.
+//
+// It fails with ErrNoTx when the helper tells that it has no transaction (see datahelperlite.OnCommit).
+// Relays of the same process are woken up when the transaction commits.
+func Enqueue(dh dhl.DataHelperLite, topic string, payload []byte) error {
+	if topic == "" {
+		return ErrEmptyTopic
+	}
+	switch err := dhl.OnCommit(dh, wakeRelays); {
+	case errors.Is(err, dhl.ErrTxCallbacksUnsupported):
+		// The helper cannot tell, trust the caller
+	case err != nil:
+		return err
+	}
+	now := time.Now().UTC()
+	_, err := dh.Exec(
+		`INSERT INTO {`+Table+`} (topic, payload, attempts, created_at, available_at) VALUES (?, ?, 0, ?, ?)`,
+		topic, payload, now, now,
+	)
+	return err
+}
+
+// DDL returns the statements that create the outbox tables for a dialect
+func DDL(d dhl.Dialect) []string {
+	id, blob, ts, text := `BIGINT GENERATED ALWAYS AS IDENTITY PRIMARY KEY`, `BYTEA`, `TIMESTAMP`, `TEXT`
+	switch d {
+	case dhl.DialectSQLServer:
+		id, blob, ts, text = `BIGINT IDENTITY(1,1) PRIMARY KEY`, `VARBINARY(MAX)`, `DATETIME2`, `NVARCHAR(MAX)`
+	case dhl.DialectMySQL:
+		id, blob, ts = `BIGINT AUTO_INCREMENT PRIMARY KEY`, `LONGBLOB`, `DATETIME(6)`
+	case dhl.DialectSQLite:
+		id, blob = `INTEGER PRIMARY KEY AUTOINCREMENT`, `BLOB`
+	}
+	return []string{
+		fmt.Sprintf(`CREATE TABLE {%s} (id %s, topic VARCHAR(255) NOT NULL, payload %s, attempts INT NOT NULL, `+
+			`created_at %s NOT NULL, available_at %s NOT NULL, published_at %s NULL, last_error %s NULL)`,
+			Table, id, blob, ts, ts, ts, text),
+		fmt.Sprintf(`CREATE INDEX %s_pending ON {%s} (available_at, id)`, Table, Table),
+		fmt.Sprintf(`CREATE TABLE {%s} (id BIGINT NOT NULL PRIMARY KEY, topic VARCHAR(255) NOT NULL, payload %s, `+
+			`attempts INT NOT NULL, created_at %s NOT NULL, failed_at %s NOT NULL, last_error %s NULL)`,
+			DeadLetterTable, blob, ts, ts, text),
+	}
+}
+
+var (
+	relaysMu sync.Mutex
+	relays   = make(map[chan struct{}]struct{})
+)
+
+// wakeRelays makes the waiting relays poll now
+func wakeRelays() {
+	relaysMu.Lock()
+	defer relaysMu.Unlock()
+	for ch := range relays {
+		select {
+		case ch <- struct{}{}:
+		default:
+		}
+	}
+}
@@ -0,0 +1,80 @@
+package outbox
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+	"testing"
+
+	dhl "github.com/NarsilWorks-Inc/datahelperlite/v3"
+	"github.com/NarsilWorks-Inc/datahelperlite/v3/internal/dhltest"
+)
+
+// relayHelper serves the pending messages to the claim query
+func relayHelper(pending ...Message) *dhltest.Helper {
+	return &dhltest.Helper{
+		OnQuery: func(sql string, args ...any) (dhl.Rows, error) {
+			if !strings.Contains(sql, "FOR UPDATE SKIP LOCKED") {
+				return nil, errors.New("claim query does not lock: " + sql)
+			}
+			vals := make([][]any, len(pending))
+			for i, m := range pending {
+				vals[i] = []any{m.ID, m.Topic, m.Payload, m.Attempts, m.CreatedAt}
+			}
+			return dhltest.NewRows([]string{"id", "topic", "payload", "attempts", "created_at"}, vals...), nil
+		},
+	}
+}
+
+func TestRelayOnce(t *testing.T) {
+	fake := relayHelper(
+		Message{ID: 1, Topic: "orders", Payload: []byte("ok")},
+		Message{ID: 2, Topic: "orders", Payload: []byte("fail")},
+		Message{ID: 3, Topic: "orders", Payload: []byte("fail"), Attempts: 2},
+	)
+	publish := func(_ context.Context, m Message) error {
+		if string(m.Payload) == "fail" {
+			return errors.New("broker down")
+		}
+		return nil
+	}
+	r := NewRelay(fake, nil, publish, RelayOptions{
+		MaxAttempts: 3,
+		Dialect:     dhl.DialectPostgres,
+		Logger:      slog.New(slog.NewTextHandler(io.Discard, nil)),
+	})
+	n, err := r.RelayOnce(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 3 {
+		t.Errorf("claimed %d, want 3", n)
+	}
+	var execs []string
+	for _, c := range fake.Calls() {
+		switch c.Method {
+		case "Exec":
+			execs = append(execs, fmt.Sprintf("%s %v", strings.Fields(c.SQL)[0], c.Args[len(c.Args)-1]))
+		case "Begin", "Commit", "Rollback":
+			execs = append(execs, strings.ToUpper(c.Method))
+		}
+	}
+	// The claim and lease commit before publishing, each message is settled on its own
+	want := []string{"BEGIN", "UPDATE 3", "COMMIT", "UPDATE 1", "UPDATE 2", "BEGIN", "INSERT broker down", "DELETE 3", "COMMIT"}
+	if strings.Join(execs, "|") != strings.Join(want, "|") {
+		t.Errorf("got %q, want %q", execs, want)
+	}
+}
+
+func TestEnqueue(t *testing.T) {
+	dh := dhl.Wrap(&dhltest.Helper{})
+	if err := Enqueue(dh, "orders", nil); !errors.Is(err, dhl.ErrNoTx) {
+		t.Errorf("got %v, want ErrNoTx", err)
+	}
+	if err := Enqueue(dh, "", nil); !errors.Is(err, ErrEmptyTopic) {
+		t.Errorf("got %v, want ErrEmptyTopic", err)
+	}
+}
@@ -0,0 +1,235 @@
+package outbox
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	dhl "github.com/NarsilWorks-Inc/datahelperlite/v3"
+)
+
+// Publisher publishes a message. A message is published at least once, so publishers should be idempotent.
+type Publisher func(ctx context.Context, m Message) error
+
+// RelayOptions configures a Relay
+type RelayOptions struct {
+	BatchSize    int                              // Messages claimed per poll. The default is 100.
+	Lease        time.Duration                    // Time other relays skip a claimed message. The default is five minutes.
+	PollInterval time.Duration                    // Time between polls when the outbox is drained. The default is one second.
+	MaxAttempts  int                              // Failed attempts before a message is dead-lettered. The default is 10.
+	Backoff      func(attempts int) time.Duration // Delay before the next attempt. The default doubles from one second up to five minutes.
+	Delete       bool                             // Delete published messages instead of setting their published_at
+	Dialect      dhl.Dialect                      // Dialect of the locking clause. Derived from the handle when empty.
+	Logger       *slog.Logger                     // Logger of relay errors. The default is slog.Default.
+	Now          func() time.Time                 // Clock. The default is time.Now.
+}
+
+// Relay moves messages from the outbox to a publisher.
+//
+// Messages are claimed with FOR UPDATE SKIP LOCKED, or READPAST on SQL Server, in a short transaction
+// that leases them by moving their available_at past the lease, so that several relays can run against
+// the same outbox without publishing a message twice at once. Each message is then published and settled
+// on its own, without a transaction held open while publishing. Messages not settled within the lease,
+// as when a relay stops, are claimed again.
+type Relay struct {
+	dh      dhl.DataHelperLite
+	handle  dhl.DataHelperHandle
+	publish Publisher
+	opts    RelayOptions
+}
+
+// NewRelay creates a relay that publishes with helpers created from dh and acquired with a handle
+func NewRelay(dh dhl.DataHelperLite, h dhl.DataHelperHandle, publish Publisher, opts RelayOptions) *Relay {
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = 100
+	}
+	if opts.Lease <= 0 {
+		opts.Lease = 5 * time.Minute
+	}
+	if opts.PollInterval <= 0 {
+		opts.PollInterval = time.Second
+	}
+	if opts.MaxAttempts <= 0 {
+		opts.MaxAttempts = 10
+	}
+	if opts.Backoff == nil {
+		opts.Backoff = dhl.ExponentialBackoff(time.Second, 5*time.Minute)
+	}
+	if opts.Dialect == "" && h != nil {
+		opts.Dialect = dhl.DialectOf(h.DI())
+	}
+	if opts.Logger == nil {
+		opts.Logger = slog.Default()
+	}
+	if opts.Now == nil {
+		opts.Now = time.Now
+	}
+	return &Relay{dh: dh, handle: h, publish: publish, opts: opts}
+}
+
+// Run relays messages until the context ends. Batches that fail are logged and retried at the next poll.
+func (r *Relay) Run(ctx context.Context) error {
+	wake := make(chan struct{}, 1)
+	relaysMu.Lock()
+	relays[wake] = struct{}{}
+	relaysMu.Unlock()
+	defer func() {
+		relaysMu.Lock()
+		delete(relays, wake)
+		relaysMu.Unlock()
+	}()
+
+	for {
+		n, err := r.RelayOnce(ctx)
+		if err != nil && ctx.Err() == nil {
+			r.opts.Logger.Error("outbox relay failed", slog.Any("error", err))
+		}
+		if n == r.opts.BatchSize && err == nil {
+			// There may be more
+			continue
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-wake:
+		case <-time.After(r.opts.PollInterval):
+		}
+	}
+}
+
+// RelayOnce claims a batch of due messages and publishes them in order, recording the outcome of each
+// as soon as it is published. It returns the number of messages claimed.
+func (r *Relay) RelayOnce(ctx context.Context) (n int, err error) {
+	dh := r.dh.NewHelper()
+	if err := dh.Acquire(ctx, r.handle); err != nil {
+		return 0, err
+	}
+	defer func() {
+		err = errors.Join(err, dh.Release())
+	}()
+
+	msgs, err := r.claim(dh)
+	if err != nil {
+		return 0, err
+	}
+	for _, m := range msgs {
+		// Messages left unsettled are claimed again when their lease ends
+		if err := ctx.Err(); err != nil {
+			return len(msgs), err
+		}
+		if err := r.settle(dh, m, r.publish(ctx, m)); err != nil {
+			return len(msgs), err
+		}
+	}
+	return len(msgs), nil
+}
+
+// claimSQL returns the statement that locks a batch of due messages
+func (r *Relay) claimSQL() string {
+	cols := `id, topic, payload, attempts, created_at`
+	where := `published_at IS NULL AND available_at <= ?`
+	switch r.opts.Dialect {
+	case dhl.DialectSQLServer:
+		return fmt.Sprintf(`SELECT TOP (%d) %s FROM {%s} WITH (UPDLOCK, ROWLOCK, READPAST) WHERE %s ORDER BY id`,
+			r.opts.BatchSize, cols, Table, where)
+	case dhl.DialectSQLite:
+		// SQLite has a single writer, the transaction is the lock
+		return fmt.Sprintf(`SELECT %s FROM {%s} WHERE %s ORDER BY id LIMIT %d`, cols, Table, where, r.opts.BatchSize)
+	}
+	return fmt.Sprintf(`SELECT %s FROM {%s} WHERE %s ORDER BY id LIMIT %d FOR UPDATE SKIP LOCKED`,
+		cols, Table, where, r.opts.BatchSize)
+}
+
+// claim locks a batch of due messages and leases them in a transaction of its own
+func (r *Relay) claim(dh dhl.DataHelperLite) (msgs []Message, err error) {
+	if err := dh.BeginManually(); err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err != nil {
+			_ = dh.Rollback()
+		}
+	}()
+
+	now := r.opts.Now().UTC()
+	rows, err := dh.Query(r.claimSQL(), now)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var m Message
+		if err := rows.Scan(&m.ID, &m.Topic, &m.Payload, &m.Attempts, &m.CreatedAt); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		msgs = append(msgs, m)
+	}
+	if err := errors.Join(rows.Err(), rows.Close()); err != nil {
+		return nil, err
+	}
+	if len(msgs) == 0 {
+		return nil, dh.Commit()
+	}
+
+	args := []any{now.Add(r.opts.Lease)}
+	for _, m := range msgs {
+		args = append(args, m.ID)
+	}
+	marks := strings.Repeat(`, ?`, len(msgs))[2:]
+	if _, err := dh.Exec(`UPDATE {`+Table+`} SET available_at = ? WHERE id IN (`+marks+`)`, args...); err != nil {
+		return nil, err
+	}
+	return msgs, dh.Commit()
+}
+
+// settle records the outcome of publishing a message
+func (r *Relay) settle(dh dhl.DataHelperLite, m Message, perr error) error {
+	now := r.opts.Now().UTC()
+	if perr == nil {
+		if r.opts.Delete {
+			_, err := dh.Exec(`DELETE FROM {`+Table+`} WHERE id = ?`, m.ID)
+			return err
+		}
+		_, err := dh.Exec(`UPDATE {`+Table+`} SET published_at = ? WHERE id = ?`, now, m.ID)
+		return err
+	}
+
+	m.Attempts++
+	if m.Attempts < r.opts.MaxAttempts {
+		_, err := dh.Exec(`UPDATE {`+Table+`} SET attempts = ?, available_at = ?, last_error = ? WHERE id = ?`,
+			m.Attempts, now.Add(r.opts.Backoff(m.Attempts)), perr.Error(), m.ID)
+		return err
+	}
+	r.opts.Logger.Warn("outbox message dead-lettered",
+		slog.Int64("id", m.ID),
+		slog.String("topic", m.Topic),
+		slog.Int("attempts", m.Attempts),
+		slog.Any("error", perr),
+	)
+	return r.deadLetter(dh, m, now, perr)
+}
+
+// deadLetter moves a message to the dead-letter table in a transaction
+func (r *Relay) deadLetter(dh dhl.DataHelperLite, m Message, now time.Time, perr error) (err error) {
+	if err := dh.BeginManually(); err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			_ = dh.Rollback()
+		}
+	}()
+	if _, err := dh.Exec(
+		`INSERT INTO {`+DeadLetterTable+`} (id, topic, payload, attempts, created_at, failed_at, last_error) VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		m.ID, m.Topic, m.Payload, m.Attempts, m.CreatedAt, now, perr.Error(),
+	); err != nil {
+		return err
+	}
+	if _, err := dh.Exec(`DELETE FROM {`+Table+`} WHERE id = ?`, m.ID); err != nil {
+		return err
+	}
+	return dh.Commit()
+}
@@ -0,0 +1,36 @@
+package datahelperlite
+
+import (
+	"database/sql"
+	"time"
+
+	dn "github.com/eaglebush/datainfo"
+)
+
+// ConfigurePool applies the connection pool settings of the database info to the database handle.
+//
+// It should be called by DataHelperHandle implementations in Open right after the handle is created.
+// The settings are the MaxOpenConnection, MaxIdleConnection, MaxConnectionLifetime and MaxConnectionIdleTime
+// fields of the database info, set by the datainfo options of the same names or by a configuration file:
+//
+//	di := dn.New(dn.ConnectionString(dsn), dn.MaxOpenConnection(20), dn.MaxConnectionLifetime(int(30*time.Minute)))
+//
+// Unset (nil) settings keep the database/sql defaults. MaxConnectionLifetime and MaxConnectionIdleTime
+// are durations in nanoseconds, the same unit as time.Duration.
+func ConfigurePool(db *sql.DB, di *dn.DataInfo) {
+	if db == nil || di == nil {
+		return
+	}
+	if di.MaxOpenConnection != nil {
+		db.SetMaxOpenConns(*di.MaxOpenConnection)
+	}
+	if di.MaxIdleConnection != nil {
+		db.SetMaxIdleConns(*di.MaxIdleConnection)
+	}
+	if di.MaxConnectionLifetime != nil {
+		db.SetConnMaxLifetime(time.Duration(*di.MaxConnectionLifetime))
+	}
+	if di.MaxConnectionIdleTime != nil {
+		db.SetConnMaxIdleTime(time.Duration(*di.MaxConnectionIdleTime))
+	}
+}
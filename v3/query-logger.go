@@ -0,0 +1,319 @@
+package datahelperlite
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"log/slog"
+	"reflect"
+	"regexp"
+	"strings"
+	"time"
+)
+
+const redacted = `[REDACTED]`
+
+// Secret wraps an argument value so that it is never written to logs.
+//
+// It is passed to the driver as its underlying value.
+type Secret struct {
+	V any
+}
+
+// Value returns the underlying value for the driver
+func (s Secret) Value() (driver.Value, error) {
+	return driver.DefaultParameterConverter.ConvertValue(s.V)
+}
+
+// String hides the underlying value
+func (s Secret) String() string {
+	return redacted
+}
+
+// LogValue hides the underlying value from slog
+func (s Secret) LogValue() slog.Value {
+	return slog.StringValue(redacted)
+}
+
+// RedactPolicy selects the argument values that are redacted in logs.
+//
+// Secret values are always redacted.
+type RedactPolicy struct {
+	Columns []string                        // Column names, case-insensitive, whose values are redacted. Values whose column cannot be inferred are redacted too.
+	Types   []reflect.Type                  // Types whose values are redacted
+	Func    func(column string, v any) bool // Custom check. The column is empty when it cannot be inferred.
+}
+
+// redactor is the compiled form of a RedactPolicy
+type redactor struct {
+	columns map[string]bool
+	types   map[reflect.Type]bool
+	fn      func(string, any) bool
+}
+
+func newRedactor(p *RedactPolicy) *redactor {
+	r := &redactor{
+		columns: make(map[string]bool),
+		types:   make(map[reflect.Type]bool),
+	}
+	if p == nil {
+		return r
+	}
+	for _, c := range p.Columns {
+		r.columns[strings.ToLower(c)] = true
+	}
+	for _, t := range p.Types {
+		r.types[t] = true
+	}
+	r.fn = p.Func
+	return r
+}
+
+// value returns the loggable form of an argument
+func (r *redactor) value(column string, v any) any {
+	if na, ok := v.(sql.NamedArg); ok {
+		if column == "" {
+			column = na.Name
+		}
+		v = na.Value
+	}
+	switch v.(type) {
+	case Secret, *Secret:
+		return redacted
+	}
+	if len(r.columns) > 0 && (column == "" || r.columns[strings.ToLower(unquoteIdent(column))]) {
+		// A value whose column is unknown may belong to one of the columns
+		return redacted
+	}
+	if v != nil && r.types[reflect.TypeOf(v)] {
+		return redacted
+	}
+	if r.fn != nil && r.fn(column, v) {
+		return redacted
+	}
+	return v
+}
+
+// args returns the loggable form of the arguments, matching them to columns
+func (r *redactor) args(columns []string, args []any) []any {
+	out := make([]any, len(args))
+	for i, a := range args {
+		col := ""
+		if i < len(columns) {
+			col = columns[i]
+		}
+		out[i] = r.value(col, a)
+	}
+	return out
+}
+
+// QueryLogOptions configures QueryLogger
+type QueryLogOptions struct {
+	Level         slog.Leveler  // Level of regular statement logs. The default is slog.LevelDebug.
+	SlowThreshold time.Duration // Statements taking at least this long are logged at WARN. Zero disables it.
+	Redact        *RedactPolicy // Argument redaction policy
+	OmitArgs      bool          // Do not log arguments at all
+	Fingerprint   bool          // Add the statement fingerprint (see Fingerprint) to each record
+}
+
+// loggedMethods are the operations written by QueryLogger
+var loggedMethods = map[string]bool{
+	"Begin":           true,
+	"BeginManually":   true,
+	"Commit":          true,
+	"Rollback":        true,
+	"Exec":            true,
+	"Exists":          true,
+	"ExistsExt":       true,
+	"Next":            true,
+	"Query":           true,
+	"QueryArray":      true,
+	"QueryRow":        true,
+	"UpsertReturning": true,
+}
+
+// QueryLogger returns an interceptor that logs helper operations with slog.
+//
+// Each record has the method, the statement, the duration, the transaction id, the rows affected by Exec
+// and the error. Failed operations are logged at ERROR, except when no rows were found
+// or a deferred rollback finds no transaction.
+func QueryLogger(logger *slog.Logger, opts QueryLogOptions) Interceptor {
+	if logger == nil {
+		logger = slog.Default()
+	}
+	if opts.Level == nil {
+		opts.Level = slog.LevelDebug
+	}
+	rd := newRedactor(opts.Redact)
+	return func(op *Operation, next Invoker) error {
+		if !loggedMethods[op.Method] {
+			return next(op)
+		}
+		start := time.Now()
+		err := next(op)
+		elapsed := time.Since(start)
+
+		level := opts.Level.Level()
+		msg := "query"
+		slow := opts.SlowThreshold > 0 && elapsed >= opts.SlowThreshold
+		switch {
+		case err != nil && !quietError(op.Method, err):
+			level, msg = slog.LevelError, "query failed"
+		case slow:
+			level, msg = slog.LevelWarn, "slow query"
+		}
+		ctx := op.Context
+		if ctx == nil {
+			ctx = context.Background()
+		}
+		if !logger.Enabled(ctx, level) {
+			return err
+		}
+
+		attrs := make([]slog.Attr, 0, 8)
+		attrs = append(attrs, slog.String("method", op.Method))
+		switch {
+		case op.SQL != "" && slow:
+			attrs = append(attrs, slog.String("sql", normalizeSQL(op.SQL)))
+		case op.SQL != "":
+			attrs = append(attrs, slog.String("sql", op.SQL))
+		case op.Table != "":
+			attrs = append(attrs, slog.String("table", op.Table))
+		}
+		if op.SQL != "" && opts.Fingerprint {
+			attrs = append(attrs, slog.String("fingerprint", Fingerprint(op.SQL)))
+		}
+		if !opts.OmitArgs {
+			switch {
+			case op.Method == "ExistsExt":
+				filters := make([]any, len(op.Filters))
+				for i, f := range op.Filters {
+					filters[i] = f.Name + " " + f.Operator + " " + slogText(rd.value(f.Name, f.Value))
+				}
+				attrs = append(attrs, slog.Any("filters", filters))
+			case op.Method == "UpsertReturning":
+				attrs = append(attrs, slog.Any("args", rd.args(op.Columns, op.Args)))
+			case len(op.Args) > 0:
+				attrs = append(attrs, slog.Any("args", rd.args(placeholderColumns(op.SQL), op.Args)))
+			}
+		}
+		attrs = append(attrs, slog.Duration("duration", elapsed))
+		if op.Method == "Exec" && err == nil {
+			attrs = append(attrs, slog.Int64("rows_affected", op.RowsAffected))
+		}
+		if op.TxID != "" {
+			attrs = append(attrs, slog.String("tx", op.TxID))
+		}
+		if err != nil {
+			attrs = append(attrs, slog.String("error", err.Error()))
+		}
+		logger.LogAttrs(ctx, level, msg, attrs...)
+		return err
+	}
+}
+
+// quietError reports errors that are expected in normal use, such as a deferred rollback after commit
+func quietError(method string, err error) bool {
+	switch ClassifyError(err) {
+	case ErrorClassNoRows:
+		return true
+	case ErrorClassTx:
+		return method == "Rollback"
+	}
+	return false
+}
+
+func slogText(v any) string {
+	return slog.AnyValue(v).String()
+}
+
+var (
+	insertColumnsRx = regexp.MustCompile(`(?is)^\s*insert\s+into\s+[^\s(]+\s*\(([^)]*)\)\s*values\s*`)
+	compareColumnRx = regexp.MustCompile(`(?i)([a-z_][a-z0-9_$]*|\[[^\]]+\]|"[^"]+"|` + "`[^`]+`" + `)\s*(=|<>|!=|<=|>=|<|>|\s+like|\s+in\s*\()\s*$`)
+)
+
+// placeholderColumns infers the column of each ? placeholder of a statement.
+//
+// Placeholders in the VALUES tuples of an INSERT take the column of their slot in the tuple, and other
+// placeholders the column of a comparison such as col = ?. An empty string is returned for placeholders
+// where the column cannot be inferred.
+func placeholderColumns(query string) []string {
+	var (
+		insertCols []string
+		values     = -1 // offset of the VALUES tuples, -1 when there are none
+	)
+	if m := insertColumnsRx.FindStringSubmatchIndex(query); m != nil {
+		for _, c := range strings.Split(query[m[2]:m[3]], ",") {
+			insertCols = append(insertCols, strings.TrimSpace(c))
+		}
+		values = m[1]
+	}
+	var (
+		cols        []string
+		pos         int
+		depth, slot int
+	)
+	for _, t := range lexSQL(query) {
+		start := pos
+		pos += len(t.text)
+		if values >= 0 && start >= values {
+			switch {
+			case t.kind == tokSpace || t.kind == tokComment:
+			case t.text == "(":
+				if depth == 0 {
+					slot = 0
+				}
+				depth++
+			case t.text == ")" && depth > 0:
+				depth--
+			case t.text == "," && depth == 1:
+				slot++
+			case depth == 0 && t.text != ",":
+				// The tuples end, as at ON CONFLICT or ON DUPLICATE KEY UPDATE
+				values = -1
+			}
+		}
+		if t.kind != tokPlaceholder {
+			continue
+		}
+		col := ""
+		switch {
+		case values >= 0 && depth > 0:
+			if slot < len(insertCols) {
+				col = insertCols[slot]
+			}
+		default:
+			if m := compareColumnRx.FindStringSubmatch(query[max(0, start-128):start]); m != nil {
+				col = m[1]
+			}
+		}
+		cols = append(cols, col)
+	}
+	return cols
+}
+
+// normalizeSQL collapses runs of whitespace outside of quoted text into single spaces
+func normalizeSQL(query string) string {
+	var sb strings.Builder
+	sb.Grow(len(query))
+	for _, t := range lexSQL(strings.TrimSpace(query)) {
+		if t.kind == tokSpace {
+			sb.WriteByte(' ')
+			continue
+		}
+		sb.WriteString(t.text)
+	}
+	return sb.String()
+}
+
+func unquoteIdent(id string) string {
+	if len(id) >= 2 {
+		switch {
+		case id[0] == '[' && id[len(id)-1] == ']',
+			id[0] == '"' && id[len(id)-1] == '"',
+			id[0] == '`' && id[len(id)-1] == '`':
+			return id[1 : len(id)-1]
+		}
+	}
+	return id
+}
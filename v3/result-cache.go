@@ -0,0 +1,478 @@
+package datahelperlite
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"database/sql/driver"
+	"encoding/hex"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+)
+
+// CacheStore stores cached query results. Implementations must be safe for concurrent use.
+type CacheStore interface {
+	Get(key string) (any, bool)                                // Get a live entry
+	Set(key string, val any, ttl time.Duration, tags []string) // Store an entry for a time with invalidation tags
+	InvalidateTags(tags ...string)                             // Remove the entries having any of the tags
+}
+
+// ResultCacheStats are the statistics of a result cache
+type ResultCacheStats struct {
+	Hits          uint64 // Reads served from the cache
+	Misses        uint64 // Reads that went to the database
+	Invalidations uint64 // Writes that invalidated tags
+}
+
+// ResultCache caches the results of read queries made through helpers returned by Cached.
+//
+// Results are keyed by the statement, the values of its arguments, the handle and its schema, and the tenant
+// of the context given to Acquire (see WithTenant), so that the cache may come before or after Tenants
+// and be shared by helpers of several databases. They are tagged
+// with the tables the statement reads, or with explicit tags, and writes through the same helper chain
+// invalidate the tags of the tables they touch. Reads inside a transaction are never cached.
+type ResultCache struct {
+	store CacheStore
+	mu    sync.Mutex
+	stats ResultCacheStats
+	gen   uint64 // incremented by invalidations, so that reads running across one do not store stale results
+}
+
+// NewResultCache creates a result cache. A nil store is an in-memory LRU store of 1024 entries.
+func NewResultCache(store CacheStore) *ResultCache {
+	if store == nil {
+		store = NewLRUStore(1024)
+	}
+	return &ResultCache{store: store}
+}
+
+// Stats returns the statistics of the cache
+func (rc *ResultCache) Stats() ResultCacheStats {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	return rc.stats
+}
+
+// Invalidate removes the results tagged with any of the tags. Table tags are lower-cased table names without schema.
+func (rc *ResultCache) Invalidate(tags ...string) {
+	rc.mu.Lock()
+	rc.gen++
+	rc.mu.Unlock()
+	rc.store.InvalidateTags(tags...)
+}
+
+type txTagsKey struct{}
+
+// Interceptor returns an interceptor that serves reads of Cached helpers from the cache and invalidates tags on writes
+func (rc *ResultCache) Interceptor() Interceptor {
+	return func(op *Operation, next Invoker) error {
+		switch op.Method {
+		case "QueryArray", "Exists":
+			if op.CacheTTL <= 0 || op.TxID != "" {
+				return next(op)
+			}
+			return rc.read(op, next)
+		case "Exec", "UpsertReturning":
+			err := next(op)
+			var tags []string
+			if op.Method == "Exec" {
+				_, tags = statementTables(op.SQL)
+			} else {
+				tags = []string{tableTag(op.Table)}
+			}
+			if len(tags) == 0 {
+				return err
+			}
+			rc.invalidate(tags)
+			if op.TxID != "" {
+				// Readers may cache what they see before the commit, so invalidate again after it
+				pending, _ := op.Value(txTagsKey{}).([]string)
+				op.SetValue(txTagsKey{}, append(pending, tags...))
+			}
+			return err
+		case "Commit":
+			err := next(op)
+			if pending, ok := op.Value(txTagsKey{}).([]string); ok && err == nil {
+				rc.invalidate(pending)
+				op.SetValue(txTagsKey{}, nil)
+			}
+			return err
+		case "Rollback":
+			err := next(op)
+			op.SetValue(txTagsKey{}, nil)
+			return err
+		}
+		return next(op)
+	}
+}
+
+func (rc *ResultCache) invalidate(tags []string) {
+	rc.mu.Lock()
+	rc.gen++
+	rc.stats.Invalidations++
+	rc.mu.Unlock()
+	rc.store.InvalidateTags(tags...)
+}
+
+func (rc *ResultCache) read(op *Operation, next Invoker) error {
+	tenant, _ := TenantID(op.Context)
+	key, ok := cacheKey(op.Method, handleKey(op.Handle), tenant, op.SQL, op.Args)
+	if !ok {
+		return next(op)
+	}
+
+	if val, ok := rc.store.Get(key); ok {
+		switch v := val.(type) {
+		case bool:
+			op.Exists = v
+			rc.hit()
+			return nil
+		case reflect.Value:
+			if out := reflect.ValueOf(op.Out); out.Kind() == reflect.Pointer && out.Elem().Type() == v.Type() {
+				out.Elem().Set(copySlice(v))
+				rc.hit()
+				return nil
+			}
+		}
+	}
+
+	rc.mu.Lock()
+	rc.stats.Misses++
+	gen := rc.gen
+	rc.mu.Unlock()
+	if err := next(op); err != nil {
+		return err
+	}
+
+	tags := op.CacheTags
+	if len(tags) == 0 {
+		tags, _ = statementTables(op.SQL)
+	}
+	var val any
+	switch op.Method {
+	case "Exists":
+		val = op.Exists
+	case "QueryArray":
+		if out := reflect.ValueOf(op.Out); out.Kind() == reflect.Pointer && out.Elem().Kind() == reflect.Slice {
+			val = copySlice(out.Elem())
+		}
+	}
+	if val == nil {
+		return nil
+	}
+	// Invalidations increment the generation before removing entries, so a result stored under
+	// the lock with an unchanged generation is either fresh or removed by the invalidation
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	if rc.gen == gen {
+		rc.store.Set(key, val, op.CacheTTL, tags)
+	}
+	return nil
+}
+
+func (rc *ResultCache) hit() {
+	rc.mu.Lock()
+	rc.stats.Hits++
+	rc.mu.Unlock()
+}
+
+// copySlice returns a shallow copy of a slice so that callers cannot change what is cached
+func copySlice(v reflect.Value) reflect.Value {
+	if v.IsNil() {
+		return reflect.Zero(v.Type())
+	}
+	c := reflect.MakeSlice(v.Type(), v.Len(), v.Len())
+	reflect.Copy(c, v)
+	return c
+}
+
+// cacheKey returns the key of a read. Comments and spacing are left out, so that tagged statements
+// share their results, while placeholders are kept, since $1 and $2 differ where their fingerprints do not.
+// It reports false when an argument has no value to key on.
+func cacheKey(method, handle, tenant, sql string, args []any) (string, bool) {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\x00%s\x00%s\x00", method, handle, tenant)
+	for _, t := range lexSQL(sql) {
+		switch t.kind {
+		case tokSpace, tokComment:
+			continue
+		}
+		fmt.Fprintf(h, "%s\x00", t.text)
+	}
+	h.Write([]byte{0})
+	for _, a := range args {
+		v, ok := argValue(a)
+		if !ok {
+			return "", false
+		}
+		fmt.Fprintf(h, "%T:%#v\x00", v, v)
+	}
+	return hex.EncodeToString(h.Sum(nil)), true
+}
+
+// handleKey identifies the database of a handle in cache keys: the handle itself, since {table}
+// placeholders are resolved by the helper, and the schema they are resolved with
+func handleKey(h DataHelperHandle) string {
+	if h == nil {
+		return ""
+	}
+	schema := ""
+	if di := h.DI(); di != nil && di.Schema != nil {
+		schema = *di.Schema
+	}
+	return fmt.Sprintf("%T:%p/%s", h, h, schema)
+}
+
+// argValue returns the value an argument is sent to the database as: the value of a driver.Valuer,
+// and what pointers point to rather than their address
+func argValue(a any) (any, bool) {
+	for range 8 {
+		if v, ok := a.(driver.Valuer); ok {
+			rv := reflect.ValueOf(a)
+			if rv.Kind() == reflect.Pointer && rv.IsNil() {
+				return nil, true
+			}
+			val, err := v.Value()
+			return val, err == nil
+		}
+		rv := reflect.ValueOf(a)
+		if rv.Kind() != reflect.Pointer {
+			return a, true
+		}
+		if rv.IsNil() {
+			return nil, true
+		}
+		a = rv.Elem().Interface()
+	}
+	return nil, false
+}
+
+// cachedHelper is a view of a wrapped helper whose reads are cached
+type cachedHelper struct {
+	*wrappedHelper
+	ttl  time.Duration
+	tags []string
+}
+
+// Cached returns a view of a helper whose QueryArray and Exists results are kept by a ResultCache for the ttl.
+//
+// The helper must have been wrapped with the Interceptor of a ResultCache. Results are tagged with the
+// tables the statement reads unless tags are given. Helpers that were not created by Wrap are returned as they are.
+func Cached(dh DataHelperLite, ttl time.Duration, tags ...string) DataHelperLite {
+	switch w := dh.(type) {
+	case *wrappedHelper:
+		return &cachedHelper{wrappedHelper: w, ttl: ttl, tags: tags}
+	case *cachedHelper:
+		return &cachedHelper{wrappedHelper: w.wrappedHelper, ttl: ttl, tags: tags}
+	}
+	return dh
+}
+
+func (c *cachedHelper) Exists(sqlWithParams string, args ...any) (bool, error) {
+	op := &Operation{Method: "Exists", SQL: sqlWithParams, Args: args, CacheTTL: c.ttl, CacheTags: c.tags}
+	err := c.invoke(op, func(op *Operation) error {
+		var err error
+		op.Exists, err = c.dh.Exists(op.SQL, op.Args...)
+		return err
+	})
+	return op.Exists, err
+}
+
+func (c *cachedHelper) QueryArray(sql string, out any, args ...any) error {
+	op := &Operation{Method: "QueryArray", SQL: sql, Args: args, Out: out, CacheTTL: c.ttl, CacheTags: c.tags}
+	return c.invoke(op, func(op *Operation) error {
+		return c.dh.QueryArray(op.SQL, op.Out, op.Args...)
+	})
+}
+
+// statementTables returns the lower-cased names, without schema, of the tables a statement reads and writes
+func statementTables(sql string) (read, written []string) {
+	var words []token
+	for _, t := range lexSQL(sql) {
+		switch t.kind {
+		case tokSpace, tokComment:
+			continue
+		}
+		words = append(words, t)
+	}
+	seen := [2]map[string]bool{{}, {}}
+	add := func(list *[]string, i int) {
+		name := qualifiedName(words, i)
+		idx := 0
+		if list == &written {
+			idx = 1
+		}
+		if name == "" || seen[idx][name] {
+			return
+		}
+		seen[idx][name] = true
+		*list = append(*list, name)
+	}
+	for i := 0; i < len(words); i++ {
+		if words[i].kind != tokWord {
+			continue
+		}
+		switch strings.ToLower(words[i].text) {
+		case "from", "join":
+			if i > 0 && strings.EqualFold(words[i-1].text, "delete") {
+				add(&written, i+1)
+				continue
+			}
+			add(&read, i+1)
+			// FROM a, b
+			for j := i + 2; j+1 < len(words) && words[j].text == ","; j += 2 {
+				add(&read, j+1)
+			}
+		case "into":
+			add(&written, i+1)
+		case "update":
+			add(&written, i+1)
+		case "truncate":
+			if i+1 < len(words) && strings.EqualFold(words[i+1].text, "table") {
+				i++
+			}
+			add(&written, i+1)
+		}
+	}
+	return read, written
+}
+
+// qualifiedName returns the table tag of the possibly schema-qualified name starting at i
+func qualifiedName(words []token, i int) string {
+	if i < len(words) && words[i].text == "{" {
+		// {table} placeholder of InterpolateTable
+		i++
+	}
+	last := ""
+	for ; i < len(words); i += 2 {
+		t := words[i]
+		if t.kind != tokWord && t.kind != tokQuotedIdent {
+			break
+		}
+		last = t.text
+		if i+1 >= len(words) || words[i+1].text != "." {
+			break
+		}
+	}
+	if last == "" {
+		return ""
+	}
+	switch strings.ToLower(last) {
+	case "select", "lateral", "only", "set", "table":
+		return ""
+	}
+	return tableTag(last)
+}
+
+// tableTag returns the cache tag of a table name
+func tableTag(name string) string {
+	name = strings.Trim(name, "{}")
+	if i := strings.LastIndexByte(name, '.'); i >= 0 {
+		name = name[i+1:]
+	}
+	return strings.ToLower(unquoteIdent(name))
+}
+
+// LRUStore is an in-memory CacheStore that evicts the least recently used entries
+type LRUStore struct {
+	mu       sync.Mutex
+	capacity int
+	ll       list.List // of *lruEntry, most recent first
+	items    map[string]*list.Element
+	tags     map[string]map[string]struct{} // tag to keys
+	now      func() time.Time
+}
+
+type lruEntry struct {
+	key     string
+	val     any
+	expires time.Time
+	tags    []string
+}
+
+// NewLRUStore creates an in-memory store of up to capacity entries
+func NewLRUStore(capacity int) *LRUStore {
+	if capacity <= 0 {
+		capacity = 1024
+	}
+	return &LRUStore{
+		capacity: capacity,
+		items:    make(map[string]*list.Element),
+		tags:     make(map[string]map[string]struct{}),
+		now:      time.Now,
+	}
+}
+
+// Get returns a live entry
+func (s *LRUStore) Get(key string) (any, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	el, ok := s.items[key]
+	if !ok {
+		return nil, false
+	}
+	e := el.Value.(*lruEntry)
+	if !s.now().Before(e.expires) {
+		s.remove(el)
+		return nil, false
+	}
+	s.ll.MoveToFront(el)
+	return e.val, true
+}
+
+// Set stores an entry
+func (s *LRUStore) Set(key string, val any, ttl time.Duration, tags []string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if el, ok := s.items[key]; ok {
+		s.remove(el)
+	}
+	e := &lruEntry{key: key, val: val, expires: s.now().Add(ttl), tags: tags}
+	s.items[key] = s.ll.PushFront(e)
+	for _, t := range tags {
+		keys, ok := s.tags[t]
+		if !ok {
+			keys = make(map[string]struct{})
+			s.tags[t] = keys
+		}
+		keys[key] = struct{}{}
+	}
+	for s.ll.Len() > s.capacity {
+		s.remove(s.ll.Back())
+	}
+}
+
+// InvalidateTags removes the entries having any of the tags
+func (s *LRUStore) InvalidateTags(tags ...string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, t := range tags {
+		for key := range s.tags[t] {
+			if el, ok := s.items[key]; ok {
+				s.remove(el)
+			}
+		}
+	}
+}
+
+// Len returns the number of entries, including expired ones not yet removed
+func (s *LRUStore) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.ll.Len()
+}
+
+func (s *LRUStore) remove(el *list.Element) {
+	e := s.ll.Remove(el).(*lruEntry)
+	delete(s.items, e.key)
+	for _, t := range e.tags {
+		if keys, ok := s.tags[t]; ok {
+			delete(keys, e.key)
+			if len(keys) == 0 {
+				delete(s.tags, t)
+			}
+		}
+	}
+}
@@ -0,0 +1,194 @@
+package datahelperlite
+
+import (
+	"database/sql"
+	"errors"
+	"log/slog"
+	"sync/atomic"
+	"time"
+
+	dn "github.com/eaglebush/datainfo"
+)
+
+// ReplicaPolicy selects how a replica is picked for read operations
+type ReplicaPolicy uint8
+
+// Replica policies
+const (
+	RoundRobin       ReplicaPolicy = 0 // Cycle through healthy replicas
+	LeastConnections ReplicaPolicy = 1 // Pick the healthy replica with the least connections in use
+)
+
+// RoutingOption configures a RoutingHandle
+type RoutingOption func(rh *RoutingHandle)
+
+// RoutingHandle wraps one primary and zero or more replica handles.
+//
+// It satisfies DataHelperHandle by delegating to the primary, so it can be
+// registered with SetHandler and passed to Acquire like any other handle.
+// Helpers wrapped by Route send reads to a replica and everything else to the primary.
+type RoutingHandle struct {
+	primary   DataHelperHandle
+	replicas  []DataHelperHandle
+	policy    ReplicaPolicy
+	rywWindow time.Duration
+	logger    *slog.Logger
+	counter   atomic.Uint64
+}
+
+// Errors
+var (
+	ErrRoutingNoPrimary error = errors.New("routing handle has no primary")
+)
+
+// WithReplicaPolicy sets the replica selection policy. The default is RoundRobin.
+func WithReplicaPolicy(p ReplicaPolicy) RoutingOption {
+	return func(rh *RoutingHandle) {
+		rh.policy = p
+	}
+}
+
+// WithReadYourWrites pins the reads of a routed helper to the primary for the duration after one of its writes.
+func WithReadYourWrites(window time.Duration) RoutingOption {
+	return func(rh *RoutingHandle) {
+		rh.rywWindow = window
+	}
+}
+
+// WithRoutingLogger sets the logger of replicas that routed helpers cannot acquire. The default is slog.Default.
+func WithRoutingLogger(logger *slog.Logger) RoutingOption {
+	return func(rh *RoutingHandle) {
+		rh.logger = logger
+	}
+}
+
+// NewRoutingHandle creates a routing handle over a primary and its replicas
+func NewRoutingHandle(primary DataHelperHandle, replicas []DataHelperHandle, opts ...RoutingOption) *RoutingHandle {
+	rh := &RoutingHandle{
+		primary:  primary,
+		replicas: replicas,
+	}
+	for _, o := range opts {
+		if o == nil {
+			continue
+		}
+		o(rh)
+	}
+	if rh.logger == nil {
+		rh.logger = slog.Default()
+	}
+	return rh
+}
+
+// Open opens the primary handle. Replicas are opened with their own DataInfo.
+func (rh *RoutingHandle) Open(di *dn.DataInfo) error {
+	if rh.primary == nil {
+		return ErrRoutingNoPrimary
+	}
+	return rh.primary.Open(di)
+}
+
+// Ping pings the primary handle
+func (rh *RoutingHandle) Ping() error {
+	if rh.primary == nil {
+		return ErrRoutingNoPrimary
+	}
+	return rh.primary.Ping()
+}
+
+// DB returns the primary database handle
+func (rh *RoutingHandle) DB() *sql.DB {
+	if rh.primary == nil {
+		return nil
+	}
+	return rh.primary.DB()
+}
+
+// DI returns the primary database info
+func (rh *RoutingHandle) DI() *dn.DataInfo {
+	if rh.primary == nil {
+		return nil
+	}
+	return rh.primary.DI()
+}
+
+// Close closes the primary and all replicas. The first error encountered is returned.
+func (rh *RoutingHandle) Close() error {
+	var err error
+	for _, r := range rh.replicas {
+		if r == nil {
+			continue
+		}
+		if cerr := r.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	if rh.primary != nil {
+		if cerr := rh.primary.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// Err retrieves the last primary handle error
+func (rh *RoutingHandle) Err() error {
+	if rh.primary == nil {
+		return ErrRoutingNoPrimary
+	}
+	return rh.primary.Err()
+}
+
+// Stats returns the pool statistics of the primary handle
+func (rh *RoutingHandle) Stats() sql.DBStats {
+	if rh.primary == nil {
+		return sql.DBStats{}
+	}
+	return rh.primary.Stats()
+}
+
+// Primary returns the primary handle
+func (rh *RoutingHandle) Primary() DataHelperHandle {
+	return rh.primary
+}
+
+// Replicas returns the replica handles
+func (rh *RoutingHandle) Replicas() []DataHelperHandle {
+	return rh.replicas
+}
+
+// Replica picks a healthy replica by the configured policy.
+//
+// The primary is returned when there are no healthy replicas.
+func (rh *RoutingHandle) Replica() DataHelperHandle {
+	healthy := make([]DataHelperHandle, 0, len(rh.replicas))
+	for _, r := range rh.replicas {
+		if isHealthy(r) {
+			healthy = append(healthy, r)
+		}
+	}
+	if len(healthy) == 0 {
+		return rh.primary
+	}
+	switch rh.policy {
+	case LeastConnections:
+		pick := healthy[0]
+		least := pick.Stats().InUse
+		for _, r := range healthy[1:] {
+			if inUse := r.Stats().InUse; inUse < least {
+				pick, least = r, inUse
+			}
+		}
+		return pick
+	default:
+		n := rh.counter.Add(1) - 1
+		return healthy[n%uint64(len(healthy))]
+	}
+}
+
+func isHealthy(h DataHelperHandle) bool {
+	if isReallyNil(h) {
+		return false
+	}
+	return h.DB() != nil && h.Err() == nil
+}
@@ -0,0 +1,211 @@
+package datahelperlite
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"time"
+)
+
+// routedHelper sends reads to a replica helper and everything else to a primary helper
+type routedHelper struct {
+	primary   DataHelperLite
+	replica   DataHelperLite
+	rh        *RoutingHandle
+	inTx      bool
+	lastWrite time.Time // last successful write of this helper, for the read-your-writes window
+}
+
+// Route wraps a helper so that it splits reads and writes when acquired with a RoutingHandle.
+//
+// Query, QueryRow, QueryArray, Exists and ExistsExt go to a healthy replica.
+// Exec, UpsertReturning, Next and all operations inside a transaction go to the primary.
+// After a successful write, the reads of the helper stay on the primary for the read-your-writes
+// window of the handle; other helpers acquired with the handle keep reading from replicas.
+// When acquired with any other handle, all operations go to that handle.
+func Route(dh DataHelperLite) DataHelperLite {
+	if dh == nil {
+		return nil
+	}
+	return &routedHelper{
+		primary: dh,
+	}
+}
+
+func (r *routedHelper) NewHelper() DataHelperLite {
+	return Route(r.primary.NewHelper())
+}
+
+// Acquire acquires the primary helper and, with a RoutingHandle, a replica helper. The replica helper of a
+// previous Acquire is released first. A replica that cannot be acquired is logged and the reads go to the primary.
+func (r *routedHelper) Acquire(ctx context.Context, h DataHelperHandle) error {
+	if r.replica != nil {
+		_ = r.replica.Release()
+	}
+	r.rh = nil
+	r.replica = nil
+	rh, ok := h.(*RoutingHandle)
+	if !ok {
+		return r.primary.Acquire(ctx, h)
+	}
+	if err := r.primary.Acquire(ctx, rh.Primary()); err != nil {
+		return err
+	}
+	r.rh = rh
+	if rep := rh.Replica(); rep != rh.Primary() {
+		replica := r.primary.NewHelper()
+		if err := replica.Acquire(ctx, rep); err != nil {
+			_ = replica.Release()
+			rh.logger.Warn("replica not acquired, reading from the primary", slog.Any("error", err))
+			return nil
+		}
+		r.replica = replica
+	}
+	return nil
+}
+
+// reader returns the helper that should serve a read
+func (r *routedHelper) reader() DataHelperLite {
+	if r.inTx || r.replica == nil || r.pinned() {
+		return r.primary
+	}
+	return r.replica
+}
+
+// wrote records a successful write for the read-your-writes window
+func (r *routedHelper) wrote(err error) {
+	if err == nil && r.rh != nil && r.rh.rywWindow > 0 {
+		r.lastWrite = time.Now()
+	}
+}
+
+// pinned reports if the reads of the helper must stay on the primary
+func (r *routedHelper) pinned() bool {
+	return !r.lastWrite.IsZero() && time.Since(r.lastWrite) < r.rh.rywWindow
+}
+
+func (r *routedHelper) Begin() error {
+	if err := r.primary.Begin(); err != nil {
+		return err
+	}
+	r.inTx = true
+	return nil
+}
+
+func (r *routedHelper) BeginManually() error {
+	if err := r.primary.BeginManually(); err != nil {
+		return err
+	}
+	r.inTx = true
+	return nil
+}
+
+func (r *routedHelper) Commit() error {
+	err := r.primary.Commit()
+	if err == nil {
+		r.inTx = false
+	}
+	return err
+}
+
+func (r *routedHelper) Rollback() error {
+	err := r.primary.Rollback()
+	r.inTx = false
+	return err
+}
+
+func (r *routedHelper) DatabaseVersion() string {
+	return r.primary.DatabaseVersion()
+}
+
+func (r *routedHelper) Discard(name string) error {
+	return r.primary.Discard(name)
+}
+
+func (r *routedHelper) Escape(fv string) string {
+	return r.primary.Escape(fv)
+}
+
+func (r *routedHelper) Exec(sql string, args ...any) (int64, error) {
+	n, err := r.primary.Exec(sql, args...)
+	r.wrote(err)
+	return n, err
+}
+
+func (r *routedHelper) Exists(sqlWithParams string, args ...any) (bool, error) {
+	return r.reader().Exists(sqlWithParams, args...)
+}
+
+func (r *routedHelper) ExistsExt(tableName string, values []ColumnFilter) (bool, error) {
+	return r.reader().ExistsExt(tableName, values)
+}
+
+func (r *routedHelper) Mark(name string) error {
+	return r.primary.Mark(name)
+}
+
+func (r *routedHelper) Next(serial string, next *int64) error {
+	err := r.primary.Next(serial, next)
+	r.wrote(err)
+	return err
+}
+
+func (r *routedHelper) Now() *time.Time {
+	return r.primary.Now()
+}
+
+func (r *routedHelper) NowUTC() *time.Time {
+	return r.primary.NowUTC()
+}
+
+func (r *routedHelper) Ping() error {
+	return r.primary.Ping()
+}
+
+func (r *routedHelper) Query(sql string, args ...any) (Rows, error) {
+	return r.reader().Query(sql, args...)
+}
+
+func (r *routedHelper) QueryArray(sql string, out any, args ...any) error {
+	return r.reader().QueryArray(sql, out, args...)
+}
+
+func (r *routedHelper) QueryRow(sql string, args ...any) Row {
+	return r.reader().QueryRow(sql, args...)
+}
+
+func (r *routedHelper) Release() error {
+	err := r.primary.Release()
+	if r.replica != nil {
+		err = errors.Join(err, r.replica.Release())
+		r.replica = nil
+	}
+	r.rh = nil
+	r.inTx = false
+	return err
+}
+
+func (r *routedHelper) Save(name string) error {
+	return r.primary.Save(name)
+}
+
+func (r *routedHelper) UpsertReturning(
+	tableName string,
+	insertColumns []string,
+	uniqueColumns []string,
+	updateColumns []string,
+	returnColumns []string,
+	args ...any,
+) (Row, error) {
+	row, err := r.primary.UpsertReturning(tableName, insertColumns, uniqueColumns, updateColumns, returnColumns, args...)
+	r.wrote(err)
+	return row, err
+}
+
+func (r *routedHelper) VendorStatement(key string) string {
+	return r.primary.VendorStatement(key)
+}
+
+func (r *routedHelper) VendorStatements() []string {
+	return r.primary.VendorStatements()
+}
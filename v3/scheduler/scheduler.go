@@ -0,0 +1,370 @@
+// Package scheduler runs tasks on cron schedules across the replicas of a service.
+//
+// Each run of a task takes a named lock (see the lock package) so that a single instance executes it,
+// and is recorded in a run history table keyed by task and scheduled time, so that an instance whose
+// clock is a little late does not run it again. On start, runs missed while no instance was up are
+// detected from the history and, for tasks that ask for it, caught up with a single late run.
+package scheduler
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+
+	dhl "github.com/NarsilWorks-Inc/datahelperlite/v3"
+	"github.com/NarsilWorks-Inc/datahelperlite/v3/lock"
+)
+
+// Table is the logical name of the run history table. Statements write it as a {table} placeholder.
+var Table = `scheduler_runs`
+
+// Run statuses
+const (
+	StatusRunning   = `running`
+	StatusSucceeded = `succeeded`
+	StatusFailed    = `failed`
+)
+
+// Errors
+var (
+	ErrTaskExists error = errors.New(`task is already scheduled`)
+	ErrEmptyName  error = errors.New(`task name is empty`)
+)
+
+// Run describes a run of a task
+type Run struct {
+	Task        string    // Name of the task
+	ScheduledAt time.Time // Time the run was scheduled for
+	Late        bool      // Catching up a run missed while no instance was up
+}
+
+// Func runs a task. The returned error is recorded in the run history.
+type Func func(ctx context.Context, r Run) error
+
+// TaskOptions configures a task
+type TaskOptions struct {
+	CatchUp bool          // Run once on start when runs were missed while no instance was up
+	Timeout time.Duration // Time a run gets before its context is canceled. Zero does not limit it.
+}
+
+// Options configures a Scheduler
+type Options struct {
+	Location *time.Location   // Time zone of the schedules. The default is time.Local.
+	Dialect  dhl.Dialect      // Dialect of the locks. Derived from the handle when empty.
+	Instance string           // Identity of the instance in the run history. The default is the host name with a random suffix.
+	Logger   *slog.Logger     // Logger of runs and missed runs. The default is slog.Default.
+	Now      func() time.Time // Clock. The default is time.Now.
+}
+
+// Scheduler runs tasks on their schedules
+type Scheduler struct {
+	dh     dhl.DataHelperLite
+	handle dhl.DataHelperHandle
+	opts   Options
+
+	mu    sync.Mutex
+	tasks []*task
+	wg    sync.WaitGroup
+}
+
+type task struct {
+	name     string
+	schedule *Schedule
+	fn       Func
+	opts     TaskOptions
+
+	next    time.Time // next run, guarded by the scheduler mutex
+	late    bool      // next is a missed run
+	running bool
+}
+
+// New creates a scheduler that works with helpers created from dh and acquired with a handle
+func New(dh dhl.DataHelperLite, h dhl.DataHelperHandle, opts Options) *Scheduler {
+	if opts.Location == nil {
+		opts.Location = time.Local
+	}
+	if opts.Dialect == "" && h != nil {
+		opts.Dialect = dhl.DialectOf(h.DI())
+	}
+	if opts.Instance == "" {
+		host, _ := os.Hostname()
+		var b [4]byte
+		_, _ = rand.Read(b[:])
+		opts.Instance = host + "-" + hex.EncodeToString(b[:])
+	}
+	if opts.Logger == nil {
+		opts.Logger = slog.Default()
+	}
+	if opts.Now == nil {
+		opts.Now = time.Now
+	}
+	return &Scheduler{dh: dh, handle: h, opts: opts}
+}
+
+// Add schedules a task with a cron expression (see ParseCron). Tasks added while the scheduler runs
+// start with their next scheduled time.
+func (s *Scheduler) Add(name, spec string, fn Func, opts TaskOptions) error {
+	if name == "" {
+		return ErrEmptyName
+	}
+	sched, err := ParseCron(spec)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, t := range s.tasks {
+		if t.name == name {
+			return fmt.Errorf("%w: %s", ErrTaskExists, name)
+		}
+	}
+	s.tasks = append(s.tasks, &task{name: name, schedule: sched, fn: fn, opts: opts})
+	return nil
+}
+
+// Run runs the tasks on their schedules until the context ends, then waits for the running tasks.
+// Runs missed since the last recorded run of each task are detected first.
+func (s *Scheduler) Run(ctx context.Context) error {
+	s.mu.Lock()
+	tasks := append([]*task(nil), s.tasks...)
+	s.mu.Unlock()
+	for _, t := range tasks {
+		s.checkMissed(ctx, t)
+	}
+	defer s.wg.Wait()
+
+	for {
+		wait := s.tick(ctx)
+		// Wake at least every minute so that clock changes do not delay runs for long
+		timer := time.NewTimer(min(wait, time.Minute))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// tick starts the runs that are due and returns the time until the next one
+func (s *Scheduler) tick(ctx context.Context) time.Duration {
+	now := s.opts.Now().In(s.opts.Location)
+	wait := time.Minute
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, t := range s.tasks {
+		if t.next.IsZero() {
+			t.next = t.schedule.Next(now)
+		}
+		if !t.next.After(now) {
+			at, late := t.next, t.late
+			t.next, t.late = t.schedule.Next(now), false
+			if t.running {
+				s.opts.Logger.Warn("scheduled run skipped, previous run still running",
+					slog.String("task", t.name), slog.Time("scheduled_at", at))
+			} else {
+				t.running = true
+				s.wg.Add(1)
+				go func() {
+					defer s.wg.Done()
+					s.execute(ctx, t, Run{Task: t.name, ScheduledAt: at, Late: late})
+					s.mu.Lock()
+					t.running = false
+					s.mu.Unlock()
+				}()
+			}
+		}
+		if !t.next.IsZero() {
+			wait = min(wait, t.next.Sub(now))
+		}
+	}
+	return max(wait, 0)
+}
+
+// execute runs a task under its lock unless another instance already ran it
+func (s *Scheduler) execute(ctx context.Context, t *task, r Run) {
+	log := s.opts.Logger.With(slog.String("task", t.name), slog.Time("scheduled_at", r.ScheduledAt))
+	ran, err := s.runLocked(ctx, t, r)
+	switch {
+	case errors.Is(err, lock.ErrNotAcquired):
+		log.Debug("scheduled run taken by another instance")
+	case err != nil:
+		log.Error("scheduled run failed", slog.Any("error", err))
+	case ran:
+		log.Debug("scheduled run done")
+	}
+}
+
+// runLocked records and runs a task while holding its lock. It reports false when the run was already recorded.
+func (s *Scheduler) runLocked(ctx context.Context, t *task, r Run) (ran bool, err error) {
+	dh := s.dh.NewHelper()
+	if err := dh.Acquire(ctx, s.handle); err != nil {
+		return false, err
+	}
+	defer func() {
+		err = errors.Join(err, dh.Release())
+	}()
+
+	unlock, err := lock.TryLock(ctx, dh, `scheduler:`+t.name, lock.Options{Dialect: s.opts.Dialect, Handle: s.handle})
+	if err != nil {
+		return false, err
+	}
+	defer func() {
+		err = errors.Join(err, unlock())
+	}()
+
+	at := r.ScheduledAt.UTC()
+	done, err := dh.Exists(`SELECT 1 FROM {`+Table+`} WHERE task = ? AND scheduled_at = ?`, t.name, at)
+	if err != nil || done {
+		return false, err
+	}
+	if _, err := dh.Exec(
+		`INSERT INTO {`+Table+`} (task, scheduled_at, instance, started_at, status) VALUES (?, ?, ?, ?, ?)`,
+		t.name, at, s.opts.Instance, s.opts.Now().UTC(), StatusRunning,
+	); err != nil {
+		return false, err
+	}
+
+	runCtx, cancel := ctx, context.CancelFunc(func() {})
+	if t.opts.Timeout > 0 {
+		runCtx, cancel = context.WithTimeout(ctx, t.opts.Timeout)
+	}
+	ferr := safeRun(runCtx, t.fn, r)
+	cancel()
+
+	status, msg := StatusSucceeded, any(nil)
+	if ferr != nil {
+		status, msg = StatusFailed, ferr.Error()
+	}
+	if _, err := dh.Exec(
+		`UPDATE {`+Table+`} SET status = ?, finished_at = ?, error = ? WHERE task = ? AND scheduled_at = ?`,
+		status, s.opts.Now().UTC(), msg, t.name, at,
+	); err != nil {
+		return true, errors.Join(ferr, err)
+	}
+	return true, ferr
+}
+
+// safeRun runs a task, turning a panic into an error
+func safeRun(ctx context.Context, fn Func, r Run) (err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			err = fmt.Errorf("task panicked: %v", p)
+		}
+	}()
+	return fn(ctx, r)
+}
+
+// checkMissed counts the runs of a task scheduled between its last recorded run and now, and sets
+// up the latest of them to run at once if the task catches up
+func (s *Scheduler) checkMissed(ctx context.Context, t *task) {
+	last, err := s.lastRun(ctx, t.name)
+	if err != nil {
+		s.opts.Logger.Warn("run history not read", slog.String("task", t.name), slog.Any("error", err))
+		return
+	}
+	if last.IsZero() {
+		return
+	}
+	now := s.opts.Now().In(s.opts.Location)
+	n, latest := Missed(t.schedule, last.In(s.opts.Location), now)
+	if n == 0 {
+		return
+	}
+	s.opts.Logger.Warn("scheduled runs missed",
+		slog.String("task", t.name),
+		slog.Int("missed", n),
+		slog.Time("last_run", last),
+		slog.Bool("catch_up", t.opts.CatchUp),
+	)
+	if t.opts.CatchUp {
+		s.mu.Lock()
+		t.next, t.late = latest, true
+		s.mu.Unlock()
+	}
+}
+
+// lastRun returns the scheduled time of the latest recorded run of a task, or the zero time if there is none
+func (s *Scheduler) lastRun(ctx context.Context, name string) (last time.Time, err error) {
+	dh := s.dh.NewHelper()
+	if err := dh.Acquire(ctx, s.handle); err != nil {
+		return time.Time{}, err
+	}
+	defer func() {
+		err = errors.Join(err, dh.Release())
+	}()
+	var at dbTime
+	if err := dh.QueryRow(`SELECT MAX(scheduled_at) FROM {`+Table+`} WHERE task = ?`, name).Scan(&at); err != nil {
+		return time.Time{}, err
+	}
+	return time.Time(at), nil
+}
+
+// dbTimeLayouts are the text forms of timestamps, which drivers return for aggregates without a declared
+// type, such as SQLite, or for all timestamps, such as MySQL without parseTime
+var dbTimeLayouts = []string{
+	time.RFC3339Nano,
+	`2006-01-02 15:04:05.999999999-07:00`,
+	`2006-01-02 15:04:05.999999999`,
+	`2006-01-02T15:04:05.999999999`,
+}
+
+// dbTime scans a timestamp given as a time or as text. Text without a zone is in UTC, as the runs are written.
+// NULL scans as the zero time.
+type dbTime time.Time
+
+func (t *dbTime) Scan(src any) error {
+	var text string
+	switch v := src.(type) {
+	case nil:
+		*t = dbTime{}
+		return nil
+	case time.Time:
+		*t = dbTime(v)
+		return nil
+	case string:
+		text = v
+	case []byte:
+		text = string(v)
+	default:
+		return fmt.Errorf("cannot scan %T into a time", src)
+	}
+	for _, layout := range dbTimeLayouts {
+		if v, err := time.ParseInLocation(layout, text, time.UTC); err == nil {
+			*t = dbTime(v)
+			return nil
+		}
+	}
+	return fmt.Errorf("cannot parse %q as a time", text)
+}
+
+// Missed returns the number of times a schedule came due after last and up to now, and the latest of them
+func Missed(sched *Schedule, last, now time.Time) (n int, latest time.Time) {
+	for t := sched.Next(last); !t.IsZero() && !t.After(now); t = sched.Next(t) {
+		n, latest = n+1, t
+	}
+	return n, latest
+}
+
+// DDL returns the statements that create the run history table for a dialect
+func DDL(d dhl.Dialect) []string {
+	ts, text := `TIMESTAMP`, `TEXT`
+	switch d {
+	case dhl.DialectSQLServer:
+		ts, text = `DATETIME2`, `NVARCHAR(MAX)`
+	case dhl.DialectMySQL:
+		ts = `DATETIME(6)`
+	}
+	return []string{
+		fmt.Sprintf(`CREATE TABLE {%s} (task VARCHAR(255) NOT NULL, scheduled_at %s NOT NULL, instance VARCHAR(255) NOT NULL, `+
+			`started_at %s NOT NULL, finished_at %s NULL, status VARCHAR(20) NOT NULL, error %s NULL, PRIMARY KEY (task, scheduled_at))`,
+			Table, ts, ts, ts, text),
+	}
+}
@@ -0,0 +1,228 @@
+package scheduler
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	dhl "github.com/NarsilWorks-Inc/datahelperlite/v3"
+	"github.com/NarsilWorks-Inc/datahelperlite/v3/internal/dhltest"
+)
+
+func TestParseCron(t *testing.T) {
+	from := time.Date(2025, 1, 31, 10, 17, 30, 0, time.UTC) // a Friday
+	for _, c := range []struct {
+		spec string
+		want time.Time
+	}{
+		{"* * * * *", time.Date(2025, 1, 31, 10, 18, 0, 0, time.UTC)},
+		{"*/15 * * * *", time.Date(2025, 1, 31, 10, 30, 0, 0, time.UTC)},
+		{"5,10 9-17 * * *", time.Date(2025, 1, 31, 11, 5, 0, 0, time.UTC)},
+		{"0 0 * * mon-wed", time.Date(2025, 2, 3, 0, 0, 0, 0, time.UTC)},
+		{"0 12 * feb 7", time.Date(2025, 2, 2, 12, 0, 0, 0, time.UTC)},
+		{"0 0 29 2 *", time.Date(2028, 2, 29, 0, 0, 0, 0, time.UTC)},
+		{"0 0 13 * fri", time.Date(2025, 2, 7, 0, 0, 0, 0, time.UTC)},  // either day field
+		{"0 0 13 * */2", time.Date(2025, 2, 13, 0, 0, 0, 0, time.UTC)}, // both day fields, */2 counts as *
+		{"10 10/6 * * *", time.Date(2025, 1, 31, 16, 10, 0, 0, time.UTC)},
+		{"@monthly", time.Date(2025, 2, 1, 0, 0, 0, 0, time.UTC)},
+		{"0 0 30 2 *", time.Time{}},
+	} {
+		s, err := ParseCron(c.spec)
+		if err != nil {
+			t.Errorf("%s: %v", c.spec, err)
+			continue
+		}
+		if got := s.Next(from); !got.Equal(c.want) {
+			t.Errorf("%s: got %v, want %v", c.spec, got, c.want)
+		}
+	}
+
+	for _, spec := range []string{"", "* * * *", "60 * * * *", "* 24 * * *", "* * 0 * *", "*/0 * * * *", "5-1 * * * *", "* * * foo *"} {
+		if _, err := ParseCron(spec); !errors.Is(err, ErrInvalidCron) {
+			t.Errorf("%q: got %v, want ErrInvalidCron", spec, err)
+		}
+	}
+}
+
+func TestDBTime(t *testing.T) {
+	want := time.Date(2025, 1, 31, 10, 15, 0, 500000000, time.UTC)
+	for _, src := range []any{
+		want,
+		"2025-01-31 10:15:00.5+00:00",
+		[]byte("2025-01-31 10:15:00.500000"),
+		"2025-01-31T10:15:00.5Z",
+	} {
+		var got dbTime
+		if err := got.Scan(src); err != nil || !time.Time(got).Equal(want) {
+			t.Errorf("%v: got %v, %v", src, time.Time(got), err)
+		}
+	}
+	var got dbTime
+	if err := got.Scan(nil); err != nil || !time.Time(got).IsZero() {
+		t.Errorf("NULL: got %v, %v", time.Time(got), err)
+	}
+	if err := got.Scan("yesterday"); err == nil {
+		t.Error("no error for text that is not a time")
+	}
+}
+
+func TestMissed(t *testing.T) {
+	s := MustParseCron("@hourly")
+	last := time.Date(2025, 1, 1, 9, 0, 0, 0, time.UTC)
+	n, latest := Missed(s, last, time.Date(2025, 1, 1, 12, 30, 0, 0, time.UTC))
+	if n != 3 || !latest.Equal(time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC)) {
+		t.Errorf("got %d up to %v, want 3 up to 12:00", n, latest)
+	}
+	if n, _ := Missed(s, last, last.Add(59*time.Minute)); n != 0 {
+		t.Errorf("got %d missed before the next run", n)
+	}
+}
+
+// store keeps the lock and run history tables in memory
+type store struct {
+	mu    sync.Mutex
+	locks map[string]bool
+	runs  map[string]string // status by task and scheduled time
+	last  time.Time
+}
+
+func newStore() *store {
+	return &store{locks: map[string]bool{}, runs: map[string]string{}}
+}
+
+func runKey(args []any) string {
+	return args[0].(string) + "@" + args[1].(time.Time).Format(time.RFC3339)
+}
+
+func (st *store) exec(sql string, args ...any) (int64, error) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	switch {
+	case strings.Contains(sql, "{locks}") && strings.HasPrefix(sql, "INSERT"):
+		if st.locks[args[0].(string)] {
+			return 0, errors.New("duplicate key")
+		}
+		st.locks[args[0].(string)] = true
+	case strings.Contains(sql, "{locks}") && strings.Contains(sql, "owner = ?"):
+		delete(st.locks, args[0].(string))
+	case strings.HasPrefix(sql, "INSERT INTO {"+Table+"}"):
+		st.runs[runKey(args)] = args[4].(string)
+	case strings.HasPrefix(sql, "UPDATE {"+Table+"}"):
+		st.runs[runKey(args[3:])] = args[0].(string)
+	}
+	return 1, nil
+}
+
+func (st *store) exists(sql string, args ...any) (bool, error) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if strings.Contains(sql, "{locks}") {
+		return st.locks[args[0].(string)], nil
+	}
+	_, ok := st.runs[runKey(args)]
+	return ok, nil
+}
+
+func (st *store) queryRow(sql string, _ ...any) dhl.Row {
+	if !strings.HasPrefix(sql, "SELECT MAX(scheduled_at)") {
+		return dhltest.ErrRow(errors.New("unexpected query: " + sql))
+	}
+	if st.last.IsZero() {
+		return dhltest.NewRow(nil)
+	}
+	return dhltest.NewRow(st.last)
+}
+
+func newTestScheduler(st *store, now time.Time, log io.Writer) *Scheduler {
+	return New(&dhltest.Helper{OnExec: st.exec, OnExists: st.exists, OnQueryRow: st.queryRow}, nil, Options{
+		Location: time.UTC,
+		Dialect:  dhl.DialectSQLite,
+		Logger:   slog.New(slog.NewTextHandler(log, nil)),
+		Now:      func() time.Time { return now },
+	})
+}
+
+func TestRunsOnceAcrossInstances(t *testing.T) {
+	st := newStore()
+	at := time.Date(2025, 1, 1, 10, 0, 0, 0, time.UTC)
+	var mu sync.Mutex
+	var runs []Run
+	fn := func(_ context.Context, r Run) error {
+		mu.Lock()
+		runs = append(runs, r)
+		mu.Unlock()
+		return nil
+	}
+
+	var instances []*Scheduler
+	for i := range 3 {
+		// Clocks a little apart, all past the scheduled time
+		s := newTestScheduler(st, at.Add(time.Duration(i)*time.Second), io.Discard)
+		if err := s.Add("report", "0 * * * *", fn, TaskOptions{}); err != nil {
+			t.Fatal(err)
+		}
+		s.tasks[0].next = at
+		instances = append(instances, s)
+	}
+	if err := instances[0].Add("report", "@daily", fn, TaskOptions{}); !errors.Is(err, ErrTaskExists) {
+		t.Errorf("got %v, want ErrTaskExists", err)
+	}
+	for _, s := range instances {
+		s.tick(context.Background())
+		s.wg.Wait()
+	}
+
+	if len(runs) != 1 || !runs[0].ScheduledAt.Equal(at) || runs[0].Late {
+		t.Fatalf("got runs %+v, want one on time", runs)
+	}
+	if got := st.runs["report@2025-01-01T10:00:00Z"]; got != StatusSucceeded {
+		t.Errorf("history status %q", got)
+	}
+	if len(st.locks) != 0 {
+		t.Error("lock not released")
+	}
+	if next := instances[0].tasks[0].next; !next.Equal(at.Add(time.Hour)) {
+		t.Errorf("next run at %v", next)
+	}
+}
+
+func TestCatchUp(t *testing.T) {
+	for _, catchUp := range []bool{false, true} {
+		st := newStore()
+		st.last = time.Date(2025, 1, 1, 9, 0, 0, 0, time.UTC)
+		var log bytes.Buffer
+		s := newTestScheduler(st, time.Date(2025, 1, 1, 12, 30, 0, 0, time.UTC), &log)
+		var runs []Run
+		_ = s.Add("rollup", "@hourly", func(_ context.Context, r Run) error {
+			runs = append(runs, r)
+			return errors.New("boom")
+		}, TaskOptions{CatchUp: catchUp})
+
+		s.checkMissed(context.Background(), s.tasks[0])
+		if !strings.Contains(log.String(), "missed=3") {
+			t.Errorf("missed runs not logged: %s", log.String())
+		}
+		s.tick(context.Background())
+		s.wg.Wait()
+
+		if !catchUp {
+			if len(runs) != 0 {
+				t.Errorf("got runs %+v without catch-up", runs)
+			}
+			continue
+		}
+		want := time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC)
+		if len(runs) != 1 || !runs[0].ScheduledAt.Equal(want) || !runs[0].Late {
+			t.Fatalf("got runs %+v, want a late run for 12:00", runs)
+		}
+		if got := st.runs["rollup@2025-01-01T12:00:00Z"]; got != StatusFailed {
+			t.Errorf("history status %q", got)
+		}
+	}
+}
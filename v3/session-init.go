@@ -0,0 +1,174 @@
+package datahelperlite
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// Errors
+var (
+	ErrSessionInit        error = errors.New(`session initialization failed`)
+	ErrConnPinUnsupported error = errors.New(`helper cannot run on a pinned connection`)
+)
+
+// ConnPinner is implemented by helpers that can run all their statements, transactions included, on one connection.
+type ConnPinner interface {
+	// PinConn makes the helper use conn until it is called again. A nil conn makes the helper use its pool again.
+	PinConn(conn *sql.Conn)
+}
+
+// SessionInit are statements that set up a database session, such as SET TIME ZONE or SET XACT_ABORT ON
+type SessionInit struct {
+	Statements []string // Run on the pinned connection in order
+	Reset      []string // Run before the connection goes back to the pool. See SessionInitializer for connections without them.
+}
+
+var (
+	sessionInitsMu sync.Mutex
+	sessionInits   = make(map[DataHelperHandle]SessionInit)
+)
+
+// SetSessionInit sets the session init statements run for every helper acquired with a handle
+func SetSessionInit(h DataHelperHandle, init SessionInit) {
+	sessionInitsMu.Lock()
+	defer sessionInitsMu.Unlock()
+	if len(init.Statements) == 0 {
+		delete(sessionInits, h)
+		return
+	}
+	sessionInits[h] = init
+}
+
+type sessionInitKey struct{}
+
+// WithSessionInit returns a context that adds session init statements to the helpers acquired with it.
+// They run after the statements of the handle.
+func WithSessionInit(ctx context.Context, init SessionInit) context.Context {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	prev, _ := ctx.Value(sessionInitKey{}).(SessionInit)
+	return context.WithValue(ctx, sessionInitKey{}, SessionInit{
+		Statements: append(append([]string(nil), prev.Statements...), init.Statements...),
+		Reset:      append(append([]string(nil), prev.Reset...), init.Reset...),
+	})
+}
+
+type sessionConnKey struct{}
+
+// SessionInitializer returns an interceptor that makes Acquire pin a connection and run the session init
+// statements of the handle (see SetSessionInit) and of the context (see WithSessionInit) on it.
+//
+// Helpers with session init statements must be released: the connection goes back to the pool, after its
+// reset statements, when the helper is released or acquired again, or when the context given to Acquire
+// ends, after which the statements of the helper fail until it is acquired again. Without reset statements,
+// a connection set up by the statements of the handle alone goes back to the pool as it is, since every helper
+// of the handle sets it up the same way; one set up by statements of the context is discarded.
+//
+// Acquire fails with ErrSessionInit when a statement fails, and with ErrConnPinUnsupported when there are
+// statements but the helper does not implement ConnPinner.
+func SessionInitializer() Interceptor {
+	return func(op *Operation, next Invoker) error {
+		switch op.Method {
+		case "Acquire":
+		case "Release":
+			// The helper rolls back first, the reset must not run inside its transaction
+			err := next(op)
+			releaseSession(op)
+			return err
+		default:
+			return next(op)
+		}
+		releaseSession(op)
+
+		ctx := op.Context
+		if ctx == nil {
+			ctx = context.Background()
+		}
+		sessionInitsMu.Lock()
+		init := sessionInits[op.Handle]
+		sessionInitsMu.Unlock()
+		keep := true // the connection may go back to the pool without reset statements
+		if extra, ok := ctx.Value(sessionInitKey{}).(SessionInit); ok {
+			init.Statements = append(append([]string(nil), init.Statements...), extra.Statements...)
+			init.Reset = append(append([]string(nil), init.Reset...), extra.Reset...)
+			keep = len(extra.Statements) == 0
+		}
+		if len(init.Statements) == 0 {
+			return next(op)
+		}
+
+		pinner, ok := op.Helper().(ConnPinner)
+		if !ok {
+			return ErrConnPinUnsupported
+		}
+		if op.Handle == nil || op.Handle.DB() == nil {
+			return ErrHandleDBNotSet
+		}
+		conn, err := op.Handle.DB().Conn(ctx)
+		if err != nil {
+			return err
+		}
+		for _, s := range init.Statements {
+			if _, err := conn.ExecContext(ctx, s); err != nil {
+				discardConn(conn)
+				return fmt.Errorf("%w: %s: %w", ErrSessionInit, s, err)
+			}
+		}
+		var once sync.Once
+		release := func() {
+			once.Do(func() { releaseConn(conn, init.Reset, keep) })
+		}
+		if err := next(op); err != nil {
+			release()
+			return err
+		}
+		pinner.PinConn(conn)
+		// The helper keeps the released connection pinned, so that its statements fail rather than
+		// run on the pool without the session set up
+		stop := context.AfterFunc(ctx, release)
+		op.SetValue(sessionConnKey{}, func() {
+			stop()
+			pinner.PinConn(nil)
+			release()
+		})
+		return nil
+	}
+}
+
+// releaseSession unpins and releases the connection pinned for the helper running the operation
+func releaseSession(op *Operation) {
+	if rel, ok := op.Value(sessionConnKey{}).(func()); ok {
+		rel()
+		op.SetValue(sessionConnKey{}, nil)
+	}
+}
+
+// releaseConn runs the reset statements and returns the connection to the pool, or discards it when they fail.
+// Without reset statements, the connection goes back to the pool if keep is set and is discarded otherwise.
+func releaseConn(conn *sql.Conn, reset []string, keep bool) {
+	if len(reset) == 0 && !keep {
+		discardConn(conn)
+		return
+	}
+	// The context of Acquire may be over, the reset must still run
+	for _, s := range reset {
+		if _, err := conn.ExecContext(context.Background(), s); err != nil {
+			discardConn(conn)
+			return
+		}
+	}
+	_ = conn.Close()
+}
+
+// discardConn closes the connection instead of returning it to the pool
+func discardConn(conn *sql.Conn) {
+	_ = conn.Raw(func(any) error {
+		return driver.ErrBadConn
+	})
+	_ = conn.Close()
+}
@@ -0,0 +1,205 @@
+package datahelperlite
+
+import (
+	"context"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+type queryTagsKey struct{}
+
+// WithQueryTag returns a context that carries a query tag. Tags are written into statements by SQLCommenter.
+func WithQueryTag(ctx context.Context, key, value string) context.Context {
+	return WithQueryTags(ctx, map[string]string{key: value})
+}
+
+// WithQueryTags returns a context that carries query tags, merged over the tags already in the context
+func WithQueryTags(ctx context.Context, tags map[string]string) context.Context {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	old := QueryTags(ctx)
+	merged := make(map[string]string, len(old)+len(tags))
+	for k, v := range old {
+		merged[k] = v
+	}
+	for k, v := range tags {
+		merged[k] = v
+	}
+	return context.WithValue(ctx, queryTagsKey{}, merged)
+}
+
+// QueryTags returns the query tags of a context
+func QueryTags(ctx context.Context) map[string]string {
+	if ctx == nil {
+		return nil
+	}
+	tags, _ := ctx.Value(queryTagsKey{}).(map[string]string)
+	return tags
+}
+
+// CommentOptions configures SQLCommenter
+type CommentOptions struct {
+	App     string                           // Application name written as the app tag
+	Tags    map[string]string                // Static tags written into every statement
+	TraceID func(ctx context.Context) string // Returns the trace id written as the trace tag, such as a W3C traceparent
+	Prepend bool                             // Write the comment before the statement instead of after it
+}
+
+// commentedMethods are the operations whose statements are tagged
+var commentedMethods = map[string]bool{
+	"Exec":       true,
+	"Exists":     true,
+	"Query":      true,
+	"QueryArray": true,
+	"QueryRow":   true,
+}
+
+type statementCommentKey struct{}
+
+// statementComment is the comment a SQLCommenter hands to the helper it wraps
+type statementComment struct {
+	text    string
+	prepend bool
+}
+
+// SQLCommenter returns an interceptor that adds a sqlcommenter-style comment to statements.
+//
+// Tags are taken from the options and from the context given to Acquire (see WithQueryTags),
+// with the context tags winning. The comment looks like /*app='billing',route='%2Finvoices'*/.
+// Keys and values are URL-encoded, so a value can never close the comment.
+//
+// The statements that ExistsExt and UpsertReturning build are tagged by the wrapped helper, which
+// receives the comment in the context of its Acquire (see CommentStatement). Tagged statements carry
+// per-request values such as trace ids, so helpers should not keep them in prepared statement
+// caches (see HasQueryTags); fingerprints and result cache keys leave comments out.
+func SQLCommenter(opts CommentOptions) Interceptor {
+	return func(op *Operation, next Invoker) error {
+		if op.Method == "Acquire" {
+			if c := opts.comment(op.Context); c != "" {
+				op.Context = context.WithValue(op.Context, statementCommentKey{}, statementComment{text: c, prepend: opts.Prepend})
+			}
+			return next(op)
+		}
+		if !commentedMethods[op.Method] || op.SQL == "" {
+			return next(op)
+		}
+		op.SQL = addComment(op.SQL, opts.comment(op.Context), opts.Prepend)
+		return next(op)
+	}
+}
+
+// comment returns the comment of the tags of the options and of a context
+func (opts CommentOptions) comment(ctx context.Context) string {
+	tags := make(map[string]string, len(opts.Tags)+4)
+	for k, v := range opts.Tags {
+		tags[k] = v
+	}
+	if opts.App != "" {
+		tags["app"] = opts.App
+	}
+	if opts.TraceID != nil && ctx != nil {
+		if id := opts.TraceID(ctx); id != "" {
+			tags["trace"] = id
+		}
+	}
+	for k, v := range QueryTags(ctx) {
+		tags[k] = v
+	}
+	return SQLComment(tags)
+}
+
+// addComment writes a comment before a statement or after it, ahead of its terminating semicolon.
+// After a statement ending with a -- comment, it goes on a line of its own.
+func addComment(sql, c string, prepend bool) string {
+	switch {
+	case c == "":
+		return sql
+	case prepend:
+		return c + " " + sql
+	}
+	if endsWithLineComment(sql) {
+		// On the same line, the comment would swallow the tag
+		return strings.TrimRight(sql, " \t\r\n") + "\n" + c
+	}
+	body := strings.TrimRight(sql, " \t\r\n;")
+	if strings.HasSuffix(strings.TrimRight(sql, " \t\r\n"), ";") {
+		return body + " " + c + ";"
+	}
+	return body + " " + c
+}
+
+// endsWithLineComment reports if the last token of a statement is a -- comment
+func endsWithLineComment(sql string) bool {
+	if !strings.Contains(sql, "--") {
+		return false
+	}
+	toks := lexSQL(sql)
+	for i := len(toks) - 1; i >= 0; i-- {
+		if toks[i].kind != tokSpace {
+			return toks[i].kind == tokComment && strings.HasPrefix(toks[i].text, "--")
+		}
+	}
+	return false
+}
+
+// CommentStatement returns a statement tagged with the comment of the SQLCommenter that handed the context
+// to Acquire, or the statement as it is when there is none. Helpers call it with the context of their
+// Acquire on the statements they build themselves, such as those of ExistsExt and UpsertReturning.
+func CommentStatement(ctx context.Context, sql string) string {
+	if ctx == nil {
+		return sql
+	}
+	c, ok := ctx.Value(statementCommentKey{}).(statementComment)
+	if !ok {
+		return sql
+	}
+	return addComment(sql, c.text, c.prepend)
+}
+
+// HasQueryTags reports if a statement holds a sqlcommenter comment, such as those written by SQLCommenter
+func HasQueryTags(sql string) bool {
+	if !strings.Contains(sql, "/*") || !strings.Contains(sql, "='") {
+		return false
+	}
+	for _, t := range lexSQL(sql) {
+		if t.kind == tokComment && strings.HasPrefix(t.text, "/*") && strings.Contains(t.text, "='") {
+			return true
+		}
+	}
+	return false
+}
+
+// SQLComment formats tags as a sqlcommenter comment with the keys sorted. It returns an empty string when there are no tags.
+func SQLComment(tags map[string]string) string {
+	if len(tags) == 0 {
+		return ""
+	}
+	keys := make([]string, 0, len(tags))
+	for k := range tags {
+		if k != "" {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	var sb strings.Builder
+	sb.WriteString("/*")
+	for i, k := range keys {
+		if i > 0 {
+			sb.WriteByte(',')
+		}
+		sb.WriteString(commentEscape(k))
+		sb.WriteString("='")
+		sb.WriteString(commentEscape(tags[k]))
+		sb.WriteByte('\'')
+	}
+	sb.WriteString("*/")
+	return sb.String()
+}
+
+// commentEscape URL-encodes a key or value. The encoding also covers the single quotes that the sqlcommenter
+// specification requires to be escaped.
+func commentEscape(s string) string {
+	return strings.ReplaceAll(url.QueryEscape(s), "+", "%20")
+}
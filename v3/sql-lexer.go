@@ -0,0 +1,271 @@
+package datahelperlite
+
+import (
+	"strings"
+)
+
+// tokenKind is the kind of a lexed SQL token
+type tokenKind uint8
+
+// SQL token kinds
+const (
+	tokSpace       tokenKind = iota // Run of whitespace
+	tokComment                      // -- line comment or /* block comment */
+	tokWord                         // Keyword or bare identifier
+	tokQuotedIdent                  // "ident", `ident` or [ident]
+	tokString                       // 'text', N'text' or $tag$text$tag$
+	tokNumber                       // Numeric literal
+	tokPlaceholder                  // ?, $1, @p1, @name or :name
+	tokPunct                        // Operator or punctuation
+)
+
+// token is a lexed SQL token
+type token struct {
+	kind tokenKind
+	text string
+}
+
+// lexSQL splits a statement into tokens. Concatenating the token texts gives back the statement.
+//
+// It is not a parser. It only knows enough to tell literals, quoted identifiers, comments
+// and placeholders apart, so that text inside quotes and comments is never mistaken for SQL.
+func lexSQL(q string) []token {
+	toks := make([]token, 0, len(q)/4)
+	i := 0
+	emit := func(kind tokenKind, end int) {
+		toks = append(toks, token{kind: kind, text: q[i:end]})
+		i = end
+	}
+	for i < len(q) {
+		c := q[i]
+		switch {
+		case isSpace(c):
+			j := i + 1
+			for j < len(q) && isSpace(q[j]) {
+				j++
+			}
+			emit(tokSpace, j)
+		case c == '-' && peek(q, i+1) == '-':
+			j := strings.IndexByte(q[i:], '\n')
+			if j < 0 {
+				j = len(q) - i
+			}
+			emit(tokComment, i+j)
+		case c == '/' && peek(q, i+1) == '*':
+			j := strings.Index(q[i+2:], "*/")
+			if j < 0 {
+				emit(tokComment, len(q))
+				continue
+			}
+			emit(tokComment, i+2+j+2)
+		case c == '\'':
+			emit(tokString, quoteEnd(q, i+1, '\''))
+		case (c == 'N' || c == 'n' || c == 'E' || c == 'e') && peek(q, i+1) == '\'' && !isWordByte(prevByte(q, i)):
+			emit(tokString, quoteEnd(q, i+2, '\''))
+		case c == '"':
+			emit(tokQuotedIdent, quoteEnd(q, i+1, '"'))
+		case c == '`':
+			emit(tokQuotedIdent, quoteEnd(q, i+1, '`'))
+		case c == '[':
+			emit(tokQuotedIdent, quoteEnd(q, i+1, ']'))
+		case c == '?':
+			emit(tokPlaceholder, i+1)
+		case c == '$' && isDigit(peek(q, i+1)):
+			j := i + 1
+			for j < len(q) && isDigit(q[j]) {
+				j++
+			}
+			emit(tokPlaceholder, j)
+		case c == '$' && !isWordByte(prevByte(q, i)):
+			// Dollar-quoted string such as $$text$$ or $fn$text$fn$
+			if tag, ok := dollarTag(q, i); ok {
+				if j := strings.Index(q[i+len(tag):], tag); j >= 0 {
+					emit(tokString, i+len(tag)+j+len(tag))
+					continue
+				}
+				emit(tokString, len(q))
+				continue
+			}
+			emit(tokPunct, i+1)
+		case c == '@' && peek(q, i+1) == '@':
+			emit(tokWord, wordEnd(q, i+2))
+		case c == '@' && isWordStart(peek(q, i+1)):
+			emit(tokPlaceholder, wordEnd(q, i+1))
+		case c == ':' && isWordStart(peek(q, i+1)) && prevByte(q, i) != ':':
+			emit(tokPlaceholder, wordEnd(q, i+1))
+		case isDigit(c) || (c == '.' && isDigit(peek(q, i+1))):
+			emit(tokNumber, numberEnd(q, i))
+		case isWordStart(c):
+			emit(tokWord, wordEnd(q, i))
+		default:
+			if i+1 < len(q) {
+				switch q[i : i+2] {
+				case "<=", ">=", "<>", "!=", "::", "||", "->":
+					emit(tokPunct, i+2)
+					continue
+				}
+			}
+			emit(tokPunct, i+1)
+		}
+	}
+	return toks
+}
+
+// SplitStatements splits a script into its statements, without the separators.
+//
+// Statements end at semicolons. A script with lines holding only GO, the batch separator of SQL Server
+// tools, is split at those lines only: its batches are sent whole, so that the semicolons inside the
+// bodies of procedures and triggers do not end them. Separators inside literals, quoted identifiers,
+// dollar-quoted bodies and comments are left alone. Statements that are empty or only hold comments are dropped.
+func SplitStatements(script string) []string {
+	var (
+		out  []string
+		sb   strings.Builder
+		code bool // the statement has more than space and comments
+	)
+	flush := func() {
+		if code {
+			out = append(out, strings.TrimSpace(sb.String()))
+		}
+		sb.Reset()
+		code = false
+	}
+	toks := lexSQL(script)
+	batches := false
+	for i := range toks {
+		if isBatchSeparator(toks, i) {
+			batches = true
+			break
+		}
+	}
+	separated := false // the line of a GO goes on
+	for i, t := range toks {
+		if separated {
+			// Drop the rest of the line of a GO, which may hold a comment
+			if t.kind == tokComment || (t.kind == tokSpace && !strings.Contains(t.text, "\n")) {
+				continue
+			}
+			separated = false
+		}
+		switch {
+		case batches && isBatchSeparator(toks, i):
+			flush()
+			separated = true
+			continue
+		case !batches && t.kind == tokPunct && t.text == ";":
+			flush()
+			continue
+		case t.kind != tokSpace && t.kind != tokComment:
+			code = true
+		}
+		sb.WriteString(t.text)
+	}
+	flush()
+	return out
+}
+
+// isBatchSeparator reports if the token at i is a GO alone on its line
+func isBatchSeparator(toks []token, i int) bool {
+	t := toks[i]
+	return t.kind == tokWord && strings.EqualFold(t.text, "GO") && lineBreakAt(toks, i-1, -1) && lineBreakAt(toks, i+1, 1)
+}
+
+// lineBreakAt reports if a line break, or the edge of the script, comes before (step -1) or after (step 1)
+// the token at i, with only blanks in between. A line comment may end the line.
+func lineBreakAt(toks []token, i, step int) bool {
+	for ; i >= 0 && i < len(toks); i += step {
+		switch t := toks[i]; {
+		case t.kind == tokSpace && strings.Contains(t.text, "\n"):
+			return true
+		case t.kind == tokSpace:
+		case t.kind == tokComment && step > 0:
+			return strings.HasPrefix(t.text, "--")
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// quoteEnd returns the index after the closing quote, treating a doubled quote as an escaped one
+func quoteEnd(q string, from int, quote byte) int {
+	for j := from; j < len(q); j++ {
+		if q[j] != quote {
+			continue
+		}
+		if quote != ']' && peek(q, j+1) == quote {
+			j++
+			continue
+		}
+		return j + 1
+	}
+	return len(q)
+}
+
+// dollarTag returns the opening tag of a dollar-quoted string starting at i
+func dollarTag(q string, i int) (string, bool) {
+	j := i + 1
+	for j < len(q) && isWordByte(q[j]) && q[j] != '$' {
+		j++
+	}
+	if j < len(q) && q[j] == '$' {
+		return q[i : j+1], true
+	}
+	return "", false
+}
+
+func wordEnd(q string, from int) int {
+	j := from
+	for j < len(q) && isWordByte(q[j]) {
+		j++
+	}
+	return j
+}
+
+func numberEnd(q string, from int) int {
+	j := from
+	for j < len(q) {
+		c := q[j]
+		switch {
+		case isDigit(c) || c == '.':
+		case (c == 'e' || c == 'E') && j > from:
+			if n := peek(q, j+1); n == '+' || n == '-' {
+				j++
+			}
+		default:
+			return j
+		}
+		j++
+	}
+	return j
+}
+
+func peek(q string, i int) byte {
+	if i < len(q) {
+		return q[i]
+	}
+	return 0
+}
+
+func prevByte(q string, i int) byte {
+	if i > 0 {
+		return q[i-1]
+	}
+	return 0
+}
+
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\f' || c == '\v'
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func isWordStart(c byte) bool {
+	return c == '_' || c == '#' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || c >= 0x80
+}
+
+func isWordByte(c byte) bool {
+	return isWordStart(c) || isDigit(c) || c == '$'
+}
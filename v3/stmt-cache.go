@@ -0,0 +1,269 @@
+package datahelperlite
+
+import (
+	"container/list"
+	"context"
+	"database/sql"
+	"sync"
+)
+
+// DefaultStmtCacheSize is the capacity of the statement caches created by StmtCacheFor
+var DefaultStmtCacheSize = 256
+
+// StmtCacheStats are the statistics of a prepared statement cache
+type StmtCacheStats struct {
+	Size      int    // Statements in the cache
+	Capacity  int    // Maximum statements in the cache
+	Hits      uint64 // Lookups served from the cache
+	Misses    uint64 // Lookups that prepared a statement
+	Evictions uint64 // Statements closed to make room or by invalidation
+}
+
+// StmtCache is an LRU cache of prepared statements of one connection pool.
+//
+// Helper implementations key it by the statement as it is sent to the server, that is,
+// after InterpolateTable and ReplaceQueryParamMarker. Statements prepared on another
+// *sql.DB than the cached ones, as after a reconnection, invalidate the cache. Helpers leave
+// out the statements that Cacheable rejects.
+type StmtCache struct {
+	mu       sync.Mutex
+	capacity int
+	db       *sql.DB
+	ll       list.List // of *cachedStmt, most recent first
+	items    map[string]*list.Element
+	kinds    map[string]bool // Cacheable of queries without query tags, up to four times the capacity
+	stats    StmtCacheStats
+}
+
+type cachedStmt struct {
+	query   string
+	stmt    *sql.Stmt
+	refs    int  // callers using the statement
+	evicted bool // close when the last caller is done
+}
+
+// NewStmtCache creates a prepared statement cache that holds up to capacity statements
+func NewStmtCache(capacity int) *StmtCache {
+	if capacity <= 0 {
+		capacity = DefaultStmtCacheSize
+	}
+	return &StmtCache{
+		capacity: capacity,
+		items:    make(map[string]*list.Element),
+		kinds:    make(map[string]bool),
+	}
+}
+
+// Cacheable reports if a query can go through the cache. Scripts of several statements, which drivers
+// cannot prepare, and statements with query tags (see HasQueryTags), which are unique per request, cannot.
+//
+// The answer is kept for queries without query tags, so that their text is read once.
+func (c *StmtCache) Cacheable(query string) bool {
+	c.mu.Lock()
+	_, cached := c.items[query]
+	ok, known := c.kinds[query]
+	c.mu.Unlock()
+	switch {
+	case cached:
+		return true
+	case known:
+		return ok
+	case HasQueryTags(query):
+		return false
+	}
+	ok = len(SplitStatements(query)) <= 1
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.kinds) >= 4*c.capacity {
+		clear(c.kinds)
+	}
+	c.kinds[query] = ok
+	return ok
+}
+
+// Do runs fn with a prepared statement of the query, preparing it on a miss.
+//
+// When tx is not nil, fn receives the transaction-specific statement (see sql.Tx.StmtContext).
+// The statement must not be used after fn returns.
+func (c *StmtCache) Do(ctx context.Context, db *sql.DB, tx *sql.Tx, query string, fn func(st *sql.Stmt) error) error {
+	if db == nil {
+		return ErrHandleDBNotSet
+	}
+	cs, err := c.acquire(ctx, db, query)
+	if err != nil {
+		return err
+	}
+	defer c.release(cs)
+
+	st := cs.stmt
+	if tx != nil {
+		st = tx.StmtContext(ctx, st)
+		defer st.Close()
+	}
+	return fn(st)
+}
+
+// Invalidate closes and removes all statements
+func (c *StmtCache) Invalidate() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.invalidate()
+}
+
+// Stats returns the statistics of the cache
+func (c *StmtCache) Stats() StmtCacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	st := c.stats
+	st.Size = c.ll.Len()
+	st.Capacity = c.capacity
+	return st
+}
+
+// ReconnectHook returns a hook for Reconnect (see OnReconnectEvent) that invalidates the cache when the connection is lost or re-established
+func (c *StmtCache) ReconnectHook() func(ReconnectEvent) {
+	return func(ev ReconnectEvent) {
+		switch ev.Kind {
+		case ReconnectLost, ReconnectConnected:
+			c.Invalidate()
+		}
+	}
+}
+
+func (c *StmtCache) acquire(ctx context.Context, db *sql.DB, query string) (*cachedStmt, error) {
+	c.mu.Lock()
+	if c.db != db {
+		c.invalidate()
+		c.db = db
+	}
+	if el, ok := c.items[query]; ok {
+		c.ll.MoveToFront(el)
+		cs := el.Value.(*cachedStmt)
+		cs.refs++
+		c.stats.Hits++
+		c.mu.Unlock()
+		return cs, nil
+	}
+	c.stats.Misses++
+	c.mu.Unlock()
+
+	// Prepare outside of the lock, it is a round trip to the server
+	stmt, err := db.PrepareContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.db != db {
+		// Invalidated while preparing, do not cache a statement of a stale pool
+		return &cachedStmt{query: query, stmt: stmt, refs: 1, evicted: true}, nil
+	}
+	if el, ok := c.items[query]; ok {
+		// Prepared concurrently, keep the cached one
+		_ = stmt.Close()
+		cs := el.Value.(*cachedStmt)
+		cs.refs++
+		return cs, nil
+	}
+	cs := &cachedStmt{query: query, stmt: stmt, refs: 1}
+	c.items[query] = c.ll.PushFront(cs)
+	for c.ll.Len() > c.capacity {
+		c.evict(c.ll.Back())
+	}
+	return cs, nil
+}
+
+func (c *StmtCache) release(cs *cachedStmt) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	cs.refs--
+	if cs.evicted && cs.refs == 0 {
+		_ = cs.stmt.Close()
+	}
+}
+
+// evict removes an element, closing its statement when no caller uses it. It must be called with the lock held.
+func (c *StmtCache) evict(el *list.Element) {
+	cs := c.ll.Remove(el).(*cachedStmt)
+	delete(c.items, cs.query)
+	cs.evicted = true
+	c.stats.Evictions++
+	if cs.refs == 0 {
+		_ = cs.stmt.Close()
+	}
+}
+
+func (c *StmtCache) invalidate() {
+	for el := c.ll.Front(); el != nil; el = c.ll.Front() {
+		c.evict(el)
+	}
+	c.db = nil
+}
+
+var (
+	stmtCachesMu sync.Mutex
+	stmtCaches   = make(map[*sql.DB]*StmtCache)
+)
+
+// StmtCacheFor returns the prepared statement cache of a connection pool, creating it with DefaultStmtCacheSize
+// on first use. Handles over the same pool, such as a BreakerHandle or a RoutingHandle and the handle they
+// wrap, share it. It returns an empty cache that is not kept for a nil pool.
+func StmtCacheFor(db *sql.DB) *StmtCache {
+	if db == nil {
+		return NewStmtCache(DefaultStmtCacheSize)
+	}
+	stmtCachesMu.Lock()
+	defer stmtCachesMu.Unlock()
+	c, ok := stmtCaches[db]
+	if !ok {
+		c = NewStmtCache(DefaultStmtCacheSize)
+		stmtCaches[db] = c
+	}
+	return c
+}
+
+// DropStmtCache closes the statements of the prepared statement cache of a connection pool and forgets the cache.
+// Handles call it when they close their pool, so that the caches of closed pools do not pile up.
+func DropStmtCache(db *sql.DB) {
+	stmtCachesMu.Lock()
+	c, ok := stmtCaches[db]
+	delete(stmtCaches, db)
+	stmtCachesMu.Unlock()
+	if ok {
+		c.Invalidate()
+	}
+}
+
+// SetStmtCache sets the prepared statement cache of a connection pool, such as one with a custom capacity
+func SetStmtCache(db *sql.DB, c *StmtCache) {
+	if db == nil {
+		return
+	}
+	stmtCachesMu.Lock()
+	defer stmtCachesMu.Unlock()
+	if old, ok := stmtCaches[db]; ok && old != c {
+		old.Invalidate()
+	}
+	stmtCaches[db] = c
+}
+
+// StmtCacheStatsByHandle returns the prepared statement cache statistics of all registered handles keyed by name
+func StmtCacheStatsByHandle() map[string]StmtCacheStats {
+	dbs := make(map[string]*sql.DB)
+	for name, h := range handlers() {
+		if !isReallyNil(h) {
+			dbs[name] = h.DB()
+		}
+	}
+	stmtCachesMu.Lock()
+	defer stmtCachesMu.Unlock()
+	snap := make(map[string]StmtCacheStats)
+	for name, db := range dbs {
+		if c, ok := stmtCaches[db]; ok {
+			snap[name] = c.Stats()
+		}
+	}
+	return snap
+}
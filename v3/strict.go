@@ -0,0 +1,157 @@
+package datahelperlite
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"slices"
+	"sync/atomic"
+)
+
+// Errors
+var (
+	ErrUnknownSavepoint error = errors.New(`savepoint was not marked or has ended`)
+	ErrSavepointExists  error = errors.New(`savepoint is already marked`)
+	ErrTxRolledBack     error = fmt.Errorf(`transaction was rolled back: %w`, sql.ErrTxDone)
+	ErrHelperReleased   error = errors.New(`helper was released`)
+)
+
+var strictMode atomic.Bool
+
+// SetStrictMode makes New return helpers wrapped with Strict. It is meant to be turned on in tests.
+func SetStrictMode(on bool) {
+	strictMode.Store(on)
+}
+
+// Strict wraps a helper so that misuse of transactions and savepoints fails with precise errors
+// before reaching the database. See StrictMode for the checks.
+func Strict(dh DataHelperLite) DataHelperLite {
+	if dh == nil {
+		return nil
+	}
+	if w, ok := dh.(*wrappedHelper); ok {
+		// The checks come first so that other interceptors do not see misuse
+		return w.clone(append([]Interceptor{StrictMode()}, w.interceptors...))
+	}
+	return Wrap(dh, StrictMode())
+}
+
+// strictState is the transaction state of a helper tracked by StrictMode
+type strictState struct {
+	acquired   bool
+	released   bool
+	tx         bool
+	manual     bool     // transaction begun with BeginManually
+	committed  bool     // the last transaction, begun with Begin, ended with a Commit, so a deferred Rollback is expected
+	rolledBack bool     // the last transaction ended with a Rollback
+	savepoints []string // marked savepoints, oldest first
+}
+
+type strictStateKey struct{}
+
+// StrictMode returns an interceptor that tracks the transaction and savepoint state of a helper and fails:
+//
+//   - operations before Acquire with ErrHandleNotSet, and after Release with ErrHelperReleased
+//   - Begin inside a transaction, and Acquire with an open one, with ErrHandleTxNotNil
+//   - Commit, Mark, Save, Discard and Rollback outside of a transaction with ErrNoTx, or with ErrTxRolledBack,
+//     which wraps sql.ErrTxDone, when the last transaction was rolled back
+//   - Mark of a marked savepoint with ErrSavepointExists
+//   - Save and Discard of a savepoint that was not marked, or was saved or discarded, with ErrUnknownSavepoint
+//
+// The deferred Rollback after the Commit of a Begin is let through, whether the Commit succeeded or not,
+// since a failed Commit ends the transaction too. Save and Discard end the savepoint and those marked after it.
+func StrictMode() Interceptor {
+	return func(op *Operation, next Invoker) error {
+		st, _ := op.Value(strictStateKey{}).(*strictState)
+		if st == nil {
+			st = &strictState{}
+			op.SetValue(strictStateKey{}, st)
+		}
+
+		switch op.Method {
+		case "Acquire":
+			if st.tx {
+				return ErrHandleTxNotNil
+			}
+			if err := next(op); err != nil {
+				return err
+			}
+			*st = strictState{acquired: true}
+			return nil
+		case "Release":
+			err := next(op)
+			*st = strictState{released: true}
+			return err
+		}
+		if st.released {
+			return ErrHelperReleased
+		}
+		if !st.acquired {
+			return ErrHandleNotSet
+		}
+
+		switch op.Method {
+		case "Begin", "BeginManually":
+			if st.tx {
+				return ErrHandleTxNotNil
+			}
+			if err := next(op); err != nil {
+				return err
+			}
+			*st = strictState{acquired: true, tx: true, manual: op.Method == "BeginManually"}
+			return nil
+		case "Commit":
+			if !st.tx {
+				return st.noTx()
+			}
+			err := next(op)
+			*st = strictState{acquired: true, committed: !st.manual}
+			return err
+		case "Rollback":
+			if !st.tx {
+				if st.committed {
+					st.committed = false
+					return next(op)
+				}
+				return st.noTx()
+			}
+			err := next(op)
+			*st = strictState{acquired: true, rolledBack: true}
+			return err
+		case "Mark":
+			if !st.tx {
+				return st.noTx()
+			}
+			if slices.Contains(st.savepoints, op.Name) {
+				return fmt.Errorf("%w: %s", ErrSavepointExists, op.Name)
+			}
+			if err := next(op); err != nil {
+				return err
+			}
+			st.savepoints = append(st.savepoints, op.Name)
+			return nil
+		case "Save", "Discard":
+			if !st.tx {
+				return st.noTx()
+			}
+			i := slices.Index(st.savepoints, op.Name)
+			if i < 0 {
+				return fmt.Errorf("%w: %s", ErrUnknownSavepoint, op.Name)
+			}
+			if err := next(op); err != nil {
+				return err
+			}
+			st.savepoints = st.savepoints[:i]
+			return nil
+		}
+		return next(op)
+	}
+}
+
+// noTx returns the error of a transaction operation outside of a transaction
+func (st *strictState) noTx() error {
+	if st.rolledBack {
+		return ErrTxRolledBack
+	}
+	return ErrNoTx
+}
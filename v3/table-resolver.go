@@ -0,0 +1,142 @@
+package datahelperlite
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+
+	dn "github.com/eaglebush/datainfo"
+)
+
+// Errors
+var (
+	ErrUnknownTable error = errors.New(`table is not mapped`)
+)
+
+// QuoteMode tells when a table resolver quotes identifiers
+type QuoteMode int
+
+// Quote modes
+const (
+	QuoteAsNeeded QuoteMode = iota // Quote reserved words and names that are not plain identifiers
+	QuoteNever                     // Use names as they are written
+	QuoteAlways                    // Quote every unquoted name part
+)
+
+// tablePlaceholderRx matches {table} and {schema.table} placeholders
+var tablePlaceholderRx = regexp.MustCompile("\\{((?:[a-zA-Z0-9_\\-.]|\\[[^\\]{}]*\\]|\"[^\"{}]*\"|`[^`{}]*`)+)\\}")
+
+// TableResolver replaces {table} and {schema.table} placeholders in statements with physical table names.
+//
+// A logical name found in Tables is replaced by its physical name, which may be schema-qualified, so that
+// tenants or archives can be pointed at other tables. Unqualified names get the Schema. Name parts are quoted
+// for the Dialect, or with Escape when it is set, according to Quote. Parts already quoted are left alone.
+type TableResolver struct {
+	Schema  string            // Schema of unqualified names
+	Tables  map[string]string // Physical names by logical name
+	Dialect Dialect           // Dialect used to quote names
+	Escape  string            // Quote characters overriding the dialect, such as `[]` or `"`
+	Quote   QuoteMode         // When to quote names
+	Strict  bool              // Fail on logical names that are not in Tables
+}
+
+// TableResolverFor creates a table resolver with the schema, dialect and escape characters of a database info
+func TableResolverFor(di *dn.DataInfo, tables map[string]string) *TableResolver {
+	tr := &TableResolver{Tables: tables, Dialect: DialectOf(di)}
+	if di == nil {
+		return tr
+	}
+	if di.Schema != nil {
+		tr.Schema = *di.Schema
+	}
+	if di.ReservedWordEscapeChar != nil {
+		tr.Escape = *di.ReservedWordEscapeChar
+	}
+	return tr
+}
+
+// Resolve replaces the table placeholders of a statement
+func (tr *TableResolver) Resolve(sql string) (string, error) {
+	if !strings.Contains(sql, "{") {
+		return sql, nil
+	}
+	var err error
+	out := tablePlaceholderRx.ReplaceAllStringFunc(sql, func(m string) string {
+		name, rerr := tr.Table(m[1 : len(m)-1])
+		if rerr != nil {
+			if err == nil {
+				err = rerr
+			}
+			return m
+		}
+		return name
+	})
+	if err != nil {
+		return sql, err
+	}
+	return out, nil
+}
+
+// Table returns the physical name of a logical table name
+func (tr *TableResolver) Table(logical string) (string, error) {
+	name := strings.Trim(logical, "{}")
+	physical, mapped := tr.Tables[name]
+	if !mapped {
+		if tr.Strict {
+			return "", fmt.Errorf("%w: %s", ErrUnknownTable, name)
+		}
+		physical = name
+	}
+	parts := splitIdent(physical)
+	if len(parts) == 1 && tr.Schema != "" {
+		parts = append([]string{tr.Schema}, parts...)
+	}
+	for i, p := range parts {
+		parts[i] = tr.quote(p)
+	}
+	return strings.Join(parts, "."), nil
+}
+
+func (tr *TableResolver) quote(part string) string {
+	if tr.Quote == QuoteNever || isQuotedIdent(part) {
+		return part
+	}
+	if tr.Quote == QuoteAsNeeded && !needsQuote(part) {
+		return part
+	}
+	switch len(tr.Escape) {
+	case 1:
+		return tr.Escape + strings.ReplaceAll(part, tr.Escape, tr.Escape+tr.Escape) + tr.Escape
+	case 2:
+		cl := tr.Escape[1:]
+		return tr.Escape[:1] + strings.ReplaceAll(part, cl, cl+cl) + cl
+	}
+	return tr.Dialect.QuoteIdent(part)
+}
+
+// splitIdent splits a qualified name at the dots outside of quotes
+func splitIdent(name string) []string {
+	var (
+		parts []string
+		start int
+		close byte
+	)
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		switch {
+		case close != 0:
+			if c == close {
+				close = 0
+			}
+		case c == '"' || c == '`':
+			close = c
+		case c == '[':
+			close = ']'
+		case c == '.':
+			parts = append(parts, name[start:i])
+			start = i + 1
+		}
+	}
+	return append(parts, name[start:])
+}
@@ -0,0 +1,162 @@
+package datahelperlite
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// Errors
+var (
+	ErrNoTenant      error = errors.New(`no tenant in the context`)
+	ErrInvalidTenant error = errors.New(`invalid tenant id`)
+)
+
+type tenantKey struct{}
+
+// WithTenant returns a context that makes helpers wrapped with Tenants work on the data of a tenant
+func WithTenant(ctx context.Context, id string) context.Context {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	return context.WithValue(ctx, tenantKey{}, id)
+}
+
+// TenantID returns the tenant id of a context
+func TenantID(ctx context.Context) (string, bool) {
+	if ctx == nil {
+		return "", false
+	}
+	id, ok := ctx.Value(tenantKey{}).(string)
+	return id, ok && id != ""
+}
+
+// Tenant is where the data of a tenant lives
+type Tenant struct {
+	ID     string            // Tenant id
+	Schema string            // Schema of the tenant tables
+	Handle DataHelperHandle  // Handle of the tenant database. Nil keeps the handle given to Acquire.
+	Tables map[string]string // Physical names by logical name, overriding the schema for some tables
+}
+
+// TenantResolver resolves a tenant id to the location of its data
+type TenantResolver interface {
+	ResolveTenant(ctx context.Context, id string) (Tenant, error)
+}
+
+// TenantResolverFunc is a function that implements TenantResolver
+type TenantResolverFunc func(ctx context.Context, id string) (Tenant, error)
+
+// ResolveTenant calls f(ctx, id)
+func (f TenantResolverFunc) ResolveTenant(ctx context.Context, id string) (Tenant, error) {
+	return f(ctx, id)
+}
+
+// SchemaPerTenant returns a resolver that maps a tenant id to a schema named by a format, such as "tenant_%s".
+// Ids must be plain identifiers, so that they cannot inject SQL.
+func SchemaPerTenant(format string) TenantResolver {
+	return TenantResolverFunc(func(_ context.Context, id string) (Tenant, error) {
+		if needsQuote(id) && !isDigits(id) {
+			return Tenant{}, fmt.Errorf("%w: %q", ErrInvalidTenant, id)
+		}
+		return Tenant{ID: id, Schema: fmt.Sprintf(format, id)}, nil
+	})
+}
+
+func isDigits(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if !isDigit(s[i]) {
+			return false
+		}
+	}
+	return s != ""
+}
+
+// TenantOptions configures the Tenants interceptor
+type TenantOptions struct {
+	Resolver   TenantResolver // Resolver of tenant ids. Nil uses the tenant id as the schema.
+	Required   bool           // Fail Acquire with ErrNoTenant when the context has no tenant
+	SearchPath bool           // Run SET LOCAL search_path to the tenant schema when a transaction begins. Only done on PostgreSQL.
+	Dialect    Dialect        // Dialect used to quote names. Derived from the handle when empty.
+	Quote      QuoteMode      // When to quote table names
+}
+
+type tenantStateKey struct{}
+
+// Tenants returns an interceptor that applies the tenant named in the context given to Acquire (see WithTenant).
+//
+// The tenant schema and table mapping are applied to {table} placeholders of statements and to the
+// table names of ExistsExt and UpsertReturning. A tenant with its own handle makes Acquire use that
+// handle instead, so Tenants should come before the interceptors that look at the handle.
+//
+// The search path is only set inside transactions, since a pool runs statements outside
+// of them on any of its connections, and only on PostgreSQL, the one dialect that has it.
+func Tenants(opts TenantOptions) Interceptor {
+	return func(op *Operation, next Invoker) error {
+		switch op.Method {
+		case "Acquire":
+			op.SetValue(tenantStateKey{}, nil)
+			id, ok := TenantID(op.Context)
+			if !ok {
+				if opts.Required {
+					return ErrNoTenant
+				}
+				return next(op)
+			}
+			resolver := opts.Resolver
+			if resolver == nil {
+				resolver = SchemaPerTenant("%s")
+			}
+			t, err := resolver.ResolveTenant(op.Context, id)
+			if err != nil {
+				return err
+			}
+			if t.Handle != nil {
+				op.Handle = t.Handle
+			}
+			if err := next(op); err != nil {
+				return err
+			}
+			dialect := opts.Dialect
+			if dialect == "" && op.Handle != nil {
+				dialect = DialectOf(op.Handle.DI())
+			}
+			op.SetValue(tenantStateKey{}, &TableResolver{
+				Schema:  t.Schema,
+				Tables:  t.Tables,
+				Dialect: dialect,
+				Quote:   opts.Quote,
+			})
+			return nil
+		}
+
+		tr, ok := op.Value(tenantStateKey{}).(*TableResolver)
+		if !ok {
+			return next(op)
+		}
+		switch op.Method {
+		case "Exec", "Exists", "Query", "QueryArray", "QueryRow":
+			sql, err := tr.Resolve(op.SQL)
+			if err != nil {
+				return err
+			}
+			op.SQL = sql
+		case "ExistsExt", "UpsertReturning":
+			table, err := tr.Table(op.Table)
+			if err != nil {
+				return err
+			}
+			op.Table = table
+		case "Begin", "BeginManually":
+			if err := next(op); err != nil || !opts.SearchPath || tr.Schema == "" || tr.Dialect != DialectPostgres {
+				return err
+			}
+			if _, err := op.Helper().Exec(`SET LOCAL search_path TO ` + tr.quote(tr.Schema)); err != nil {
+				_ = op.Helper().Rollback()
+				return err
+			}
+			return nil
+		}
+		return next(op)
+	}
+}
@@ -0,0 +1,170 @@
+package datahelperlite
+
+import (
+	"context"
+	"strings"
+)
+
+// TraceAttr is a span attribute
+type TraceAttr struct {
+	Key   string
+	Value any
+}
+
+// Span is a unit of traced work. It is small enough to be adapted to an OpenTelemetry span.
+type Span interface {
+	SetAttributes(attrs ...TraceAttr) // Add attributes to the span
+	RecordError(err error)            // Record an error on the span
+	End()                             // End the span
+}
+
+// Tracer starts spans. The returned context carries the new span as the parent of later spans.
+type Tracer interface {
+	Start(ctx context.Context, name string, attrs ...TraceAttr) (context.Context, Span)
+}
+
+// TraceOptions configures Tracing
+type TraceOptions struct {
+	System     string // Value of db.system. When empty it is taken from the driver name of the handle.
+	HandleName string // Name of the handle. When empty it is the name the handle was registered with.
+	OmitSQL    bool   // Do not record statements
+}
+
+// Attribute keys
+const (
+	AttrDBSystem     = `db.system`
+	AttrDBStatement  = `db.statement`
+	AttrDBOperation  = `db.operation`
+	AttrDBTable      = `db.sql.table`
+	AttrRowsAffected = `db.rows_affected`
+	AttrHandle       = `db.handle`
+	AttrTxID         = `db.transaction.id`
+	AttrTxOutcome    = `db.transaction.outcome`
+)
+
+type txSpanKey struct{}
+
+// txSpan is the span around a transaction, kept in the state of the helper
+type txSpan struct {
+	ctx  context.Context
+	span Span
+}
+
+// tracedMethods are the operations that get a span
+var tracedMethods = map[string]bool{
+	"Acquire":         true,
+	"Release":         true,
+	"Begin":           true,
+	"BeginManually":   true,
+	"Commit":          true,
+	"Rollback":        true,
+	"Mark":            true,
+	"Save":            true,
+	"Discard":         true,
+	"Exec":            true,
+	"Exists":          true,
+	"ExistsExt":       true,
+	"Next":            true,
+	"Ping":            true,
+	"Query":           true,
+	"QueryArray":      true,
+	"QueryRow":        true,
+	"UpsertReturning": true,
+}
+
+// Tracing returns an interceptor that opens a span per helper operation.
+//
+// Operations inside a transaction are children of a transaction span
+// that starts at Begin and ends at Commit or Rollback. The error of a failed Commit or Rollback
+// is recorded on the transaction span instead of its outcome.
+func Tracing(tracer Tracer, opts TraceOptions) Interceptor {
+	return func(op *Operation, next Invoker) error {
+		if tracer == nil || !tracedMethods[op.Method] {
+			return next(op)
+		}
+
+		parent := op.Context
+		if parent == nil {
+			parent = context.Background()
+		}
+		ts, _ := op.Value(txSpanKey{}).(*txSpan)
+		if ts != nil {
+			parent = ts.ctx
+		}
+
+		attrs := []TraceAttr{{Key: AttrDBOperation, Value: op.Method}}
+		if sys := traceSystem(opts.System, op.Handle); sys != "" {
+			attrs = append(attrs, TraceAttr{Key: AttrDBSystem, Value: sys})
+		}
+		if name := opts.HandleName; name != "" {
+			attrs = append(attrs, TraceAttr{Key: AttrHandle, Value: name})
+		} else if name := HandleName(op.Handle); name != "" {
+			attrs = append(attrs, TraceAttr{Key: AttrHandle, Value: name})
+		}
+		if op.SQL != "" && !opts.OmitSQL {
+			attrs = append(attrs, TraceAttr{Key: AttrDBStatement, Value: op.SQL})
+		}
+		if op.Table != "" {
+			attrs = append(attrs, TraceAttr{Key: AttrDBTable, Value: op.Table})
+		}
+
+		begin := (op.Method == "Begin" || op.Method == "BeginManually") && ts == nil
+		if begin {
+			tctx, tspan := tracer.Start(parent, "transaction", attrs[1:]...)
+			ts = &txSpan{ctx: tctx, span: tspan}
+			parent = tctx
+		}
+
+		_, span := tracer.Start(parent, op.Method, attrs...)
+		err := next(op)
+		if op.Method == "Exec" && err == nil {
+			span.SetAttributes(TraceAttr{Key: AttrRowsAffected, Value: op.RowsAffected})
+		}
+		if op.TxID != "" {
+			span.SetAttributes(TraceAttr{Key: AttrTxID, Value: op.TxID})
+		}
+		if err != nil {
+			span.RecordError(err)
+		}
+		span.End()
+
+		switch {
+		case begin && err == nil:
+			ts.span.SetAttributes(TraceAttr{Key: AttrTxID, Value: op.TxID})
+			op.SetValue(txSpanKey{}, ts)
+		case begin:
+			// The transaction never started
+			ts.span.RecordError(err)
+			ts.span.End()
+		case ts != nil && (op.Method == "Rollback" || op.Method == "Commit"):
+			// A failed Commit ends the transaction too
+			if err != nil {
+				ts.span.RecordError(err)
+			} else {
+				ts.span.SetAttributes(TraceAttr{Key: AttrTxOutcome, Value: strings.ToLower(op.Method)})
+			}
+			ts.span.End()
+			op.SetValue(txSpanKey{}, nil)
+		}
+		return err
+	}
+}
+
+// traceSystem returns the db.system of a handle
+func traceSystem(system string, h DataHelperHandle) string {
+	if system != "" || isReallyNil(h) {
+		return system
+	}
+	di := h.DI()
+	if di == nil || di.DriverName == nil {
+		return ""
+	}
+	switch d := strings.ToLower(*di.DriverName); d {
+	case "postgres", "pgx", "pq":
+		return "postgresql"
+	case "sqlserver", "mssql":
+		return "mssql"
+	default:
+		return d
+	}
+}
@@ -0,0 +1,137 @@
+package datahelperlite
+
+import (
+	"errors"
+)
+
+// Errors
+var (
+	ErrTxCallbacksUnsupported error = errors.New(`helper does not support transaction callbacks`)
+	ErrTxStateUnsupported     error = errors.New(`helper does not report its transaction state`)
+)
+
+// TxCallbacks is implemented by helpers that run callbacks when their transaction ends.
+// Helpers returned by Wrap implement it.
+type TxCallbacks interface {
+	OnCommit(fn func()) error        // Run fn after the transaction commits
+	OnRollback(fn func(error)) error // Run fn with the error of Rollback after the transaction is rolled back
+}
+
+// OnCommit registers a function to run after the transaction of a helper commits.
+//
+// It fails with ErrNoTx outside of a transaction and with ErrTxCallbacksUnsupported when the helper
+// does not implement TxCallbacks. Functions registered after a Mark are dropped when that savepoint is discarded.
+func OnCommit(dh DataHelperLite, fn func()) error {
+	tc, ok := dh.(TxCallbacks)
+	if !ok {
+		return ErrTxCallbacksUnsupported
+	}
+	return tc.OnCommit(fn)
+}
+
+// OnRollback registers a function to run after the transaction of a helper is rolled back, or fails to commit.
+//
+// It fails like OnCommit, and functions registered after a Mark are also dropped when that savepoint is discarded.
+func OnRollback(dh DataHelperLite, fn func(error)) error {
+	tc, ok := dh.(TxCallbacks)
+	if !ok {
+		return ErrTxCallbacksUnsupported
+	}
+	return tc.OnRollback(fn)
+}
+
+// InTx reports if a helper has an open transaction, without side effects.
+//
+// It fails with ErrTxStateUnsupported when the helper does not tell it with an InTx method,
+// as helpers returned by Wrap and Route do.
+func InTx(dh DataHelperLite) (bool, error) {
+	ts, ok := dh.(interface{ InTx() bool })
+	if !ok {
+		return false, ErrTxStateUnsupported
+	}
+	return ts.InTx(), nil
+}
+
+// txScope holds the callbacks registered in a transaction, or in a savepoint of it
+type txScope struct {
+	savepoint  string
+	onCommit   []func()
+	onRollback []func(error)
+}
+
+func (w *wrappedHelper) OnCommit(fn func()) error {
+	if len(w.scopes) == 0 {
+		return ErrNoTx
+	}
+	s := &w.scopes[len(w.scopes)-1]
+	s.onCommit = append(s.onCommit, fn)
+	return nil
+}
+
+func (w *wrappedHelper) InTx() bool {
+	return w.txID != ""
+}
+
+func (w *wrappedHelper) OnRollback(fn func(error)) error {
+	if len(w.scopes) == 0 {
+		return ErrNoTx
+	}
+	s := &w.scopes[len(w.scopes)-1]
+	s.onRollback = append(s.onRollback, fn)
+	return nil
+}
+
+// markScope opens the scope of a savepoint
+func (w *wrappedHelper) markScope(name string) {
+	if len(w.scopes) > 0 {
+		w.scopes = append(w.scopes, txScope{savepoint: name})
+	}
+}
+
+// endScope ends the scope of a savepoint and those opened after it, keeping their callbacks when saved
+func (w *wrappedHelper) endScope(name string, keep bool) {
+	i := len(w.scopes) - 1
+	for i > 0 && w.scopes[i].savepoint != name {
+		i--
+	}
+	if i <= 0 {
+		return
+	}
+	if keep {
+		parent := &w.scopes[i-1]
+		for _, s := range w.scopes[i:] {
+			parent.onCommit = append(parent.onCommit, s.onCommit...)
+			parent.onRollback = append(parent.onRollback, s.onRollback...)
+		}
+	}
+	w.scopes = w.scopes[:i]
+}
+
+// endTx runs the callbacks of the ended transaction in the order they were registered
+func (w *wrappedHelper) endTx(committed bool, err error) {
+	scopes := w.scopes
+	w.scopes = nil
+	for _, s := range scopes {
+		if committed {
+			for _, fn := range s.onCommit {
+				fn()
+			}
+			continue
+		}
+		for _, fn := range s.onRollback {
+			fn(err)
+		}
+	}
+}
+
+func (r *routedHelper) OnCommit(fn func()) error {
+	return OnCommit(r.primary, fn)
+}
+
+func (r *routedHelper) OnRollback(fn func(error)) error {
+	return OnRollback(r.primary, fn)
+}
+
+func (r *routedHelper) InTx() bool {
+	return r.inTx
+}